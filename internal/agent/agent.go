@@ -0,0 +1,258 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package agent implements the systemd password agent protocol.
+//
+// See https://www.freedesktop.org/wiki/Software/systemd/PasswordAgents/
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/unit"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// AskPasswordDir is the directory where systemd queues password requests.
+	AskPasswordDir = "/run/systemd/ask-password/"
+	// cryptsetupIDPrefix marks password requests from systemd-cryptsetup.
+	cryptsetupIDPrefix = "cryptsetup:"
+	// rescanInterval is the period for re-scanning the queue, in case any
+	// inotify event got lost.
+	rescanInterval = 5 * time.Second
+)
+
+// Request is a pending systemd password request.
+type Request struct {
+	// Path is the path of the `ask.*` file describing this request.
+	Path     string
+	Socket   string
+	ID       string
+	Message  string
+	PID      int
+	NotAfter uint64
+}
+
+// Pending returns all valid password requests queued in `dir`.
+func Pending(dir string) ([]Request, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s", dir)
+	}
+
+	reqs := []Request{}
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), "ask.") {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		req, err := ParseRequest(path)
+		if err != nil {
+			logrus.Debugf("skipping password request %s: %s", path, err)
+			continue
+		}
+		if req.Expired() {
+			continue
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// ParseRequest decodes a password request from an `ask.*` file.
+func ParseRequest(path string) (Request, error) {
+	req := Request{Path: path}
+	fp, err := os.Open(path)
+	if err != nil {
+		return req, err
+	}
+	defer fp.Close()
+	opts, err := unit.Deserialize(fp)
+	if err != nil {
+		return req, errors.Wrapf(err, "failed to parse %s", path)
+	}
+
+	for _, opt := range opts {
+		if opt.Section != "Ask" {
+			continue
+		}
+		switch opt.Name {
+		case "Socket":
+			req.Socket = opt.Value
+		case "Id":
+			req.ID = opt.Value
+		case "Message":
+			req.Message = opt.Value
+		case "PID":
+			req.PID, err = strconv.Atoi(opt.Value)
+		case "NotAfter":
+			req.NotAfter, err = strconv.ParseUint(opt.Value, 10, 64)
+		}
+		if err != nil {
+			return req, errors.Wrapf(err, "invalid %s in %s", opt.Name, path)
+		}
+	}
+	if req.Socket == "" {
+		return req, errors.Errorf("missing socket in %s", path)
+	}
+
+	return req, nil
+}
+
+// Expired returns whether the request deadline has passed.
+func (r Request) Expired() bool {
+	if r.NotAfter == 0 {
+		return false
+	}
+	return monotonicNow() > r.NotAfter
+}
+
+// Deadline returns the remaining time to answer the request, or zero if
+// the request has no deadline.
+func (r Request) Deadline() time.Duration {
+	if r.NotAfter == 0 {
+		return 0
+	}
+	now := monotonicNow()
+	if now >= r.NotAfter {
+		return time.Nanosecond
+	}
+	return time.Duration(r.NotAfter-now) * time.Microsecond
+}
+
+// Volume returns the target of a systemd-cryptsetup request, which is
+// either a volume name or an absolute device path.
+func (r Request) Volume() (string, bool) {
+	if !strings.HasPrefix(r.ID, cryptsetupIDPrefix) {
+		return "", false
+	}
+	target := strings.TrimPrefix(r.ID, cryptsetupIDPrefix)
+	// Friendly names are formatted as "description (volume)".
+	if strings.HasSuffix(target, ")") {
+		if i := strings.LastIndex(target, " ("); i >= 0 {
+			target = target[i+2 : len(target)-1]
+		}
+	}
+	if target == "" {
+		return "", false
+	}
+	return target, true
+}
+
+// Reply answers the request with a password.
+func (r Request) Reply(password []byte) error {
+	return r.send(append([]byte("+"), password...))
+}
+
+// Cancel answers the request without a password.
+func (r Request) Cancel() error {
+	return r.send([]byte("-"))
+}
+
+func (r Request) send(msg []byte) error {
+	addr := &net.UnixAddr{Name: r.Socket, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to %s", r.Socket)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(msg); err != nil {
+		return errors.Wrapf(err, "failed to reply to %s", r.Socket)
+	}
+	return nil
+}
+
+// Watch monitors `dir` for password requests, invoking `handle` once for
+// each new request. It returns when `ctx` is done.
+func Watch(ctx context.Context, dir string, handle func(context.Context, Request)) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize inotify")
+	}
+	inotify := os.NewFile(uintptr(fd), "inotify")
+	defer inotify.Close()
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO); err != nil {
+		return errors.Wrapf(err, "failed to watch %s", dir)
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := inotify.Read(buf); err != nil {
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	seen := map[string]bool{}
+	ticker := time.NewTicker(rescanInterval)
+	defer ticker.Stop()
+	for {
+		reqs, err := Pending(dir)
+		if err != nil {
+			return err
+		}
+		current := map[string]bool{}
+		for _, req := range reqs {
+			current[req.Path] = true
+			if seen[req.Path] {
+				continue
+			}
+			logrus.Debugf("new password request %s (%s)", req.Path, req.ID)
+			wg.Add(1)
+			go func(req Request) {
+				defer wg.Done()
+				handle(ctx, req)
+			}(req)
+		}
+		seen = current
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+// monotonicNow returns CLOCK_MONOTONIC in microseconds, as used by `NotAfter`.
+func monotonicNow() uint64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return uint64(ts.Nano()) / 1000
+}
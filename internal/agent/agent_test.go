@@ -0,0 +1,153 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeAsk(t *testing.T, dir string, name string, socket string, id string) string {
+	path := filepath.Join(dir, name)
+	body := fmt.Sprintf(`[Ask]
+PID=1234
+Socket=%s
+AcceptCached=1
+Echo=0
+NotAfter=0
+Message=Please enter passphrase for disk luks_vol!
+Icon=drive-harddisk
+Id=%s
+`, socket, id)
+	if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRequestVolume(t *testing.T) {
+	tests := []struct {
+		id    string
+		exp   string
+		expOk bool
+	}{
+		{"", "", false},
+		{"other:luks_vol", "", false},
+		{"cryptsetup:", "", false},
+		{"cryptsetup:luks_vol", "luks_vol", true},
+		{"cryptsetup:/dev/sdb", "/dev/sdb", true},
+		{"cryptsetup:Data disk (luks_vol)", "luks_vol", true},
+	}
+
+	for _, tt := range tests {
+		out, ok := Request{ID: tt.id}.Volume()
+		if ok != tt.expOk || out != tt.exp {
+			t.Fatalf("expected (%q, %v) for %q, got (%q, %v)", tt.exp, tt.expOk, tt.id, out, ok)
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "agent_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := writeAsk(t, tmpDir, "ask.abc", "/run/systemd/ask-password/sck.abc", "cryptsetup:luks_vol")
+	req, err := ParseRequest(path)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	exp := Request{
+		Path:    path,
+		Socket:  "/run/systemd/ask-password/sck.abc",
+		ID:      "cryptsetup:luks_vol",
+		Message: "Please enter passphrase for disk luks_vol!",
+		PID:     1234,
+	}
+	if req != exp {
+		t.Fatalf("expected %+v, got %+v", exp, req)
+	}
+	if req.Expired() || req.Deadline() != 0 {
+		t.Fatalf("unexpected deadline for %+v", req)
+	}
+
+	expired := Request{NotAfter: 1}
+	if !expired.Expired() {
+		t.Fatalf("expected request to be expired")
+	}
+}
+
+func TestWatchReply(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "agent_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sck := filepath.Join(tmpDir, "sck.abc")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sck, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	handled := make(chan string, 2)
+	go func() {
+		done <- Watch(ctx, tmpDir, func(ctx context.Context, req Request) {
+			handled <- req.ID
+			if err := req.Reply([]byte("sekrit")); err != nil {
+				t.Errorf("unexpected error %q", err)
+			}
+		})
+	}()
+
+	// Requests are picked up after the watcher is started too.
+	time.Sleep(100 * time.Millisecond)
+	writeAsk(t, tmpDir, "ask.abc", sck, "cryptsetup:luks_vol")
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if string(buf[:n]) != "+sekrit" {
+		t.Fatalf("expected reply %q, got %q", "+sekrit", buf[:n])
+	}
+	if id := <-handled; id != "cryptsetup:luks_vol" {
+		t.Fatalf("unexpected request %q", id)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	select {
+	case id := <-handled:
+		t.Fatalf("request %q handled twice", id)
+	default:
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit records unlock attempts in an append-only log.
+//
+// Records only carry non-secret identifiers of key sources, never key
+// material, so that the log can be kept and shipped for compliance.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// DefaultPath is the default audit log location. `/run` is carried over
+// from initramfs by switch-root, thus early unlocks are kept too.
+const DefaultPath = "/run/coreos-cryptagent/audit.log"
+
+// Results of unlock attempts.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	// ResultForwarded is a passphrase passed to systemd-cryptsetup without
+	// being verified, as for remote unlocks.
+	ResultForwarded = "forwarded"
+)
+
+// Error classes of failed unlock attempts.
+const (
+	ClassConfig       = "config"
+	ClassProvider     = "provider"
+	ClassVerification = "verification"
+	ClassCanceled     = "canceled"
+)
+
+// Record is a single unlock attempt.
+type Record struct {
+	Time   time.Time `json:"time"`
+	Device string    `json:"device,omitempty"`
+	// Volume is the device-mapper name.
+	Volume      string `json:"volume,omitempty"`
+	Keyslot     int    `json:"keyslot"`
+	KeyslotFile string `json:"keyslotFile,omitempty"`
+	Provider    string `json:"provider"`
+	// Identifiers are non-secret references to the key source, such as
+	// key names and versions.
+	Identifiers map[string]string `json:"identifiers,omitempty"`
+	Result      string            `json:"result"`
+	ErrorClass  string            `json:"errorClass,omitempty"`
+}
+
+// Log is an append-only audit log, storing one JSON record per line.
+type Log struct {
+	Path string
+}
+
+// Append adds `rec` at the end of the log, creating it if needed.
+func (l Log) Append(rec Record) error {
+	if err := os.MkdirAll(filepath.Dir(l.Path), 0700); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	// Records may come from concurrent processes, e.g. attach and server.
+	if err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrapf(err, "failed to lock %s", l.Path)
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(append(b, '\n'))
+	return err
+}
+
+// Read returns all records in the log, oldest first. A missing log has
+// no records.
+func (l Log) Read() ([]Record, error) {
+	recs := []Record{}
+	fp, err := os.Open(l.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return recs, nil
+		}
+		return nil, err
+	}
+	defer fp.Close()
+
+	sc := bufio.NewScanner(fp)
+	for n := 1; sc.Scan(); n++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, errors.Wrapf(err, "malformed record at %s:%d", l.Path, n)
+		}
+		recs = append(recs, rec)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// Identifiers returns the non-secret identifiers of a key source.
+func Identifiers(pj config.ProviderJSON) map[string]string {
+	ids := map[string]string{}
+	set := func(k string, v string) {
+		if v != "" {
+			ids[k] = v
+		}
+	}
+	switch v := pj.Value.(type) {
+	case config.ContentV1:
+		set("source", redactURL(v.Source))
+	case config.AzureVaultV1:
+		set("baseURL", v.BaseURL)
+		set("keyName", v.KeyName)
+		set("keyVersion", v.KeyVersion)
+	case config.AwsKmsV1:
+		set("region", v.Region)
+		set("keyID", v.KeyID)
+	case config.GcpKmsV1:
+		set("key", "projects/"+v.Project+"/locations/"+v.Location+"/keyRings/"+v.KeyRing+"/cryptoKeys/"+v.Key)
+	case config.Pkcs11V1:
+		set("module", v.Module)
+		set("tokenLabel", v.TokenLabel)
+		set("keyLabel", v.KeyLabel)
+	case config.EtcdV1:
+		set("endpoints", strings.Join(v.Endpoints, ","))
+		set("key", v.Key)
+	case config.KeyFileV1:
+		set("device", v.Device)
+		set("path", v.Path)
+	case config.ExecV1:
+		set("path", v.Path)
+	case config.InteractiveV1:
+		set("tty", v.TTY)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids
+}
+
+// redactURL strips anything which may carry secrets from a source URL:
+// `data:` payloads, user credentials and query parameters.
+func redactURL(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme == "data" {
+		return "data:"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
@@ -15,17 +15,20 @@
 package cli
 
 import (
-	"os/exec"
+	"context"
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"strings"
+	"text/tabwriter"
 
-	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/internal/luks"
+	"github.com/coreos/coreos-cryptagent/internal/unlock"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
-const sdHelperBin = "/lib/systemd/systemd-cryptsetup"
-
 var (
 	attachCmd = &cobra.Command{
 		Use:          "attach",
@@ -33,10 +36,19 @@ var (
 		Short:        "Attach a crypsetup volume by device path",
 		SilenceUsage: true,
 	}
+
+	attachOpts struct {
+		dryRun bool
+		json   bool
+	}
 )
 
+func init() {
+	attachCmd.Flags().BoolVar(&attachOpts.dryRun, "dry-run", false, "retrieve and verify the key, without activating the volume")
+	attachCmd.Flags().BoolVar(&attachOpts.json, "json", false, "print JSON output, with --dry-run")
+}
+
 func runAttachCmd(cmd *cobra.Command, args []string) error {
-	var err error
 	if len(args) == 0 {
 		return errors.New("device path missing")
 	}
@@ -49,42 +61,42 @@ func runAttachCmd(cmd *cobra.Command, args []string) error {
 		return errors.Errorf("input path %s is not absolute", pathIn)
 	}
 
-	blockPath, err := common.LookupBlockdev(pathIn)
-	if err != nil {
-		return errors.Wrap(err, "failed reverse block lookup")
+	if attachOpts.json && !attachOpts.dryRun {
+		return errors.New("--json requires --dry-run")
 	}
-
-	volName, err := common.LookupVolName(pathIn)
-	if err != nil {
-		return errors.Wrap(err, "failed volume name lookup")
+	if attachOpts.dryRun {
+		return dryRunAttach(pathIn)
 	}
+	return unlock.Attach(hostSystem(), unlock.SystemdCryptsetup, pathIn)
+}
 
-	logrus.Debugf("unlocking volume %s on device %s\n", volName, blockPath)
-	opts := []string{"-"}
-	err = sdHelper(volName, blockPath, opts)
+// dryRunAttach prints how the volume on `pathIn` would be activated.
+// Dry runs are not unlocks, thus they are not audited.
+func dryRunAttach(pathIn string) error {
+	u := unlock.Unlocker{Cryptsetup: luks.Default, Roots: configRoots()}
+	plan, err := u.PlanAttach(context.Background(), hostSystem(), unlock.SystemdCryptsetup, pathIn)
 	if err != nil {
-		return errors.Wrap(err, "failed to run systemd-crypsetup")
+		return err
 	}
 
-	return nil
-}
-
-func sdHelper(volume string, path string, opts []string) error {
-	if volume == "" {
-		return errors.New("empty input volume name")
-	}
-	if path == "" {
-		return errors.New("empty input path")
+	if attachOpts.json {
+		return printJSON(os.Stdout, plan)
 	}
+	return printPlan(os.Stdout, plan)
+}
 
-	args := []string{"attach", volume, path}
-	args = append(args, opts...)
-	cmd := exec.Command(sdHelperBin, args...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		msg := errors.New(string(out))
-		return errors.Wrap(msg, err.Error())
+// printPlan prints a dry-run plan for humans.
+func printPlan(w io.Writer, plan unlock.Plan) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "device:\t%s\n", plan.Device)
+	fmt.Fprintf(tw, "block device:\t%s\n", plan.BlockDevice)
+	fmt.Fprintf(tw, "volume:\t%s\n", plan.Volume)
+	fmt.Fprintf(tw, "config:\t%s\n", plan.ConfigDir)
+	fmt.Fprintf(tw, "command:\t%s\n", strings.Join(plan.Command, " "))
+	fmt.Fprintf(tw, "keyslot:\t%d\n", plan.Keyslot)
+	fmt.Fprintf(tw, "provider:\t%s\n", plan.Provider)
+	if len(plan.Identifiers) > 0 {
+		fmt.Fprintf(tw, "identifiers:\t%s\n", formatIdentifiers(plan.Identifiers))
 	}
-
-	return nil
+	return tw.Flush()
 }
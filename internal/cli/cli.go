@@ -15,18 +15,73 @@
 package cli
 
 import (
+	"strings"
+
+	"github.com/coreos/coreos-cryptagent/internal/audit"
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/internal/logging"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
 	"github.com/spf13/cobra"
 )
 
-var cmdAgent = &cobra.Command{
-	Use:           "coreos-cryptagent [command]",
-	SilenceErrors: true,
+var (
+	cmdAgent = &cobra.Command{
+		Use:               "coreos-cryptagent [command]",
+		PersistentPreRunE: setupLogging,
+		SilenceErrors:     true,
+	}
+
+	globalOpts struct {
+		configRoots []string
+		logFormat   string
+		auditLog    string
+	}
+)
+
+func init() {
+	cmdAgent.PersistentFlags().StringVar(&globalOpts.auditLog, "audit-log", audit.DefaultPath, "path to the unlock audit log, empty to disable auditing")
+	cmdAgent.PersistentFlags().StringVar(&globalOpts.logFormat, "log-format", logging.FormatText, "log format on stderr, either "+logging.FormatText+" or "+logging.FormatJSON)
+	cmdAgent.PersistentFlags().StringArrayVar(&globalOpts.configRoots, "config-root", nil, "configuration root, may be repeated by decreasing precedence (default: $"+config.ConfigRootEnv+" or "+strings.Join(config.DefaultConfigRoots, ", ")+")")
+}
+
+// setupLogging configures log sinks, before running any command.
+func setupLogging(cmd *cobra.Command, args []string) error {
+	return logging.Setup(globalOpts.logFormat)
+}
+
+// configRoots returns the configuration roots from the command line, the
+// environment, or the default ones, in this order.
+func configRoots() common.Roots {
+	if len(globalOpts.configRoots) > 0 {
+		return common.Roots(globalOpts.configRoots)
+	}
+	return common.RootsFromEnv()
+}
+
+// auditLog returns the configured audit log, or nil if auditing is disabled.
+func auditLog() *audit.Log {
+	if globalOpts.auditLog == "" {
+		return nil
+	}
+	return &audit.Log{Path: globalOpts.auditLog}
+}
+
+// hostSystem returns the view of host devices, with the configured roots.
+func hostSystem() common.System {
+	return common.System{Roots: configRoots()}
 }
 
 // Setup initializes cryptagent CLI infra
 func Setup() error {
 	cmdAgent.AddCommand(attachCmd)
+	cmdAgent.AddCommand(enrollCmd)
+	cmdAgent.AddCommand(rotateCmd)
+	cmdAgent.AddCommand(listCmd)
+	cmdAgent.AddCommand(statusCmd)
 	cmdAgent.AddCommand(serverCmd)
+	cmdAgent.AddCommand(generatorCmd)
+	cmdAgent.AddCommand(crypttabCmd)
+	cmdAgent.AddCommand(historyCmd)
 	return nil
 }
 
@@ -0,0 +1,144 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/internal/crypttab"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	crypttabCmd = &cobra.Command{
+		Use:   "crypttab",
+		Short: "Convert between crypttab and cryptagent configuration",
+	}
+
+	crypttabImportCmd = &cobra.Command{
+		Use:          "import <file>",
+		RunE:         runCrypttabImportCmd,
+		Short:        "Import crypttab entries as volume configurations",
+		SilenceUsage: true,
+	}
+
+	crypttabExportCmd = &cobra.Command{
+		Use:          "export",
+		RunE:         runCrypttabExportCmd,
+		Short:        "Print configured volumes as crypttab entries",
+		SilenceUsage: true,
+	}
+)
+
+func init() {
+	crypttabCmd.AddCommand(crypttabImportCmd)
+	crypttabCmd.AddCommand(crypttabExportCmd)
+}
+
+func runCrypttabImportCmd(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		return errors.New("crypttab path missing")
+	}
+	if len(args) != 1 {
+		return errors.New("too many arguments")
+	}
+	fp, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	entries, err := crypttab.Parse(fp)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse %s", args[0])
+	}
+
+	// Convert all entries first, so that nothing is written on errors.
+	sys := hostSystem()
+	seen := map[string]string{}
+	vds := []common.VolumeDir{}
+	for _, e := range entries {
+		vol, err := crypttab.Import(e)
+		if err != nil {
+			return err
+		}
+		// Devices are told apart by their block device, so that aliases
+		// of a configured device are detected. Missing devices can only
+		// be compared by path.
+		id, lookupErr := sys.LookupBlockdev(vol.Device())
+		if lookupErr != nil {
+			logrus.Warnf("volume %s: %s", e.Name, lookupErr)
+			id = vol.Device()
+		}
+		if other, ok := seen[id]; ok {
+			return errors.Errorf("volume %s: device %s already used by volume %s", e.Name, vol.Device(), other)
+		}
+		seen[id] = e.Name
+
+		var confDir string
+		if lookupErr == nil {
+			confDir, err = sys.DeviceConfigDir(vol.Device())
+		} else {
+			confDir, err = sys.Roots.DeviceConfigDir(vol.Device())
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(confDir); err == nil {
+			return errors.Errorf("volume %s: already configured in %s", e.Name, confDir)
+		}
+		for _, opt := range vol.Unsupported {
+			logrus.Warnf("volume %s: ignoring unsupported option %q", e.Name, opt)
+		}
+		vds = append(vds, common.VolumeDir{
+			Dir:      confDir,
+			Volume:   vol.Config,
+			Keyslots: vol.Keyslots,
+		})
+	}
+
+	if err := common.WriteVolumeDirs(vds); err != nil {
+		return errors.Wrap(err, "failed to write volume configurations")
+	}
+	for i, e := range entries {
+		logrus.Infof("imported volume %s into %s", e.Name, vds[i].Dir)
+	}
+	return nil
+}
+
+func runCrypttabExportCmd(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return errors.New("too many arguments")
+	}
+	vols, err := hostSystem().ListVolumes()
+	if err != nil {
+		return err
+	}
+	for _, v := range vols {
+		e, notes, err := crypttab.Export(v.ConfigDir)
+		if err != nil {
+			logrus.Warnf("skipping %s: %s", v.Device, err)
+			continue
+		}
+		for _, note := range notes {
+			logrus.Warnf("volume %s: %s", e.Name, note)
+		}
+		fmt.Println(e)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/internal/luks"
+	"github.com/coreos/coreos-cryptagent/internal/providers"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	enrollCmd = &cobra.Command{
+		Use:          "enroll",
+		RunE:         runEnrollCmd,
+		Short:        "Enroll a new keyslot on a cryptsetup volume",
+		SilenceUsage: true,
+	}
+
+	enrollOpts struct {
+		device   string
+		provider string
+		name     string
+		keyFile  string
+	}
+)
+
+func init() {
+	enrollCmd.Flags().StringVar(&enrollOpts.device, "device", "", "path to the encrypted device")
+	enrollCmd.Flags().StringVar(&enrollOpts.provider, "provider", "", "path to the provider configuration (JSON)")
+	enrollCmd.Flags().StringVar(&enrollOpts.name, "name", "", "volume name, for devices without an existing configuration")
+	enrollCmd.Flags().StringVar(&enrollOpts.keyFile, "key-file", "", "file containing an existing passphrase (default: prompt)")
+}
+
+func runEnrollCmd(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return errors.New("too many arguments")
+	}
+	if enrollOpts.device == "" {
+		return errors.New("device path missing")
+	}
+	if !filepath.IsAbs(enrollOpts.device) {
+		return errors.Errorf("input path %s is not absolute", enrollOpts.device)
+	}
+	if enrollOpts.provider == "" {
+		return errors.New("provider configuration missing")
+	}
+
+	pj, err := common.ReadProvider(enrollOpts.provider)
+	if err != nil {
+		return errors.Wrap(err, "failed to read provider configuration")
+	}
+	p, err := providers.FromConfig(pj)
+	if err != nil {
+		return err
+	}
+	enroller, ok := p.(providers.Enroller)
+	if !ok {
+		return errors.Errorf("provider %s does not support enrollment", enrollOpts.provider)
+	}
+
+	confDir, err := hostSystem().DeviceConfigDir(enrollOpts.device)
+	if err != nil {
+		return err
+	}
+	vj, newVolume, err := enrollVolume(confDir)
+	if err != nil {
+		return err
+	}
+
+	existing, err := readPassphrase(enrollOpts.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read existing passphrase")
+	}
+	if err := luks.TestKey(enrollOpts.device, existing, -1); err != nil {
+		return errors.Wrap(err, "existing passphrase rejected")
+	}
+
+	slot, err := freeKeyslot(confDir, enrollOpts.device)
+	if err != nil {
+		return err
+	}
+
+	req := providers.Request{
+		Device:     enrollOpts.device,
+		VolumeName: volumeName(vj),
+		Keyslot:    slot,
+		Roots:      configRoots(),
+	}
+	key, newPj, err := enroller.Enroll(context.Background(), req)
+	if err != nil {
+		return errors.Wrap(err, "failed to enroll key with provider")
+	}
+	if err := luks.AddKey(enrollOpts.device, existing, key, slot); err != nil {
+		return errors.Wrapf(err, "failed to add keyslot %d", slot)
+	}
+
+	if err := writeEnrollConfig(confDir, vj, newVolume, slot, newPj); err != nil {
+		logrus.Warnf("rolling back keyslot %d on %s", slot, enrollOpts.device)
+		if rbErr := luks.KillSlot(enrollOpts.device, existing, slot); rbErr != nil {
+			logrus.Errorf("failed to roll back keyslot %d: %s", slot, rbErr)
+		}
+		return err
+	}
+
+	logrus.Infof("enrolled keyslot %d on %s", slot, enrollOpts.device)
+	return nil
+}
+
+// enrollVolume returns the volume configuration for the device being enrolled,
+// and whether it is new.
+func enrollVolume(confDir string) (config.VolumeJSON, bool, error) {
+	vj, err := common.ReadVolume(confDir)
+	if err == nil {
+		if enrollOpts.name != "" {
+			return vj, false, errors.Errorf("volume already configured in %s", confDir)
+		}
+		return vj, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return vj, false, err
+	}
+
+	if enrollOpts.name == "" {
+		return vj, false, errors.New("volume name missing")
+	}
+	vj = config.VolumeJSON{
+		Kind: config.VolumeCryptsetupLUKS1V1,
+		Value: config.CryptsetupLUKS1V1{
+			Name:   enrollOpts.name,
+			Device: enrollOpts.device,
+		},
+	}
+	return vj, true, nil
+}
+
+// freeKeyslot returns the lowest keyslot which is neither configured nor
+// active in the LUKS header.
+func freeKeyslot(confDir string, device string) (int, error) {
+	used := map[int]bool{}
+	active, err := luks.ActiveKeyslots(device)
+	if err != nil {
+		return -1, errors.Wrap(err, "failed to read LUKS keyslots")
+	}
+	for _, n := range active {
+		used[n] = true
+	}
+	configured, err := common.Keyslots(confDir)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return -1, err
+	}
+	for _, n := range configured {
+		used[n] = true
+	}
+
+	slot := 0
+	for used[slot] {
+		slot++
+	}
+	return slot, nil
+}
+
+func writeEnrollConfig(confDir string, vj config.VolumeJSON, newVolume bool, slot int, pj config.ProviderJSON) error {
+	if newVolume {
+		if err := common.WriteVolume(confDir, vj); err != nil {
+			return errors.Wrap(err, "failed to write volume configuration")
+		}
+	}
+	if err := common.WriteKeyslot(confDir, slot, pj); err != nil {
+		return errors.Wrapf(err, "failed to write keyslot %d configuration", slot)
+	}
+	return nil
+}
+
+// volumeName returns the name of a configured volume, if any.
+func volumeName(vj config.VolumeJSON) string {
+	if luks1, ok := vj.Value.(config.CryptsetupLUKS1V1); ok {
+		return luks1.Name
+	}
+	return ""
+}
+
+// readPassphrase reads a passphrase from `keyFile`, or interactively from
+// the terminal if no file is given.
+func readPassphrase(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		return ioutil.ReadFile(keyFile)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.New("no key file given and stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, "Enter existing passphrase: ")
+	pass, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return pass, err
+}
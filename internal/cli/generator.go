@@ -0,0 +1,42 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/coreos/coreos-cryptagent/internal/generator"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	generatorCmd = &cobra.Command{
+		Use:          "generator normal-dir [early-dir] [late-dir]",
+		RunE:         runGeneratorCmd,
+		Short:        "Generate cryptsetup units, as a systemd generator",
+		SilenceUsage: true,
+	}
+)
+
+func runGeneratorCmd(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		return errors.New("output directory missing")
+	}
+	if len(args) > 3 {
+		return errors.New("too many arguments")
+	}
+	// Units are generated with normal priority, thus early and late
+	// directories are unused.
+	return generator.Generate(hostSystem(), args[0])
+}
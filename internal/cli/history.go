@@ -0,0 +1,95 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/audit"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	historyCmd = &cobra.Command{
+		Use:          "history",
+		RunE:         runHistoryCmd,
+		Short:        "Show the unlock audit log",
+		SilenceUsage: true,
+	}
+
+	historyOpts struct {
+		json   bool
+		volume string
+	}
+)
+
+func init() {
+	historyCmd.Flags().BoolVar(&historyOpts.json, "json", false, "print JSON output")
+	historyCmd.Flags().StringVar(&historyOpts.volume, "volume", "", "only show records for this volume name or device")
+}
+
+func runHistoryCmd(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return errors.New("too many arguments")
+	}
+	al := auditLog()
+	if al == nil {
+		return errors.New("audit log disabled")
+	}
+	all, err := al.Read()
+	if err != nil {
+		return err
+	}
+	recs := []audit.Record{}
+	for _, rec := range all {
+		if historyOpts.volume == "" || rec.Volume == historyOpts.volume || rec.Device == historyOpts.volume {
+			recs = append(recs, rec)
+		}
+	}
+
+	if historyOpts.json {
+		return printJSON(os.Stdout, recs)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tVOLUME\tDEVICE\tKEYSLOT\tPROVIDER\tIDENTIFIERS\tRESULT")
+	for _, rec := range recs {
+		keyslot := "-"
+		if rec.Keyslot >= 0 {
+			keyslot = strconv.Itoa(rec.Keyslot)
+		}
+		result := rec.Result
+		if rec.ErrorClass != "" {
+			result += " (" + rec.ErrorClass + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", rec.Time.Format(time.RFC3339), dash(rec.Volume), dash(rec.Device), keyslot, rec.Provider, dash(formatIdentifiers(rec.Identifiers)), result)
+	}
+	return tw.Flush()
+}
+
+func formatIdentifiers(ids map[string]string) string {
+	pairs := make([]string, 0, len(ids))
+	for k, v := range ids {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
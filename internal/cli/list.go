@@ -0,0 +1,149 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	listCmd = &cobra.Command{
+		Use:          "list",
+		RunE:         runListCmd,
+		Short:        "List configured cryptsetup volumes",
+		SilenceUsage: true,
+	}
+
+	statusCmd = &cobra.Command{
+		Use:          "status",
+		RunE:         runStatusCmd,
+		Short:        "Show configured cryptsetup volumes and their live state",
+		SilenceUsage: true,
+	}
+
+	listOpts struct {
+		json bool
+	}
+)
+
+// volumeStatus augments a configured volume with its live state.
+type volumeStatus struct {
+	common.VolumeInfo
+	Mapper common.MapperStatus `json:"mapper"`
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{listCmd, statusCmd} {
+		cmd.Flags().BoolVar(&listOpts.json, "json", false, "print JSON output")
+	}
+}
+
+func runListCmd(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return errors.New("too many arguments")
+	}
+	vols, err := hostSystem().ListVolumes()
+	if err != nil {
+		return err
+	}
+
+	if listOpts.json {
+		return printJSON(os.Stdout, vols)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tBLOCKDEV\tNAME\tKIND\tKEYSLOTS")
+	for _, v := range vols {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", v.Device, dash(v.BlockDevice), dash(v.Name), v.Kind, formatKeyslots(v))
+	}
+	return tw.Flush()
+}
+
+func runStatusCmd(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return errors.New("too many arguments")
+	}
+	vols, err := hostSystem().ListVolumes()
+	if err != nil {
+		return err
+	}
+
+	statuses := make([]volumeStatus, 0, len(vols))
+	for _, v := range vols {
+		st := volumeStatus{VolumeInfo: v}
+		if v.Name != "" {
+			st.Mapper, err = hostSystem().LookupMapper(v.Name)
+			if err != nil {
+				return err
+			}
+		}
+		statuses = append(statuses, st)
+	}
+
+	if listOpts.json {
+		return printJSON(os.Stdout, statuses)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tBLOCKDEV\tNAME\tSTATE\tDM\tMAPPER")
+	for _, st := range statuses {
+		state := "inactive"
+		if st.Mapper.Suspended {
+			state = "suspended"
+		} else if st.Mapper.Active {
+			state = "active"
+		}
+		if st.Error != "" {
+			state = "broken"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", st.Device, dash(st.BlockDevice), dash(st.Name), state, dash(st.Mapper.DmName), dash(st.Mapper.Path))
+	}
+	return tw.Flush()
+}
+
+func formatKeyslots(v common.VolumeInfo) string {
+	if v.Error != "" {
+		return "error: " + v.Error
+	}
+	slots := make([]string, 0, len(v.Keyslots))
+	for _, ks := range v.Keyslots {
+		if ks.Error != "" {
+			slots = append(slots, fmt.Sprintf("%d:error", ks.Slot))
+			continue
+		}
+		slots = append(slots, fmt.Sprintf("%d:%s", ks.Slot, ks.Provider))
+	}
+	return dash(strings.Join(slots, ","))
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/internal/luks"
+	"github.com/coreos/coreos-cryptagent/internal/providers"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rotateCmd = &cobra.Command{
+		Use:   "rotate <device>",
+		RunE:  runRotateCmd,
+		Short: "Re-key a configured keyslot of a cryptsetup volume",
+		Long: `Re-key a configured keyslot of a cryptsetup volume.
+
+The new key is enrolled through the provider configuration given with
+--provider, or through the current one otherwise. Static ContentV1 sources
+always return the same key, thus rotating such a keyslot requires a new
+configuration with --provider.`,
+		SilenceUsage: true,
+	}
+
+	rotateOpts struct {
+		slot     int
+		provider string
+	}
+)
+
+func init() {
+	rotateCmd.Flags().IntVar(&rotateOpts.slot, "slot", -1, "keyslot to rotate")
+	rotateCmd.Flags().StringVar(&rotateOpts.provider, "provider", "", "path to a new provider configuration (JSON) (default: current one)")
+}
+
+// rotation tracks the steps of a keyslot rotation, so that they can be
+// undone in reverse order on failure.
+type rotation struct {
+	device string
+	undo   []func() error
+}
+
+func (r *rotation) step(desc string, do func() error, undo func() error) error {
+	logrus.Debugf("rotation step: %s", desc)
+	if err := do(); err != nil {
+		return errors.Wrapf(err, "failed to %s", desc)
+	}
+	if undo != nil {
+		r.undo = append(r.undo, undo)
+	}
+	return nil
+}
+
+func (r *rotation) rollback() {
+	logrus.Warnf("rolling back keyslot rotation on %s", r.device)
+	for i := len(r.undo) - 1; i >= 0; i-- {
+		if err := r.undo[i](); err != nil {
+			logrus.Errorf("rollback step failed: %s", err)
+		}
+	}
+}
+
+func runRotateCmd(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		return errors.New("device path missing")
+	}
+	if len(args) != 1 {
+		return errors.New("too many arguments")
+	}
+	device := args[0]
+	if !filepath.IsAbs(device) {
+		return errors.Errorf("input path %s is not absolute", device)
+	}
+	slot := rotateOpts.slot
+	if slot < 0 {
+		return errors.New("keyslot missing")
+	}
+
+	confDir, err := hostSystem().LookupConfigDir(device)
+	if err != nil {
+		return errors.Wrap(err, "failed config directory lookup")
+	}
+	vj, err := common.ReadVolume(confDir)
+	if err != nil {
+		return errors.Wrap(err, "failed to read volume configuration")
+	}
+	curPj, err := common.ReadKeyslot(confDir, slot)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read keyslot %d configuration", slot)
+	}
+	newPj, err := rotationProvider(curPj, rotateOpts.provider)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	req := providers.Request{
+		Device:     device,
+		VolumeName: volumeName(vj),
+		Keyslot:    slot,
+		Roots:      configRoots(),
+	}
+	curProvider, err := providers.FromConfig(curPj)
+	if err != nil {
+		return err
+	}
+	curKey, err := curProvider.Key(ctx, req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to retrieve current key for keyslot %d", slot)
+	}
+	if err := luks.TestKey(device, curKey, slot); err != nil {
+		return errors.Wrapf(err, "current key does not open keyslot %d", slot)
+	}
+
+	newProvider, err := providers.FromConfig(newPj)
+	if err != nil {
+		return err
+	}
+	enroller, ok := newProvider.(providers.Enroller)
+	if !ok {
+		return errors.New("provider does not support enrollment")
+	}
+	newKey, newPj, err := enroller.Enroll(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "failed to enroll key with provider")
+	}
+	if bytes.Equal(curKey, newKey) {
+		return errors.New("provider returned the current key, nothing to rotate")
+	}
+
+	tmpSlot, err := freeKeyslot(confDir, device)
+	if err != nil {
+		return err
+	}
+
+	r := rotation{device: device}
+	if err := rotate(&r, confDir, slot, tmpSlot, curKey, newKey, newPj); err != nil {
+		r.rollback()
+		return err
+	}
+
+	logrus.Infof("rotated keyslot %d on %s", slot, device)
+	return nil
+}
+
+// rotationProvider returns the provider configuration which enrolls the new
+// key: the one at `path` if not empty, or the current one `curPj`.
+//
+// ContentV1 enrollment returns the current key, thus static content cannot
+// be rotated without a new configuration.
+func rotationProvider(curPj config.ProviderJSON, path string) (config.ProviderJSON, error) {
+	if path != "" {
+		pj, err := common.ReadProvider(path)
+		if err != nil {
+			return pj, errors.Wrap(err, "failed to read provider configuration")
+		}
+		return pj, nil
+	}
+	if curPj.Kind == config.ProviderContentV1 {
+		return curPj, errors.New("keyslot uses static content, --provider is required to rotate it")
+	}
+	return curPj, nil
+}
+
+// rotate re-keys `slot`, using `tmpSlot` as a staging area so that the
+// volume can be unlocked at every step.
+//
+// The staged key gets its own configuration before the old key is killed,
+// thus an interrupted rotation always leaves a keyslot whose configuration
+// matches its key.
+func rotate(r *rotation, confDir string, slot int, tmpSlot int, curKey []byte, newKey []byte, newPj config.ProviderJSON) error {
+	device := r.device
+
+	err := r.step("stage new key",
+		func() error { return luks.AddKey(device, curKey, newKey, tmpSlot) },
+		func() error { return luks.KillSlot(device, curKey, tmpSlot) },
+	)
+	if err != nil {
+		return err
+	}
+	err = r.step("verify staged key",
+		func() error { return luks.TestKey(device, newKey, tmpSlot) },
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	err = r.step("configure staged key",
+		func() error { return common.WriteKeyslot(confDir, tmpSlot, newPj) },
+		func() error { return common.RemoveKeyslot(confDir, tmpSlot) },
+	)
+	if err != nil {
+		return err
+	}
+	err = r.step("kill old keyslot",
+		func() error { return luks.KillSlot(device, newKey, slot) },
+		func() error { return luks.AddKey(device, newKey, curKey, slot) },
+	)
+	if err != nil {
+		return err
+	}
+	err = r.step("add new key",
+		func() error { return luks.AddKey(device, newKey, newKey, slot) },
+		func() error { return luks.KillSlot(device, newKey, slot) },
+	)
+	if err != nil {
+		return err
+	}
+	err = r.step("verify new key",
+		func() error { return luks.TestKey(device, newKey, slot) },
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = r.step("replace keyslot configuration",
+		func() error { return common.WriteKeyslot(confDir, slot, newPj) },
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Configuration goes first, so that no configured keyslot is left
+	// without its key.
+	if err := common.RemoveKeyslot(confDir, tmpSlot); err != nil {
+		logrus.Warnf("failed to remove staging keyslot %d configuration: %s", tmpSlot, err)
+		return nil
+	}
+	if err := luks.KillSlot(device, newKey, tmpSlot); err != nil {
+		logrus.Warnf("failed to wipe staging keyslot %d: %s", tmpSlot, err)
+	}
+	return nil
+}
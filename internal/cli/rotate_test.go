@@ -0,0 +1,84 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+func TestRotationProvider(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cli_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	static := config.ProviderJSON{
+		Kind:  config.ProviderContentV1,
+		Value: config.ContentV1{Source: "https://localhost/key.txt"},
+	}
+	kms := config.ProviderJSON{
+		Kind: config.ProviderAwsKmsV1,
+		Value: config.AwsKmsV1{
+			Region:     "us-east-1",
+			KeyID:      "alias/data",
+			Ciphertext: "c2Vrcml0",
+		},
+	}
+	newPath := filepath.Join(tmpDir, "new.json")
+	newJSON := `{"kind": "ContentV1", "value": {"source": "https://localhost/new.txt"}}`
+	if err := ioutil.WriteFile(newPath, []byte(newJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+	newPj := config.ProviderJSON{
+		Kind:  config.ProviderContentV1,
+		Value: config.ContentV1{Source: "https://localhost/new.txt"},
+	}
+
+	tests := []struct {
+		cur  config.ProviderJSON
+		path string
+		exp  config.ProviderJSON
+		err  bool
+	}{
+		// Static content requires a new configuration.
+		{static, "", config.ProviderJSON{}, true},
+		{static, newPath, newPj, false},
+		{static, filepath.Join(tmpDir, "missing.json"), config.ProviderJSON{}, true},
+		{kms, "", kms, false},
+		{kms, newPath, newPj, false},
+	}
+	for i, tt := range tests {
+		pj, err := rotationProvider(tt.cur, tt.path)
+		if tt.err {
+			if err == nil {
+				t.Fatalf("#%d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: unexpected error %q", i, err)
+		}
+		if !reflect.DeepEqual(pj, tt.exp) {
+			t.Fatalf("#%d: expected %+v, got %+v", i, tt.exp, pj)
+		}
+	}
+}
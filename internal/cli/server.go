@@ -15,11 +15,29 @@
 package cli
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/agent"
+	"github.com/coreos/coreos-cryptagent/internal/logging"
+	"github.com/coreos/coreos-cryptagent/internal/luks"
+	"github.com/coreos/coreos-cryptagent/internal/remote"
+	"github.com/coreos/coreos-cryptagent/internal/unlock"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// activationTimeout bounds the wait for a volume to be activated after its
+// password request was answered.
+const activationTimeout = 2 * time.Minute
+
 var (
 	serverCmd = &cobra.Command{
 		Use:          "server",
@@ -27,15 +45,214 @@ var (
 		Short:        "Runs the password agent server",
 		SilenceUsage: true,
 	}
+
+	serverOpts struct {
+		remoteListen   string
+		remoteCert     string
+		remoteKey      string
+		remoteClientCA string
+		dryRun         bool
+		json           bool
+	}
 )
 
+func init() {
+	serverCmd.Flags().StringVar(&serverOpts.remoteListen, "remote-listen", "", "address to serve the remote unlock API on (default: disabled)")
+	serverCmd.Flags().StringVar(&serverOpts.remoteCert, "remote-cert", "", "path to the remote unlock server certificate (PEM)")
+	serverCmd.Flags().StringVar(&serverOpts.remoteKey, "remote-key", "", "path to the remote unlock server private key (PEM)")
+	serverCmd.Flags().StringVar(&serverOpts.remoteClientCA, "remote-client-ca", "", "path to the CA certificates for remote unlock clients (PEM)")
+	serverCmd.Flags().BoolVar(&serverOpts.dryRun, "dry-run", false, "retrieve and verify the key of every configured keyslot, then exit")
+	serverCmd.Flags().BoolVar(&serverOpts.json, "json", false, "print JSON output, with --dry-run")
+}
+
 func runServerCmd(cmd *cobra.Command, args []string) error {
 	if len(args) != 0 {
 		return errors.New("too many arguments")
 	}
+	if serverOpts.json && !serverOpts.dryRun {
+		return errors.New("--json requires --dry-run")
+	}
 	logrus.Infoln("starting coreos-cryptagent server")
+	var tlsConfig *tls.Config
+	if serverOpts.remoteListen != "" {
+		if serverOpts.dryRun {
+			return errors.New("remote unlock cannot be used with --dry-run")
+		}
+		if serverOpts.remoteCert == "" || serverOpts.remoteKey == "" || serverOpts.remoteClientCA == "" {
+			return errors.New("remote unlock requires --remote-cert, --remote-key and --remote-client-ca")
+		}
+		var err error
+		tlsConfig, err = remote.TLSConfig(serverOpts.remoteCert, serverOpts.remoteKey, serverOpts.remoteClientCA)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logrus.Infof("received %s, stopping", sig)
+		cancel()
+	}()
+
+	if serverOpts.dryRun {
+		return dryRunServer(ctx)
+	}
+	if tlsConfig != nil {
+		remoteErr := make(chan error, 1)
+		go func() {
+			logrus.Infof("serving remote unlock API on %s", serverOpts.remoteListen)
+			err := remote.ListenAndServe(ctx, serverOpts.remoteListen, tlsConfig, remote.Handler{Dir: agent.AskPasswordDir, Audit: auditLog()})
+			if err != nil {
+				// Stop the agent too, so that the failure is visible.
+				cancel()
+			}
+			remoteErr <- err
+		}()
+		if err := agent.Watch(ctx, agent.AskPasswordDir, handlePasswordRequest); err != nil {
+			return err
+		}
+		return <-remoteErr
+	}
+
+	return agent.Watch(ctx, agent.AskPasswordDir, handlePasswordRequest)
+}
+
+// handlePasswordRequest answers a systemd-cryptsetup password request for a
+// configured volume. Requests for unknown volumes are left to other agents.
+func handlePasswordRequest(ctx context.Context, req agent.Request) {
+	target, ok := req.Volume()
+	if !ok {
+		return
+	}
+	var confDir string
+	var err error
+	log := logrus.WithField(logging.FieldVolume, target)
+	if filepath.IsAbs(target) {
+		log = logrus.WithField(logging.FieldDevice, target)
+		confDir, err = hostSystem().LookupConfigDir(target)
+	} else {
+		confDir, err = configRoots().LookupConfigDirByName(target)
+	}
+	if err != nil {
+		log.Debugf("ignoring password request for %s: %s", target, err)
+		return
+	}
 
-	//TODO(lucab): agent server logic
-	for {
+	keyCtx := ctx
+	if d := req.Deadline(); d > 0 {
+		var cancel context.CancelFunc
+		keyCtx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	u := unlock.Unlocker{Cryptsetup: luks.Default, Audit: auditLog(), Roots: configRoots()}
+	res, err := u.Key(keyCtx, confDir)
+	if err != nil {
+		log.Errorf("failed to retrieve key for %s: %s", target, err)
+		return
+	}
+	log = log.WithFields(logrus.Fields{
+		logging.FieldKeyslot:  res.Keyslot,
+		logging.FieldProvider: res.Provider.String(),
+	})
+	if err := req.Reply(res.Key); err != nil {
+		log.Errorf("failed to answer password request for %s: %s", target, err)
+		return
+	}
+	log.Infof("answered password request for %s with keyslot %d (%s)", target, res.Keyslot, res.Provider)
+
+	volume := target
+	if filepath.IsAbs(target) {
+		volume = res.Volume
+	}
+	commitKey(ctx, log, res, volume)
+}
+
+// dryRunServer retrieves and verifies the key of every keyslot of all
+// configured volumes, instead of waiting for password requests, and prints
+// how each volume would be activated as `attach --dry-run` does. Dry runs
+// are not unlocks, thus they are not audited.
+func dryRunServer(ctx context.Context) error {
+	sys := hostSystem()
+	vols, err := sys.ListVolumes()
+	if err != nil {
+		return err
+	}
+	u := unlock.Unlocker{Cryptsetup: luks.Default, Roots: configRoots()}
+	plans := []unlock.Plan{}
+	failed := 0
+	for _, v := range vols {
+		log := logrus.WithField(logging.FieldDevice, v.Device)
+		if v.Error != "" {
+			log.Errorf("dry run: volume on %s: %s", v.Device, v.Error)
+			failed++
+			continue
+		}
+		log = log.WithField(logging.FieldVolume, v.Name)
+		plan, checks, err := u.PlanCheck(ctx, sys, unlock.SystemdCryptsetup, v.Device)
+		for _, c := range checks {
+			klog := log.WithFields(logrus.Fields{
+				logging.FieldKeyslot:  c.Keyslot,
+				logging.FieldProvider: c.Provider.String(),
+			})
+			if c.Err != nil {
+				klog.Errorf("dry run: keyslot %d of volume %s failed: %s", c.Keyslot, v.Name, c.Err)
+				failed++
+				continue
+			}
+			klog.Infof("dry run: keyslot %d (%s) opens volume %s", c.Keyslot, c.Provider, v.Name)
+		}
+		if err != nil {
+			log.Errorf("dry run: volume %s: %s", v.Name, err)
+			// Keyslot failures are already counted.
+			if len(checks) == 0 {
+				failed++
+			}
+			continue
+		}
+		plans = append(plans, plan)
+	}
+
+	if serverOpts.json {
+		err = printJSON(os.Stdout, plans)
+	} else {
+		for i, plan := range plans {
+			if i > 0 {
+				fmt.Println()
+			}
+			if err = printPlan(os.Stdout, plan); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("dry run: %d failures", failed)
+	}
+	return nil
+}
+
+// commitKey commits the key of `res` once `volume` is active. If it does not
+// show up, e.g. because activation failed, the key is left uncommitted so
+// that one-time keys stay available for another attempt.
+func commitKey(ctx context.Context, log *logrus.Entry, res unlock.Result, volume string) {
+	if !res.NeedsCommit() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, activationTimeout)
+	defer cancel()
+	if err := unlock.WaitActive(ctx, volume); err != nil {
+		log.Warnf("not committing keyslot %d, volume %s is not active: %s", res.Keyslot, volume, err)
+		return
+	}
+	if err := res.Commit(ctx); err != nil {
+		log.Warnf("failed to commit keyslot %d of volume %s: %s", res.Keyslot, volume, err)
+		return
 	}
+	log.Debugf("committed keyslot %d of volume %s", res.Keyslot, volume)
 }
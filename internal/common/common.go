@@ -15,10 +15,7 @@
 package common
 
 import (
-	"bufio"
-	"encoding/json"
 	"io/ioutil"
-	"os"
 	"path/filepath"
 	"strings"
 
@@ -30,62 +27,74 @@ import (
 
 const devBlockPath = "/dev/block/"
 
+// System is a view of the host devices and of the configuration.
+//
+// Device and sysfs paths are resolved under `Root`, which allows tests to
+// run against fake device trees. Symlinks in such trees must be relative.
+type System struct {
+	// Root is prepended to `/dev` and `/sys` paths, empty for the host.
+	Root string
+	// Roots are the configuration roots.
+	Roots Roots
+}
+
+// hostPath translates an absolute host path into the system view.
+func (s System) hostPath(path string) string {
+	if s.Root == "" {
+		return path
+	}
+	return filepath.Join(s.Root, path)
+}
+
 // LookupBlockdev translates a block device path into its `/dev/block` entry.
 //
 // `path` must be an existing absolute path. The resulting string is an absolute
 // path rooted at `/dev/block/`.
-func LookupBlockdev(pathIn string) (string, error) {
+func (s System) LookupBlockdev(pathIn string) (string, error) {
 	logrus.Debugf("looking up block device for %s", pathIn)
 	if pathIn == "" {
 		return "", errors.New("empty path to lookup")
 	}
-	realPath, err := filepath.EvalSymlinks(pathIn)
+	realPath, err := filepath.EvalSymlinks(s.hostPath(pathIn))
 	if err != nil {
 		return "", err
 	}
 
-	fis, err := ioutil.ReadDir(devBlockPath)
+	blockDir := s.hostPath(devBlockPath)
+	fis, err := ioutil.ReadDir(blockDir)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to list %s", devBlockPath)
+		return "", errors.Wrapf(err, "failed to list %s", blockDir)
 	}
 	for _, fi := range fis {
-		entry := filepath.Join(devBlockPath, fi.Name())
-		resolved, err := filepath.EvalSymlinks(entry)
+		resolved, err := filepath.EvalSymlinks(filepath.Join(blockDir, fi.Name()))
 		if err == nil && realPath == resolved {
-			return entry, nil
+			return filepath.Join(devBlockPath, fi.Name()), nil
 		}
 	}
 
 	return "", errors.Errorf("unable to lookup %s", pathIn)
 }
 
-// LookupVolName translates a block device path into its LUKS volume name.
-//
-// `path` must be an existing absolute path. The resulting string is a volume name.
-func LookupVolName(pathIn string) (string, error) {
-	// To ease testing, inject the base directory to a private function.
-	return lookupVolName(config.DevConfigDir, pathIn)
-}
-
-func lookupVolName(devConfigDir string, pathIn string) (string, error) {
+// lookupVolName translates a block device path into its LUKS volume name,
+// from the configuration in `devConfigDir`.
+func (s System) lookupVolName(devConfigDir string, pathIn string) (string, error) {
 	logrus.Debugf("looking up volume name for device %s", pathIn)
 	if pathIn == "" {
 		return "", errors.New("empty path to lookup")
 	}
-	confDir, err := lookupConfigDir(devConfigDir, pathIn)
+	confDir, err := s.lookupConfigDir(devConfigDir, pathIn)
 	if err != nil {
 		return "", err
 	}
+	return volName(confDir)
+}
 
-	fp, err := os.Open(filepath.Join(confDir, "volume.json"))
+// volName returns the LUKS volume name configured in `confDir`.
+func volName(confDir string) (string, error) {
+	vj, err := ReadVolume(confDir)
 	if err != nil {
 		return "", err
 	}
-	defer fp.Close()
-	var vj config.VolumeJSON
-	if err := json.NewDecoder(bufio.NewReader(fp)).Decode(&vj); err != nil {
-		return "", err
-	}
 
 	if luks1, ok := vj.Value.(config.CryptsetupLUKS1V1); ok {
 		if luks1.Name == "" {
@@ -102,14 +111,14 @@ func lookupVolName(devConfigDir string, pathIn string) (string, error) {
 // `path` must be an existing absolute path to a device. `devConfigDir` is the default
 // base config directory for coreos-cryptagent. The resulting string is the absolute
 // path to the device configuration directory.
-func lookupConfigDir(devConfigDir string, pathIn string) (string, error) {
+func (s System) lookupConfigDir(devConfigDir string, pathIn string) (string, error) {
 	if pathIn == "" {
 		return "", errors.New("empty device id")
 	}
 
 	dev := pathIn
 	if !strings.HasPrefix(dev, devBlockPath) {
-		res, err := LookupBlockdev(pathIn)
+		res, err := s.LookupBlockdev(pathIn)
 		if err != nil {
 			return "", err
 		}
@@ -125,7 +134,7 @@ func lookupConfigDir(devConfigDir string, pathIn string) (string, error) {
 			continue
 		}
 		plain := unit.UnitNamePathUnescape(fi.Name())
-		plainDev, err := LookupBlockdev(plain)
+		plainDev, err := s.LookupBlockdev(plain)
 		if err != nil {
 			return "", err
 		}
@@ -47,7 +47,7 @@ func TestLookupBlockdevLoop(t *testing.T) {
 		t.Skipf("test setup failed: %s", err)
 	}
 
-	out, err := LookupBlockdev(loop0Dev)
+	out, err := System{}.LookupBlockdev(loop0Dev)
 	if err != nil {
 		t.Fatalf("unexpected error %q", err)
 	}
@@ -91,7 +91,7 @@ func TestLookupVolNameLoop(t *testing.T) {
 	}
 	fp.Sync()
 
-	out, err := lookupVolName(tmpDir, loop0BlockDev)
+	out, err := System{}.lookupVolName(tmpDir, loop0BlockDev)
 	if err != nil {
 		t.Fatalf("unexpected error %q", err)
 	}
@@ -116,7 +116,7 @@ func TestLookupBlockdev(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		_, err := LookupBlockdev(tt.pathIn)
+		_, err := System{}.LookupBlockdev(tt.pathIn)
 		if err != nil && err.Error() != tt.expErr.Error() {
 			t.Fatalf("expected error %q, got %q", tt.expErr, err)
 		}
@@ -140,10 +140,126 @@ func TestLookupVolName(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		_, err := LookupVolName(tt.pathIn)
+		_, err := System{Roots: config.DefaultConfigRoots}.LookupVolName(tt.pathIn)
 		if err != nil && err.Error() != tt.expErr.Error() {
 			t.Fatalf("expected error %q, got %q", tt.expErr, err)
 		}
 	}
 
 }
+
+// writeDevTree creates a fake `/dev` under `root`, with relative symlinks
+// as udev would create them.
+func writeDevTree(t *testing.T, root string) {
+	links := map[string]string{
+		"dev/block/8:1":         "../sda1",
+		"dev/block/8:2":         "../sda2",
+		"dev/disk/by-uuid/abcd": "../../sda2",
+	}
+	for _, dev := range []string{"sda1", "sda2"} {
+		if err := os.MkdirAll(filepath.Join(root, "dev"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "dev", dev), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range links {
+		path := filepath.Join(root, link)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSystemLookup(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "common_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	writeDevTree(t, tmpDir)
+	confRoot := filepath.Join(tmpDir, "etc")
+	confDir := writeTestVolume(t, confRoot, "/dev/disk/by-uuid/abcd", "luks_vol")
+	sys := System{Root: tmpDir, Roots: Roots{confRoot}}
+
+	for _, tt := range []struct {
+		pathIn string
+		exp    string
+	}{
+		{"/dev/sda1", "/dev/block/8:1"},
+		{"/dev/sda2", "/dev/block/8:2"},
+		{"/dev/disk/by-uuid/abcd", "/dev/block/8:2"},
+		{"/dev/sdb", ""},
+	} {
+		out, err := sys.LookupBlockdev(tt.pathIn)
+		if tt.exp == "" {
+			if err == nil {
+				t.Fatalf("expected error for %s, got %q", tt.pathIn, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if out != tt.exp {
+			t.Fatalf("expected %q for %s, got %q", tt.exp, tt.pathIn, out)
+		}
+	}
+
+	for _, pathIn := range []string{"/dev/sda2", "/dev/block/8:2"} {
+		out, err := sys.LookupConfigDir(pathIn)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if out != confDir {
+			t.Fatalf("expected %q for %s, got %q", confDir, pathIn, out)
+		}
+		name, err := sys.LookupVolName(pathIn)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if name != "luks_vol" {
+			t.Fatalf("expected volume luks_vol for %s, got %q", pathIn, name)
+		}
+	}
+	if _, err := sys.LookupVolName("/dev/sda1"); err == nil {
+		t.Fatalf("expected error for unconfigured device")
+	}
+
+	// Aliases of a configured device share its directory.
+	for _, tt := range []struct {
+		pathIn string
+		exp    string
+	}{
+		{"/dev/sda2", confDir},
+		{"/dev/block/8:2", confDir},
+		{"/dev/sda1", DeviceConfigDir(filepath.Join(confRoot, config.DevConfigSubdir), "/dev/sda1")},
+		{"/dev/sdb", ""},
+	} {
+		out, err := sys.DeviceConfigDir(tt.pathIn)
+		if tt.exp == "" {
+			if err == nil {
+				t.Fatalf("expected error for %s, got %q", tt.pathIn, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if out != tt.exp {
+			t.Fatalf("expected %q for %s, got %q", tt.exp, tt.pathIn, out)
+		}
+	}
+
+	vols, err := sys.ListVolumes()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if len(vols) != 1 || vols[0].BlockDevice != "/dev/block/8:2" {
+		t.Fatalf("unexpected volumes %+v", vols)
+	}
+}
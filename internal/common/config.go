@@ -0,0 +1,245 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/coreos/go-systemd/unit"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const volumeFile = "volume.json"
+
+var keyslotFileRe = regexp.MustCompile(`^(\d+)\.json$`)
+
+// DeviceConfigDir returns the configuration directory for a device path.
+//
+// `devPath` is the user-specified path of the encrypted device, which is
+// escaped as per `systemd-escape --path`.
+func DeviceConfigDir(devConfigDir string, devPath string) string {
+	return filepath.Join(devConfigDir, unit.UnitNamePathEscape(devPath))
+}
+
+// ReadVolume decodes the volume configuration in `confDir`.
+func ReadVolume(confDir string) (config.VolumeJSON, error) {
+	var vj config.VolumeJSON
+	err := readJSON(filepath.Join(confDir, volumeFile), &vj)
+	return vj, err
+}
+
+// WriteVolume atomically stores the volume configuration in `confDir`.
+func WriteVolume(confDir string, vj config.VolumeJSON) error {
+	return writeJSON(filepath.Join(confDir, volumeFile), vj)
+}
+
+// CryptsetupOptions returns the systemd-cryptsetup options for volume
+// `luks1`, as used by attach, the generator and crypttab export.
+//
+// Discards are only allowed if `disableDiscard` is explicitly false.
+func CryptsetupOptions(luks1 config.CryptsetupLUKS1V1) []string {
+	opts := []string{}
+	if luks1.DisableDiscard != nil && !*luks1.DisableDiscard {
+		opts = append(opts, "discard")
+	}
+	return opts
+}
+
+// VolumeDir is the complete configuration of a device directory.
+type VolumeDir struct {
+	Dir      string
+	Volume   config.VolumeJSON
+	Keyslots map[int]config.ProviderJSON
+}
+
+// WriteVolumeDirs creates all the given configuration directories, or none
+// of them.
+//
+// Each directory is populated under a temporary name next to its
+// destination, then renamed in place once all of them are complete. On
+// failure, the directories renamed so far are removed again.
+func WriteVolumeDirs(vds []VolumeDir) (err error) {
+	for _, vd := range vds {
+		if _, err := os.Lstat(vd.Dir); err == nil {
+			return errors.Errorf("%s already exists", vd.Dir)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	staged := make([]string, 0, len(vds))
+	defer func() {
+		for _, tmpDir := range staged {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+	for _, vd := range vds {
+		parent := filepath.Dir(vd.Dir)
+		if err := os.MkdirAll(parent, 0700); err != nil {
+			return err
+		}
+		tmpDir, err := ioutil.TempDir(parent, "."+filepath.Base(vd.Dir))
+		if err != nil {
+			return err
+		}
+		staged = append(staged, tmpDir)
+		if err := WriteVolume(tmpDir, vd.Volume); err != nil {
+			return errors.Wrap(err, "failed to write volume configuration")
+		}
+		for n, pj := range vd.Keyslots {
+			if err := WriteKeyslot(tmpDir, n, pj); err != nil {
+				return errors.Wrapf(err, "failed to write keyslot %d configuration", n)
+			}
+		}
+	}
+
+	renamed := []string{}
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, dir := range renamed {
+			if rmErr := os.RemoveAll(dir); rmErr != nil {
+				logrus.Errorf("failed to remove %s: %s", dir, rmErr)
+			}
+		}
+	}()
+	for i, vd := range vds {
+		if err := os.Rename(staged[i], vd.Dir); err != nil {
+			return err
+		}
+		renamed = append(renamed, vd.Dir)
+		if err := syncDir(filepath.Dir(vd.Dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keyslots returns the sorted list of keyslots configured in `confDir`.
+func Keyslots(confDir string) ([]int, error) {
+	fis, err := ioutil.ReadDir(confDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s", confDir)
+	}
+	slots := []int{}
+	for _, fi := range fis {
+		m := keyslotFileRe.FindStringSubmatch(fi.Name())
+		if fi.IsDir() || m == nil {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, n)
+	}
+
+	sort.Ints(slots)
+	return slots, nil
+}
+
+// ReadKeyslot decodes the configuration for keyslot `n` in `confDir`.
+func ReadKeyslot(confDir string, n int) (config.ProviderJSON, error) {
+	return ReadProvider(KeyslotPath(confDir, n))
+}
+
+// ReadProvider decodes a provider configuration file.
+func ReadProvider(path string) (config.ProviderJSON, error) {
+	var pj config.ProviderJSON
+	err := readJSON(path, &pj)
+	return pj, err
+}
+
+// WriteKeyslot atomically stores the configuration for keyslot `n` in `confDir`.
+func WriteKeyslot(confDir string, n int, pj config.ProviderJSON) error {
+	return writeJSON(KeyslotPath(confDir, n), pj)
+}
+
+// RemoveKeyslot durably removes the configuration for keyslot `n` in
+// `confDir`, if any.
+func RemoveKeyslot(confDir string, n int) error {
+	if err := os.Remove(KeyslotPath(confDir, n)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(confDir)
+}
+
+// KeyslotPath returns the path of the configuration file for keyslot `n`.
+func KeyslotPath(confDir string, n int) string {
+	return filepath.Join(confDir, strconv.Itoa(n)+".json")
+}
+
+func readJSON(path string, v interface{}) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := json.NewDecoder(bufio.NewReader(fp)).Decode(v); err != nil {
+		return errors.Wrapf(err, "failed to decode %s", path)
+	}
+	return nil
+}
+
+// writeJSON encodes `v` into a temporary file, which is then renamed to `path`.
+func writeJSON(path string, v interface{}) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fp, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	tmpPath := fp.Name()
+	defer os.Remove(tmpPath)
+	defer fp.Close()
+
+	enc := json.NewEncoder(fp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return errors.Wrapf(err, "failed to encode %s", path)
+	}
+	if err := fp.Sync(); err != nil {
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes the entries of directory `dir` to disk.
+func syncDir(dir string) error {
+	dfp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dfp.Close()
+	return dfp.Sync()
+}
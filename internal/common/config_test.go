@@ -0,0 +1,170 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+func TestDeviceConfigDir(t *testing.T) {
+	out := DeviceConfigDir("/conf", "/dev/disk/by-id/foo-bar")
+	exp := "/conf/dev-disk-by\\x2did-foo\\x2dbar"
+	if out != exp {
+		t.Fatalf("expected %q, got %q", exp, out)
+	}
+}
+
+func TestKeyslotsRoundtrip(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "common_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	confDir := filepath.Join(tmpDir, "dev-loop0")
+
+	luks := config.CryptsetupLUKS1V1{
+		Name:   "luks_vol",
+		Device: "/dev/loop0",
+	}
+	if err := WriteVolume(confDir, config.VolumeJSON{Kind: config.VolumeCryptsetupLUKS1V1, Value: luks}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	content := config.ContentV1{Source: "https://localhost/key.txt"}
+	for _, n := range []int{3, 0} {
+		pj := config.ProviderJSON{Kind: config.ProviderContentV1, Value: content}
+		if err := WriteKeyslot(confDir, n, pj); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	// Unrelated entries must be ignored.
+	if err := ioutil.WriteFile(filepath.Join(confDir, "1.json~"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	slots, err := Keyslots(confDir)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !reflect.DeepEqual(slots, []int{0, 3}) {
+		t.Fatalf("expected keyslots [0 3], got %v", slots)
+	}
+
+	vj, err := ReadVolume(confDir)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !reflect.DeepEqual(vj.Value, luks) {
+		t.Fatalf("expected volume %v, got %v", luks, vj.Value)
+	}
+	pj, err := ReadKeyslot(confDir, 3)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !reflect.DeepEqual(pj.Value, content) {
+		t.Fatalf("expected keyslot %v, got %v", content, pj.Value)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := RemoveKeyslot(confDir, 3); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	slots, err = Keyslots(confDir)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !reflect.DeepEqual(slots, []int{0}) {
+		t.Fatalf("expected keyslots [0], got %v", slots)
+	}
+}
+
+func TestWriteVolumeDirs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "common_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	vj := config.VolumeJSON{
+		Kind:  config.VolumeCryptsetupLUKS1V1,
+		Value: config.CryptsetupLUKS1V1{Name: "luks_vol", Device: "/dev/loop0"},
+	}
+	pj := config.ProviderJSON{
+		Kind:  config.ProviderContentV1,
+		Value: config.ContentV1{Source: "https://localhost/key.txt"},
+	}
+	vd := func(name string) VolumeDir {
+		return VolumeDir{
+			Dir:      filepath.Join(tmpDir, "dev", name),
+			Volume:   vj,
+			Keyslots: map[int]config.ProviderJSON{1: pj},
+		}
+	}
+	notFile := filepath.Join(tmpDir, "file")
+	if err := ioutil.WriteFile(notFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		vds []VolumeDir
+		err bool
+	}{
+		// Destination already exists.
+		{[]VolumeDir{vd("dev-loop1"), {Dir: notFile}}, true},
+		// Staging fails.
+		{[]VolumeDir{vd("dev-loop1"), {Dir: filepath.Join(notFile, "dev-loop2")}}, true},
+		// Renaming the second directory fails, the first one is rolled back.
+		{[]VolumeDir{vd("dev-loop1"), vd("dev-loop1")}, true},
+		{[]VolumeDir{vd("dev-loop1"), vd("dev-loop2")}, false},
+	}
+	for i, tt := range tests {
+		err := WriteVolumeDirs(tt.vds)
+		if tt.err && err == nil {
+			t.Fatalf("#%d: expected error", i)
+		}
+		if !tt.err && err != nil {
+			t.Fatalf("#%d: unexpected error %q", i, err)
+		}
+		fis, err := ioutil.ReadDir(filepath.Join(tmpDir, "dev"))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		exp := []string{}
+		if !tt.err {
+			exp = []string{"dev-loop1", "dev-loop2"}
+		}
+		if !reflect.DeepEqual(names, exp) {
+			t.Fatalf("#%d: expected directories %v, got %v", i, exp, names)
+		}
+	}
+
+	slots, err := Keyslots(filepath.Join(tmpDir, "dev", "dev-loop2"))
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !reflect.DeepEqual(slots, []int{1}) {
+		t.Fatalf("expected keyslots [1], got %v", slots)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/coreos/go-systemd/unit"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Roots are layered configuration roots, by decreasing precedence.
+//
+// A volume configured in several roots is entirely taken from the first one
+// (i.e. keyslots are not merged across roots). Missing roots are skipped.
+type Roots []string
+
+// RootsFromEnv returns the roots from the environment, or the default ones.
+func RootsFromEnv() Roots {
+	env := os.Getenv(config.ConfigRootEnv)
+	if env == "" {
+		return Roots(config.DefaultConfigRoots)
+	}
+	roots := Roots{}
+	for _, r := range strings.Split(env, ":") {
+		if r != "" {
+			roots = append(roots, r)
+		}
+	}
+	return roots
+}
+
+// devConfigDirs returns the device configuration directories of all roots.
+func (r Roots) devConfigDirs() []string {
+	dirs := make([]string, 0, len(r))
+	for _, root := range r {
+		dirs = append(dirs, filepath.Join(root, config.DevConfigSubdir))
+	}
+	return dirs
+}
+
+// writable returns the root where new volumes are configured: the first
+// one which is neither the vendor nor the runtime root, if any.
+func (r Roots) writable() (string, error) {
+	if len(r) == 0 {
+		return "", errors.New("no configuration roots")
+	}
+	for _, root := range r {
+		clean := filepath.Clean(root)
+		if clean != filepath.Clean(config.VendorConfigDir) && clean != filepath.Clean(config.RuntimeConfigDir) {
+			return root, nil
+		}
+	}
+	return r[0], nil
+}
+
+// VolumeDirs returns the effective configuration directory of each
+// configured device, sorted by escaped device path.
+func (r Roots) VolumeDirs() ([]string, error) {
+	found := map[string]string{}
+	for _, devConfigDir := range r.devConfigDirs() {
+		fis, err := ioutil.ReadDir(devConfigDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list %s", devConfigDir)
+		}
+		for _, fi := range fis {
+			if _, ok := found[fi.Name()]; ok || !fi.IsDir() {
+				continue
+			}
+			found[fi.Name()] = filepath.Join(devConfigDir, fi.Name())
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dirs := make([]string, 0, len(names))
+	for _, name := range names {
+		dirs = append(dirs, found[name])
+	}
+	return dirs, nil
+}
+
+// DeviceConfigDir returns the effective configuration directory for a
+// device path, which is in the writable root if not configured yet.
+func (r Roots) DeviceConfigDir(devPath string) (string, error) {
+	for _, devConfigDir := range r.devConfigDirs() {
+		dir := DeviceConfigDir(devConfigDir, devPath)
+		if _, err := os.Stat(dir); err == nil {
+			return dir, nil
+		}
+	}
+	root, err := r.writable()
+	if err != nil {
+		return "", err
+	}
+	return DeviceConfigDir(filepath.Join(root, config.DevConfigSubdir), devPath), nil
+}
+
+// LookupConfigDir translates a block device path into its effective
+// configuration directory.
+//
+// `path` must be an existing absolute path. The resulting string is the absolute
+// path to the device configuration directory.
+func (s System) LookupConfigDir(pathIn string) (string, error) {
+	if pathIn == "" {
+		return "", errors.New("empty device id")
+	}
+	// Resolve the device once, instead of for each root.
+	dev := pathIn
+	if !strings.HasPrefix(dev, devBlockPath) {
+		res, err := s.LookupBlockdev(pathIn)
+		if err != nil {
+			return "", err
+		}
+		dev = res
+	}
+	return s.Roots.lookup(func(devConfigDir string) (string, error) {
+		return s.lookupConfigDir(devConfigDir, dev)
+	}, pathIn)
+}
+
+// DeviceConfigDir returns the effective configuration directory of the
+// block device at `devPath`, whichever alias it is configured under, or a
+// new directory in the writable root if it is not configured yet.
+func (s System) DeviceConfigDir(devPath string) (string, error) {
+	dev, err := s.LookupBlockdev(devPath)
+	if err != nil {
+		return "", err
+	}
+	dirs, err := s.Roots.VolumeDirs()
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range dirs {
+		plain := unit.UnitNamePathUnescape(filepath.Base(dir))
+		configured, err := s.LookupBlockdev(plain)
+		if err != nil {
+			logrus.Debugf("skipping config directory %q: %s", dir, err)
+			continue
+		}
+		if configured == dev {
+			return dir, nil
+		}
+	}
+	return s.Roots.DeviceConfigDir(devPath)
+}
+
+// LookupConfigDirByName translates a volume name into its effective
+// configuration directory.
+func (r Roots) LookupConfigDirByName(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("empty volume name")
+	}
+	// Only effective directories are considered, so that shadowed volumes
+	// cannot match.
+	dirs, err := r.VolumeDirs()
+	if err != nil {
+		return "", err
+	}
+	for _, path := range dirs {
+		vj, err := ReadVolume(path)
+		if err != nil {
+			logrus.Debugf("skipping config directory %q: %s", path, err)
+			continue
+		}
+		if luks1, ok := vj.Value.(config.CryptsetupLUKS1V1); ok && luks1.Name == name {
+			logrus.Debugf("found config directory %q for volume %q", path, name)
+			return path, nil
+		}
+	}
+
+	return "", errors.Errorf("no config directory found for volume %q", name)
+}
+
+// LookupVolName translates a block device path into its LUKS volume name.
+//
+// `path` must be an existing absolute path. The resulting string is a volume name.
+func (s System) LookupVolName(pathIn string) (string, error) {
+	if pathIn == "" {
+		return "", errors.New("empty path to lookup")
+	}
+	confDir, err := s.LookupConfigDir(pathIn)
+	if err != nil {
+		return "", err
+	}
+	return volName(confDir)
+}
+
+// lookup returns the first successful `fn` result over all roots, skipping
+// missing ones.
+func (r Roots) lookup(fn func(devConfigDir string) (string, error), target string) (string, error) {
+	failures := []string{}
+	for _, devConfigDir := range r.devConfigDirs() {
+		if _, err := os.Stat(devConfigDir); os.IsNotExist(err) {
+			continue
+		}
+		res, err := fn(devConfigDir)
+		if err == nil {
+			return res, nil
+		}
+		failures = append(failures, err.Error())
+	}
+	if len(failures) == 0 {
+		return "", errors.Errorf("no configuration root found for %q", target)
+	}
+	return "", errors.Errorf("lookup failed for %q: %s", target, strings.Join(failures, "; "))
+}
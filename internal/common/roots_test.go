@@ -0,0 +1,125 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+func writeTestVolume(t *testing.T, root string, device string, name string) string {
+	confDir := DeviceConfigDir(filepath.Join(root, config.DevConfigSubdir), device)
+	luks := config.CryptsetupLUKS1V1{Name: name, Device: device}
+	if err := WriteVolume(confDir, config.VolumeJSON{Kind: config.VolumeCryptsetupLUKS1V1, Value: luks}); err != nil {
+		t.Fatal(err)
+	}
+	return confDir
+}
+
+func TestRootsLayering(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "common_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	run := filepath.Join(tmpDir, "run")
+	boot := filepath.Join(tmpDir, "boot")
+	vendor := filepath.Join(tmpDir, "vendor")
+	roots := Roots{run, boot, vendor, filepath.Join(tmpDir, "missing")}
+
+	writeTestVolume(t, vendor, "/dev/sda2", "vendor_root")
+	bootRoot := writeTestVolume(t, boot, "/dev/sda2", "boot_root")
+	runData := writeTestVolume(t, run, "/dev/sdb1", "run_data")
+	vendorSwap := writeTestVolume(t, vendor, "/dev/sdc1", "vendor_swap")
+
+	dirs, err := roots.VolumeDirs()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	exp := []string{bootRoot, runData, vendorSwap}
+	if !reflect.DeepEqual(dirs, exp) {
+		t.Fatalf("expected %v, got %v", exp, dirs)
+	}
+
+	vols, err := System{Roots: roots}.ListVolumes()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if len(vols) != 3 || vols[0].Name != "boot_root" || vols[0].Device != "/dev/sda2" {
+		t.Fatalf("unexpected volumes %+v", vols)
+	}
+
+	for _, tt := range []struct {
+		name string
+		exp  string
+	}{
+		{"boot_root", bootRoot},
+		{"run_data", runData},
+		{"vendor_swap", vendorSwap},
+		{"vendor_root", ""},
+	} {
+		out, err := roots.LookupConfigDirByName(tt.name)
+		if tt.exp == "" {
+			if err == nil {
+				t.Fatalf("expected error for shadowed volume %s, got %q", tt.name, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if out != tt.exp {
+			t.Fatalf("expected %q for %s, got %q", tt.exp, tt.name, out)
+		}
+	}
+
+	for _, tt := range []struct {
+		roots  Roots
+		device string
+		exp    string
+	}{
+		{roots, "/dev/sda2", bootRoot},
+		{roots, "/dev/sdd", DeviceConfigDir(filepath.Join(run, config.DevConfigSubdir), "/dev/sdd")},
+		{Roots{config.RuntimeConfigDir, config.BaseConfigDir}, "/dev/sdd", DeviceConfigDir(config.DevConfigDir, "/dev/sdd")},
+		{Roots{config.RuntimeConfigDir}, "/dev/sdd", DeviceConfigDir(filepath.Join(config.RuntimeConfigDir, "dev"), "/dev/sdd")},
+	} {
+		out, err := tt.roots.DeviceConfigDir(tt.device)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if out != tt.exp {
+			t.Fatalf("expected %q for %s, got %q", tt.exp, tt.device, out)
+		}
+	}
+}
+
+func TestRootsFromEnv(t *testing.T) {
+	defer os.Unsetenv(config.ConfigRootEnv)
+
+	os.Unsetenv(config.ConfigRootEnv)
+	if out := RootsFromEnv(); !reflect.DeepEqual(out, Roots(config.DefaultConfigRoots)) {
+		t.Fatalf("expected default roots, got %v", out)
+	}
+	os.Setenv(config.ConfigRootEnv, "/run/test::/boot/test")
+	exp := Roots{"/run/test", "/boot/test"}
+	if out := RootsFromEnv(); !reflect.DeepEqual(out, exp) {
+		t.Fatalf("expected %v, got %v", exp, out)
+	}
+}
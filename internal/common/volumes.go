@@ -0,0 +1,169 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/coreos/go-systemd/unit"
+	"github.com/pkg/errors"
+)
+
+const (
+	devMapperPath = "/dev/mapper/"
+	sysBlockPath  = "/sys/block/"
+)
+
+// VolumeInfo summarizes the configuration of an encrypted device.
+type VolumeInfo struct {
+	Device      string        `json:"device"`
+	BlockDevice string        `json:"blockDevice,omitempty"`
+	ConfigDir   string        `json:"configDir"`
+	Name        string        `json:"name,omitempty"`
+	Kind        string        `json:"kind"`
+	Keyslots    []KeyslotInfo `json:"keyslots"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// KeyslotInfo summarizes the configuration of a keyslot.
+type KeyslotInfo struct {
+	Slot     int    `json:"slot"`
+	Provider string `json:"provider"`
+	Error    string `json:"error,omitempty"`
+}
+
+// MapperStatus records the live state of a device-mapper volume.
+type MapperStatus struct {
+	Active    bool   `json:"active"`
+	Path      string `json:"path,omitempty"`
+	DmName    string `json:"dmName,omitempty"`
+	UUID      string `json:"uuid,omitempty"`
+	Suspended bool   `json:"suspended"`
+}
+
+// ListVolumes enumerates the effective configuration of all devices.
+//
+// Broken entries are reported in the `Error` fields of the results,
+// instead of failing the whole listing.
+func (s System) ListVolumes() ([]VolumeInfo, error) {
+	dirs, err := s.Roots.VolumeDirs()
+	if err != nil {
+		return nil, err
+	}
+	vols := []VolumeInfo{}
+	for _, dir := range dirs {
+		vols = append(vols, s.volumeInfo(dir, unit.UnitNamePathUnescape(filepath.Base(dir))))
+	}
+	return vols, nil
+}
+
+func (s System) volumeInfo(confDir string, device string) VolumeInfo {
+	info := VolumeInfo{
+		Device:    device,
+		ConfigDir: confDir,
+		Kind:      config.VolumeInvalid.String(),
+		Keyslots:  []KeyslotInfo{},
+	}
+	if blockdev, err := s.LookupBlockdev(device); err == nil {
+		info.BlockDevice = blockdev
+	}
+
+	vj, err := ReadVolume(confDir)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Kind = vj.Kind.String()
+	if luks1, ok := vj.Value.(config.CryptsetupLUKS1V1); ok {
+		info.Name = luks1.Name
+	}
+
+	slots, err := Keyslots(confDir)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	for _, n := range slots {
+		ks := KeyslotInfo{
+			Slot:     n,
+			Provider: config.ProviderInvalid.String(),
+		}
+		pj, err := ReadKeyslot(confDir, n)
+		if err != nil {
+			ks.Error = err.Error()
+		} else {
+			ks.Provider = pj.Kind.String()
+		}
+		info.Keyslots = append(info.Keyslots, ks)
+	}
+
+	return info
+}
+
+// LookupMapper returns the live state of the device-mapper volume `name`.
+func (s System) LookupMapper(name string) (MapperStatus, error) {
+	st, err := lookupMapper(s.hostPath(devMapperPath), s.hostPath(sysBlockPath), name)
+	if st.Path != "" {
+		st.Path = filepath.Join(devMapperPath, name)
+	}
+	return st, err
+}
+
+func lookupMapper(devMapper string, sysBlock string, name string) (MapperStatus, error) {
+	var st MapperStatus
+	if name == "" {
+		return st, errors.New("empty volume name")
+	}
+
+	mapperPath := filepath.Join(devMapper, name)
+	if _, err := os.Stat(mapperPath); err == nil {
+		st.Path = mapperPath
+	}
+
+	fis, err := ioutil.ReadDir(sysBlock)
+	if err != nil {
+		return st, errors.Wrapf(err, "failed to list %s", sysBlock)
+	}
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), "dm-") {
+			continue
+		}
+		dmDir := filepath.Join(sysBlock, fi.Name(), "dm")
+		if readSysfs(filepath.Join(dmDir, "name")) != name {
+			continue
+		}
+		st.Active = true
+		st.DmName = fi.Name()
+		st.UUID = readSysfs(filepath.Join(dmDir, "uuid"))
+		st.Suspended = readSysfs(filepath.Join(dmDir, "suspended")) == "1"
+		break
+	}
+
+	return st, nil
+}
+
+// readSysfs returns the trimmed content of a sysfs attribute, or an empty
+// string if it cannot be read.
+func readSysfs(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
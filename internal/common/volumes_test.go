@@ -0,0 +1,139 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+func TestListVolumes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "common_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	devConfigDir := filepath.Join(tmpDir, config.DevConfigSubdir)
+	confDir := DeviceConfigDir(devConfigDir, "/dev/non-existing")
+	luks := config.CryptsetupLUKS1V1{
+		Name:   "luks_vol",
+		Device: "/dev/non-existing",
+	}
+	if err := WriteVolume(confDir, config.VolumeJSON{Kind: config.VolumeCryptsetupLUKS1V1, Value: luks}); err != nil {
+		t.Fatal(err)
+	}
+	pj := config.ProviderJSON{
+		Kind:  config.ProviderContentV1,
+		Value: config.ContentV1{Source: "https://localhost/key.txt"},
+	}
+	if err := WriteKeyslot(confDir, 0, pj); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(KeyslotPath(confDir, 1), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	brokenDir := DeviceConfigDir(devConfigDir, "/dev/broken")
+	if err := os.MkdirAll(brokenDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	vols, err := System{Roots: Roots{tmpDir}}.ListVolumes()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if len(vols) != 2 {
+		t.Fatalf("expected 2 volumes, got %d", len(vols))
+	}
+
+	broken, vol := vols[0], vols[1]
+	if broken.Device != "/dev/broken" || broken.Error == "" {
+		t.Fatalf("expected broken entry for /dev/broken, got %+v", broken)
+	}
+	if vol.Device != "/dev/non-existing" || vol.Name != "luks_vol" || vol.Kind != "CryptsetupLUKS1V1" {
+		t.Fatalf("unexpected volume entry %+v", vol)
+	}
+	if len(vol.Keyslots) != 2 {
+		t.Fatalf("expected 2 keyslots, got %+v", vol.Keyslots)
+	}
+	if vol.Keyslots[0].Provider != "ContentV1" || vol.Keyslots[0].Error != "" {
+		t.Fatalf("unexpected keyslot entry %+v", vol.Keyslots[0])
+	}
+	if vol.Keyslots[1].Error == "" {
+		t.Fatalf("expected broken keyslot entry, got %+v", vol.Keyslots[1])
+	}
+}
+
+func TestLookupMapper(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "common_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	devMapper := filepath.Join(tmpDir, "dev", "mapper")
+	sysBlock := filepath.Join(tmpDir, "sys", "block")
+
+	attrs := map[string]string{
+		"sys/block/dm-0/dm/name":      "other\n",
+		"sys/block/dm-1/dm/name":      "luks_vol\n",
+		"sys/block/dm-1/dm/uuid":      "CRYPT-LUKS1-0123-luks_vol\n",
+		"sys/block/dm-1/dm/suspended": "0\n",
+		"sys/block/loop0/size":        "0\n",
+		"dev/mapper/luks_vol":         "",
+	}
+	for p, v := range attrs {
+		path := filepath.Join(tmpDir, p)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st, err := lookupMapper(devMapper, sysBlock, "luks_vol")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	exp := MapperStatus{
+		Active: true,
+		Path:   filepath.Join(devMapper, "luks_vol"),
+		DmName: "dm-1",
+		UUID:   "CRYPT-LUKS1-0123-luks_vol",
+	}
+	if st != exp {
+		t.Fatalf("expected status %+v, got %+v", exp, st)
+	}
+
+	st, err = lookupMapper(devMapper, sysBlock, "missing")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if st.Active {
+		t.Fatalf("expected inactive volume, got %+v", st)
+	}
+
+	st, err = System{Root: tmpDir}.LookupMapper("luks_vol")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !st.Active || st.Path != "/dev/mapper/luks_vol" {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package crypttab converts between crypttab(5) entries and cryptagent
+// volume configurations.
+package crypttab
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// diskDir is where udev links devices by tag.
+const diskDir = "/dev/disk/"
+
+// deviceTags maps crypttab device tags to their udev directories.
+var deviceTags = []struct {
+	tag string
+	dir string
+}{
+	{"UUID=", "by-uuid"},
+	{"PARTUUID=", "by-partuuid"},
+	{"LABEL=", "by-label"},
+	{"PARTLABEL=", "by-partlabel"},
+}
+
+// Entry is a single crypttab line.
+type Entry struct {
+	Name   string
+	Device string
+	// KeyFile is empty if the passphrase has to be asked for.
+	KeyFile string
+	Options []string
+}
+
+// String formats the entry as a crypttab line.
+func (e Entry) String() string {
+	keyFile, opts := e.KeyFile, strings.Join(e.Options, ",")
+	if keyFile == "" {
+		keyFile = "none"
+	}
+	if opts == "" {
+		return fmt.Sprintf("%s %s %s", e.Name, e.Device, keyFile)
+	}
+	return fmt.Sprintf("%s %s %s %s", e.Name, e.Device, keyFile, opts)
+}
+
+// Parse reads all entries of a crypttab file, skipping comments.
+func Parse(r io.Reader) ([]Entry, error) {
+	entries := []Entry{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, errors.Errorf("line %d: expected 2 to 4 fields, got %d", n, len(fields))
+		}
+		e := Entry{Name: fields[0], Device: fields[1]}
+		if len(fields) > 2 && fields[2] != "none" && fields[2] != "-" {
+			e.KeyFile = fields[2]
+		}
+		if len(fields) > 3 {
+			e.Options = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Volume is the cryptagent configuration for a crypttab entry.
+type Volume struct {
+	Config   config.VolumeJSON
+	Keyslots map[int]config.ProviderJSON
+	// Unsupported lists the ignored parts of the entry.
+	Unsupported []string
+}
+
+// Device returns the device path of the volume.
+func (v Volume) Device() string {
+	return v.Config.Value.(config.CryptsetupLUKS1V1).Device
+}
+
+// keyFileOptions records the crypttab options related to key files.
+type keyFileOptions struct {
+	slot    int
+	tries   int
+	offset  int64
+	size    int64
+	timeout int
+	// set lists the key file options found, for reporting.
+	set []string
+}
+
+// Import converts a crypttab entry into a cryptagent configuration.
+//
+// Options without a cryptagent equivalent are reported in `Unsupported`,
+// while entries for other volume types than LUKS fail.
+func Import(e Entry) (Volume, error) {
+	vol := Volume{Keyslots: map[int]config.ProviderJSON{}, Unsupported: []string{}}
+	device, err := devicePath(e.Device)
+	if err != nil {
+		return vol, err
+	}
+
+	discard := false
+	opts := keyFileOptions{}
+	for _, opt := range e.Options {
+		kv := strings.SplitN(opt, "=", 2)
+		var err error
+		switch kv[0] {
+		case "luks", "":
+		case "plain", "tcrypt", "tcrypt-hidden", "tcrypt-system", "tcrypt-veracrypt", "bitlk", "loop-aes":
+			return vol, errors.Errorf("volume %s: unsupported volume type %q", e.Name, kv[0])
+		case "discard":
+			discard = true
+		case "tries":
+			opts.tries, err = optionInt(kv)
+			if err == nil && opts.tries == 0 {
+				vol.Unsupported = append(vol.Unsupported, "tries=0 (unlimited)")
+			}
+		case "key-slot", "keyslot":
+			opts.slot, err = optionInt(kv)
+		case "keyfile-offset":
+			opts.offset, err = optionInt64(kv)
+		case "keyfile-size":
+			opts.size, err = optionInt64(kv)
+		case "keyfile-timeout":
+			opts.timeout, err = optionSeconds(kv)
+		default:
+			vol.Unsupported = append(vol.Unsupported, opt)
+			continue
+		}
+		if err != nil {
+			return vol, errors.Wrapf(err, "volume %s: invalid option %q", e.Name, opt)
+		}
+		if strings.HasPrefix(kv[0], "keyfile-") || kv[0] == "tries" {
+			opts.set = append(opts.set, kv[0])
+		}
+	}
+
+	pj, unsupported, err := keyProvider(e.KeyFile, opts)
+	if err != nil {
+		return vol, errors.Wrapf(err, "volume %s", e.Name)
+	}
+	vol.Unsupported = append(vol.Unsupported, unsupported...)
+	vol.Keyslots[opts.slot] = pj
+
+	disable := !discard
+	vol.Config = config.VolumeJSON{
+		Kind: config.VolumeCryptsetupLUKS1V1,
+		Value: config.CryptsetupLUKS1V1{
+			Name:           e.Name,
+			Device:         device,
+			DisableDiscard: &disable,
+		},
+	}
+	return vol, nil
+}
+
+// keyProvider returns the provider for a crypttab key file, and the key file
+// options it cannot represent.
+func keyProvider(keyFile string, opts keyFileOptions) (config.ProviderJSON, []string, error) {
+	unsupported := func(allowed ...string) []string {
+		out := []string{}
+		for _, o := range opts.set {
+			ok := false
+			for _, a := range allowed {
+				ok = ok || o == a
+			}
+			if !ok {
+				out = append(out, o)
+			}
+		}
+		return out
+	}
+
+	var pj config.ProviderJSON
+	path, device := keyFile, ""
+	if i := strings.LastIndex(keyFile, ":"); i > 0 {
+		path, device = keyFile[:i], keyFile[i+1:]
+	}
+	switch {
+	case keyFile == "":
+		cfg := config.InteractiveV1{Tries: opts.tries}
+		pj = config.ProviderJSON{Kind: config.ProviderInteractiveV1, Value: cfg}
+		return pj, unsupported("tries"), cfg.Validate()
+	case device != "" || strings.HasPrefix(keyFile, "/dev/"):
+		if device == "" {
+			path, device = "", keyFile
+		}
+		cfg := config.KeyFileV1{
+			Device:  device,
+			Path:    path,
+			Offset:  opts.offset,
+			Size:    opts.size,
+			Timeout: opts.timeout,
+		}
+		pj = config.ProviderJSON{Kind: config.ProviderKeyFileV1, Value: cfg}
+		return pj, unsupported("keyfile-offset", "keyfile-size", "keyfile-timeout"), cfg.Validate()
+	case filepath.IsAbs(keyFile):
+		cfg := config.ContentV1{
+			Source: "file://" + keyFile,
+			File:   &config.ContentV1File{Root: "/"},
+		}
+		pj = config.ProviderJSON{Kind: config.ProviderContentV1, Value: cfg}
+		return pj, unsupported(), cfg.Validate()
+	default:
+		return pj, nil, errors.Errorf("key file %q is not absolute", keyFile)
+	}
+}
+
+// devicePath translates a crypttab device into a path under /dev.
+func devicePath(device string) (string, error) {
+	if filepath.IsAbs(device) {
+		return device, nil
+	}
+	for _, dt := range deviceTags {
+		if strings.HasPrefix(device, dt.tag) && len(device) > len(dt.tag) {
+			value := strings.NewReplacer("/", `\x2f`, " ", `\x20`).Replace(device[len(dt.tag):])
+			return diskDir + dt.dir + "/" + value, nil
+		}
+	}
+	return "", errors.Errorf("unsupported device %q", device)
+}
+
+// crypttabDevice translates a device path into a crypttab tag, if possible.
+func crypttabDevice(path string) string {
+	for _, dt := range deviceTags {
+		prefix := diskDir + dt.dir + "/"
+		if strings.HasPrefix(path, prefix) {
+			value := strings.NewReplacer(`\x2f`, "/", `\x20`, " ").Replace(path[len(prefix):])
+			if !strings.ContainsAny(value, " \t") {
+				return dt.tag + value
+			}
+		}
+	}
+	return path
+}
+
+// Export converts the volume configured in `confDir` into a crypttab entry.
+//
+// Only one keyslot can be represented in crypttab: the first one with a
+// key file or passphrase equivalent is used, and the others are reported
+// in the returned notes.
+func Export(confDir string) (Entry, []string, error) {
+	var e Entry
+	notes := []string{}
+	vj, err := common.ReadVolume(confDir)
+	if err != nil {
+		return e, nil, err
+	}
+	luks1, ok := vj.Value.(config.CryptsetupLUKS1V1)
+	if !ok {
+		return e, nil, errors.Errorf("unsupported volume kind %s", vj.Kind)
+	}
+	e.Name = luks1.Name
+	e.Device = crypttabDevice(luks1.Device)
+	e.Options = append([]string{"luks"}, common.CryptsetupOptions(luks1)...)
+
+	slots, err := common.Keyslots(confDir)
+	if err != nil {
+		return e, nil, err
+	}
+	found := false
+	for _, n := range slots {
+		pj, err := common.ReadKeyslot(confDir, n)
+		if err != nil {
+			return e, nil, err
+		}
+		keyFile, opts, ok := crypttabKey(pj)
+		if !ok {
+			notes = append(notes, fmt.Sprintf("keyslot %d: %s cannot be represented in crypttab", n, pj.Kind))
+			continue
+		}
+		if found {
+			notes = append(notes, fmt.Sprintf("keyslot %d: only one key per crypttab entry", n))
+			continue
+		}
+		found = true
+		e.KeyFile = keyFile
+		e.Options = append(e.Options, opts...)
+		e.Options = append(e.Options, "key-slot="+strconv.Itoa(n))
+	}
+	return e, notes, nil
+}
+
+// crypttabKey returns the crypttab key file and options for a provider.
+func crypttabKey(pj config.ProviderJSON) (string, []string, bool) {
+	opts := []string{}
+	switch v := pj.Value.(type) {
+	case config.InteractiveV1:
+		if v.Tries > 0 {
+			opts = append(opts, "tries="+strconv.Itoa(v.Tries))
+		}
+		return "", opts, true
+	case config.KeyFileV1:
+		keyFile := v.Device
+		if v.Path != "" {
+			keyFile = v.Path + ":" + v.Device
+		}
+		if v.Offset > 0 {
+			opts = append(opts, "keyfile-offset="+strconv.FormatInt(v.Offset, 10))
+		}
+		if v.Size > 0 {
+			opts = append(opts, "keyfile-size="+strconv.FormatInt(v.Size, 10))
+		}
+		if v.Timeout > 0 {
+			opts = append(opts, "keyfile-timeout="+strconv.Itoa(v.Timeout)+"s")
+		}
+		return keyFile, opts, true
+	case config.ContentV1:
+		if !strings.HasPrefix(v.Source, "file://") || v.Verification != nil || v.Envelope != nil {
+			return "", nil, false
+		}
+		return filepath.Clean(strings.TrimPrefix(v.Source, "file://")), opts, true
+	default:
+		return "", nil, false
+	}
+}
+
+func optionInt(kv []string) (int, error) {
+	if len(kv) != 2 {
+		return 0, errors.New("missing value")
+	}
+	n, err := strconv.Atoi(kv[1])
+	if err == nil && n < 0 {
+		return 0, errors.New("negative value")
+	}
+	return n, err
+}
+
+func optionInt64(kv []string) (int64, error) {
+	if len(kv) != 2 {
+		return 0, errors.New("missing value")
+	}
+	n, err := strconv.ParseInt(kv[1], 10, 64)
+	if err == nil && n < 0 {
+		return 0, errors.New("negative value")
+	}
+	return n, err
+}
+
+// optionSeconds parses a timespan such as "30", "30s" or "2min", rounded up
+// to whole seconds.
+func optionSeconds(kv []string) (int, error) {
+	if len(kv) != 2 {
+		return 0, errors.New("missing value")
+	}
+	value := strings.Replace(kv[1], "min", "m", 1)
+	if _, err := strconv.Atoi(value); err == nil {
+		value += "s"
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, errors.Errorf("invalid timespan %q", kv[1])
+	}
+	return int((d + time.Second - 1) / time.Second), nil
+}
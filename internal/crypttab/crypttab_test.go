@@ -0,0 +1,206 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypttab
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+func TestParse(t *testing.T) {
+	in := `# <name> <device> <key file> <options>
+luks_root UUID=3f6d2a1c-4b5e-4f7a-9c8d-1e2f3a4b5c6d none luks,discard,tries=5
+
+data /dev/sdb1 /etc/keys/data.key
+swap	PARTUUID=0a1b2c3d-01	/dev/urandom	plain,swap
+`
+	entries, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	exp := []Entry{
+		{"luks_root", "UUID=3f6d2a1c-4b5e-4f7a-9c8d-1e2f3a4b5c6d", "", []string{"luks", "discard", "tries=5"}},
+		{"data", "/dev/sdb1", "/etc/keys/data.key", nil},
+		{"swap", "PARTUUID=0a1b2c3d-01", "/dev/urandom", []string{"plain", "swap"}},
+	}
+	if !reflect.DeepEqual(entries, exp) {
+		t.Fatalf("expected %+v, got %+v", exp, entries)
+	}
+
+	if _, err := Parse(strings.NewReader("lonely\n")); err == nil {
+		t.Fatalf("expected error for a single field")
+	}
+}
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		line        string
+		device      string
+		slot        int
+		provider    config.ProviderJSON
+		unsupported []string
+		expErr      bool
+	}{
+		{
+			"root UUID=1234 none luks,discard,tries=5,key-slot=2",
+			"/dev/disk/by-uuid/1234",
+			2,
+			config.ProviderJSON{Kind: config.ProviderInteractiveV1, Value: config.InteractiveV1{Tries: 5}},
+			[]string{},
+			false,
+		},
+		{
+			"data /dev/sdb1 /etc/keys/data.key luks,nofail,x-systemd.device-timeout=10",
+			"/dev/sdb1",
+			0,
+			config.ProviderJSON{Kind: config.ProviderContentV1, Value: config.ContentV1{
+				Source: "file:///etc/keys/data.key",
+				File:   &config.ContentV1File{Root: "/"},
+			}},
+			[]string{"nofail", "x-systemd.device-timeout=10"},
+			false,
+		},
+		{
+			"usb PARTLABEL=data /luks/usb.key:LABEL=KEYS keyfile-offset=512,keyfile-size=64,keyfile-timeout=1min,tries=2",
+			"/dev/disk/by-partlabel/data",
+			0,
+			config.ProviderJSON{Kind: config.ProviderKeyFileV1, Value: config.KeyFileV1{
+				Device:  "LABEL=KEYS",
+				Path:    "/luks/usb.key",
+				Offset:  512,
+				Size:    64,
+				Timeout: 60,
+			}},
+			[]string{"tries"},
+			false,
+		},
+		{
+			"raw /dev/sdc /dev/disk/by-id/usb-stick keyfile-size=32",
+			"/dev/sdc",
+			0,
+			config.ProviderJSON{Kind: config.ProviderKeyFileV1, Value: config.KeyFileV1{
+				Device: "/dev/disk/by-id/usb-stick",
+				Size:   32,
+			}},
+			[]string{},
+			false,
+		},
+		{"offset /dev/sdb1 /etc/keys/data.key keyfile-offset=8", "/dev/sdb1", 0, config.ProviderJSON{}, nil, false},
+		{"swap /dev/sda3 /dev/urandom plain,swap", "", 0, config.ProviderJSON{}, nil, true},
+		{"rel /dev/sda3 keys/rel.key", "", 0, config.ProviderJSON{}, nil, true},
+		{"tries /dev/sda3 none tries=many", "", 0, config.ProviderJSON{}, nil, true},
+		{"tag ID=1234 none", "", 0, config.ProviderJSON{}, nil, true},
+	}
+
+	for _, tt := range tests {
+		entries, err := Parse(strings.NewReader(tt.line))
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		vol, err := Import(entries[0])
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for %q", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q for %q", err, tt.line)
+		}
+		if vol.Device() != tt.device {
+			t.Fatalf("expected device %q, got %q", tt.device, vol.Device())
+		}
+		if tt.provider.Kind == config.ProviderInvalid {
+			// Only check that unrepresentable options are reported.
+			if len(vol.Unsupported) == 0 {
+				t.Fatalf("expected unsupported options for %q", tt.line)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(vol.Keyslots, map[int]config.ProviderJSON{tt.slot: tt.provider}) {
+			t.Fatalf("expected keyslot %d %+v, got %+v", tt.slot, tt.provider, vol.Keyslots)
+		}
+		if !reflect.DeepEqual(vol.Unsupported, tt.unsupported) {
+			t.Fatalf("expected unsupported %v, got %v", tt.unsupported, vol.Unsupported)
+		}
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "crypttab_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	lines := []string{
+		"root UUID=1234 none luks,discard,tries=5,key-slot=2",
+		"usb PARTLABEL=data /luks/usb.key:LABEL=KEYS luks,keyfile-offset=512,keyfile-size=64,keyfile-timeout=60s,key-slot=0",
+		"data /dev/sdb1 /etc/keys/data.key luks,key-slot=1",
+	}
+	entries, err := Parse(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	for i, e := range entries {
+		vol, err := Import(e)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		confDir := common.DeviceConfigDir(tmpDir, vol.Device())
+		if err := common.WriteVolume(confDir, vol.Config); err != nil {
+			t.Fatal(err)
+		}
+		for n, pj := range vol.Keyslots {
+			if err := common.WriteKeyslot(confDir, n, pj); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		out, notes, err := Export(confDir)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if out.String() != lines[i] {
+			t.Fatalf("expected %q, got %q", lines[i], out)
+		}
+		if len(notes) != 0 {
+			t.Fatalf("unexpected notes %v", notes)
+		}
+	}
+
+	// Add a keyslot without crypttab equivalent.
+	confDir := common.DeviceConfigDir(tmpDir, "/dev/sdb1")
+	aws := config.ProviderJSON{Kind: config.ProviderAwsKmsV1, Value: config.AwsKmsV1{Region: "us-east-1", Ciphertext: "AQID"}}
+	if err := common.WriteKeyslot(confDir, 0, aws); err != nil {
+		t.Fatal(err)
+	}
+	out, notes, err := Export(confDir)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if out.String() != lines[2] {
+		t.Fatalf("expected %q, got %q", lines[2], out)
+	}
+	if len(notes) != 1 || !strings.Contains(notes[0], "AwsKmsV1") {
+		t.Fatalf("expected a note for AwsKmsV1, got %v", notes)
+	}
+}
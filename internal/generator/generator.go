@@ -0,0 +1,202 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package generator implements a systemd generator, producing cryptsetup
+// units for all configured volumes.
+//
+// See https://www.freedesktop.org/software/systemd/man/systemd.generator.html
+package generator
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/coreos/go-systemd/unit"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// cryptsetupBin is the systemd helper attaching volumes.
+	cryptsetupBin = "/lib/systemd/systemd-cryptsetup"
+	// cryptsetupTarget pulls in all generated units.
+	cryptsetupTarget = "cryptsetup.target"
+	// networkTarget is required by volumes with remote providers.
+	networkTarget = "network-online.target"
+)
+
+// Generate writes a `systemd-cryptsetup@.service` unit into `outDir` for
+// each volume configured in `sys`.
+//
+// Broken volume configurations are logged and skipped, as generators must
+// not prevent booting.
+func Generate(sys common.System, outDir string) error {
+	warnMissingRoots(sys.Roots)
+	vols, err := sys.ListVolumes()
+	if err != nil {
+		return err
+	}
+	for _, vol := range vols {
+		if vol.Error != "" {
+			logrus.Warnf("skipping volume %s: %s", vol.Device, vol.Error)
+			continue
+		}
+		name, opts, err := VolumeUnit(vol)
+		if err != nil {
+			logrus.Warnf("skipping volume %s: %s", vol.Device, err)
+			continue
+		}
+		if err := writeUnit(outDir, name, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warnMissingRoots warns about missing roots, except the vendor and runtime
+// ones which are optional. Generators run before local filesystems are
+// mounted, thus the base root under `/boot` is usually not available: its
+// volumes only get units if their configuration is also in `/run` or `/usr`.
+func warnMissingRoots(roots common.Roots) {
+	for _, root := range roots {
+		clean := filepath.Clean(root)
+		if clean == filepath.Clean(config.VendorConfigDir) || clean == filepath.Clean(config.RuntimeConfigDir) {
+			continue
+		}
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			logrus.Warnf("configuration root %s is missing (not mounted yet?), volumes configured there get no unit", root)
+		}
+	}
+}
+
+// VolumeUnit returns the name and the content of the cryptsetup unit for a
+// volume.
+func VolumeUnit(vol common.VolumeInfo) (string, []*unit.UnitOption, error) {
+	if vol.Name == "" {
+		return "", nil, errors.New("empty volume name")
+	}
+	if strings.ContainsAny(vol.Name, "'\n") || strings.ContainsAny(vol.Device, "'\n") {
+		return "", nil, errors.New("unsupported characters in volume name or device")
+	}
+	vj, err := common.ReadVolume(vol.ConfigDir)
+	if err != nil {
+		return "", nil, err
+	}
+	luks1, ok := vj.Value.(config.CryptsetupLUKS1V1)
+	if !ok {
+		return "", nil, errors.Errorf("unsupported volume kind %s", vj.Kind)
+	}
+	remote := false
+	for _, ks := range vol.Keyslots {
+		pj, err := common.ReadKeyslot(vol.ConfigDir, ks.Slot)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "keyslot %d", ks.Slot)
+		}
+		remote = remote || needsNetwork(pj)
+	}
+
+	// The key is provided by the cryptagent password agent.
+	attach := cryptsetupBin + " attach " + quote(vol.Name) + " " + quote(vol.Device) + " '-'"
+	if copts := common.CryptsetupOptions(luks1); len(copts) > 0 {
+		attach += " " + quote(strings.Join(copts, ","))
+	}
+
+	name := "systemd-cryptsetup@" + unit.UnitNameEscape(vol.Name) + ".service"
+	device := unit.UnitNamePathEscape(vol.Device) + ".device"
+	opts := []*unit.UnitOption{
+		unit.NewUnitOption("Unit", "Description", "Cryptography Setup for %I"),
+		unit.NewUnitOption("Unit", "Documentation", "man:systemd-cryptsetup@.service(8)"),
+		unit.NewUnitOption("Unit", "SourcePath", escapeSpecifiers(vol.ConfigDir)),
+		unit.NewUnitOption("Unit", "DefaultDependencies", "no"),
+		unit.NewUnitOption("Unit", "Conflicts", "umount.target"),
+		unit.NewUnitOption("Unit", "IgnoreOnIsolate", "true"),
+		// As systemd-cryptsetup-generator does, the volume is stopped
+		// if its device goes away.
+		unit.NewUnitOption("Unit", "BindsTo", device),
+		unit.NewUnitOption("Unit", "After", device),
+		unit.NewUnitOption("Unit", "After", "cryptsetup-pre.target"),
+	}
+	if remote {
+		opts = append(opts,
+			unit.NewUnitOption("Unit", "Wants", networkTarget),
+			unit.NewUnitOption("Unit", "After", networkTarget),
+		)
+	}
+	opts = append(opts,
+		unit.NewUnitOption("Unit", "Before", cryptsetupTarget),
+		unit.NewUnitOption("Unit", "Before", "umount.target"),
+		unit.NewUnitOption("Service", "Type", "oneshot"),
+		unit.NewUnitOption("Service", "RemainAfterExit", "yes"),
+		unit.NewUnitOption("Service", "TimeoutSec", "0"),
+		unit.NewUnitOption("Service", "ExecStart", attach),
+		unit.NewUnitOption("Service", "ExecStop", cryptsetupBin+" detach "+quote(vol.Name)),
+	)
+	return name, opts, nil
+}
+
+// needsNetwork returns whether a provider (or any nested provider) fetches
+// keys over the network.
+func needsNetwork(pj config.ProviderJSON) bool {
+	switch v := pj.Value.(type) {
+	case config.ContentV1:
+		u, err := url.Parse(v.Source)
+		if err != nil || (u.Scheme != "data" && u.Scheme != "file") {
+			return true
+		}
+		return v.Envelope != nil && v.Envelope.Key != nil && needsNetwork(*v.Envelope.Key)
+	case config.AzureVaultV1, config.AwsKmsV1, config.GcpKmsV1, config.EtcdV1:
+		return true
+	case config.Pkcs11V1:
+		return v.Pin != nil && needsNetwork(*v.Pin)
+	default:
+		return false
+	}
+}
+
+// quote returns a single-quoted command line argument.
+func quote(s string) string {
+	return "'" + strings.Replace(escapeSpecifiers(s), `\`, `\\`, -1) + "'"
+}
+
+// escapeSpecifiers escapes `%` to prevent specifier expansion.
+func escapeSpecifiers(s string) string {
+	return strings.Replace(s, "%", "%%", -1)
+}
+
+// writeUnit writes unit `name` into `outDir`, and adds it to the
+// requirements of the cryptsetup target.
+func writeUnit(outDir string, name string, opts []*unit.UnitOption) error {
+	content, err := ioutil.ReadAll(unit.Serialize(opts))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, name), content, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write unit %s", name)
+	}
+
+	requires := filepath.Join(outDir, cryptsetupTarget+".requires")
+	if err := os.MkdirAll(requires, 0755); err != nil {
+		return err
+	}
+	link := filepath.Join(requires, name)
+	if err := os.Symlink(filepath.Join("..", name), link); err != nil && !os.IsExist(err) {
+		return errors.Wrapf(err, "failed to link unit %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+func TestGenerateGolden(t *testing.T) {
+	outDir, err := ioutil.TempDir("", "generator_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outDir)
+
+	if err := Generate(common.System{Roots: common.Roots{filepath.Join("testdata", "root")}}, outDir); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	goldens, err := ioutil.ReadDir(filepath.Join("testdata", "golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := filepath.Glob(filepath.Join(outDir, "*.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) != len(goldens) {
+		t.Fatalf("expected %d units, got %v", len(goldens), generated)
+	}
+	for _, fi := range goldens {
+		exp, err := ioutil.ReadFile(filepath.Join("testdata", "golden", fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadFile(filepath.Join(outDir, fi.Name()))
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if string(out) != string(exp) {
+			t.Fatalf("unit %s mismatch, expected:\n%s\ngot:\n%s", fi.Name(), exp, out)
+		}
+		link, err := os.Readlink(filepath.Join(outDir, cryptsetupTarget+".requires", fi.Name()))
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if link != filepath.Join("..", fi.Name()) {
+			t.Fatalf("unexpected link target %q for %s", link, fi.Name())
+		}
+	}
+}
+
+func TestNeedsNetwork(t *testing.T) {
+	local := &config.ProviderJSON{Kind: config.ProviderContentV1, Value: config.ContentV1{Source: "data:,1234"}}
+	remote := &config.ProviderJSON{Kind: config.ProviderContentV1, Value: config.ContentV1{Source: "https://keys.example.com/pin"}}
+
+	tests := []struct {
+		pj  config.ProviderJSON
+		exp bool
+	}{
+		{*local, false},
+		{*remote, true},
+		{config.ProviderJSON{Kind: config.ProviderContentV1, Value: config.ContentV1{Source: "tftp://10.0.0.1/key"}}, true},
+		{config.ProviderJSON{Kind: config.ProviderContentV1, Value: config.ContentV1{
+			Source:   "file:///boot/etc/keys/sealed",
+			Envelope: &config.ContentV1Envelope{Kind: config.EnvelopeAESGCM, Key: remote},
+		}}, true},
+		{config.ProviderJSON{Kind: config.ProviderEtcdV1, Value: config.EtcdV1{}}, true},
+		{config.ProviderJSON{Kind: config.ProviderPkcs11V1, Value: config.Pkcs11V1{Pin: local}}, false},
+		{config.ProviderJSON{Kind: config.ProviderPkcs11V1, Value: config.Pkcs11V1{Pin: remote}}, true},
+		{config.ProviderJSON{Kind: config.ProviderKeyFileV1, Value: config.KeyFileV1{}}, false},
+		{config.ProviderJSON{Kind: config.ProviderInteractiveV1, Value: config.InteractiveV1{}}, false},
+	}
+	for i, tt := range tests {
+		if out := needsNetwork(tt.pj); out != tt.exp {
+			t.Fatalf("expected %v for case %d, got %v", tt.exp, i, out)
+		}
+	}
+}
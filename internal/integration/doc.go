@@ -0,0 +1,30 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package integration holds the end-to-end test suite.
+//
+// Tests unlock real loop-backed LUKS volumes through the `coreos-cryptagent`
+// binary and systemd-cryptsetup, against local stand-ins for key servers.
+// They are opt-in, as they need root privileges, the `loop` module and
+// the cryptsetup tools:
+//
+//	go test -tags integration -v ./internal/integration/
+//
+// Tests are skipped if any requirement is missing.
+//
+// Stand-ins cover the network key sources of the providers which exist:
+// an HTTPS server for ContentV1, and Azure IMDS and Key Vault for
+// AzureVaultV1. There are no Vault or Tang providers, thus no stand-ins
+// for them.
+package integration
@@ -0,0 +1,233 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/agent"
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/internal/luks"
+	"github.com/coreos/coreos-cryptagent/internal/unlock"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	// imageSize is large enough for a LUKS2 header and some payload.
+	imageSize = 32 << 20
+	// attachTimeout bounds a whole attach, including key retrieval.
+	attachTimeout = 2 * time.Minute
+)
+
+// cryptagentBin is the binary under test, built by TestMain.
+var cryptagentBin string
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	tmpDir, err := ioutil.TempDir("", "integration_")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cryptagentBin = filepath.Join(tmpDir, "coreos-cryptagent")
+	out, err := exec.Command("go", "build", "-o", cryptagentBin, "github.com/coreos/coreos-cryptagent").CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to build coreos-cryptagent: %s\n%s", err, out)
+		return 1
+	}
+	return m.Run()
+}
+
+// requireHost skips the test if the host cannot run it.
+func requireHost(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests require root privileges")
+	}
+	for _, tool := range []string{"cryptsetup", "losetup", unlock.SystemdCryptsetup} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("missing %s: %s", tool, err)
+		}
+	}
+	// The module may be built-in, thus only the control device matters.
+	exec.Command("modprobe", "loop").Run()
+	if _, err := os.Stat("/dev/loop-control"); err != nil {
+		t.Skipf("loop devices unavailable: %s", err)
+	}
+}
+
+// cleanup runs teardown steps in reverse order. It is meant to be deferred
+// right away, so that steps run on test failures too.
+type cleanup struct {
+	t     *testing.T
+	steps []func() error
+}
+
+func (c *cleanup) add(step func() error) {
+	c.steps = append(c.steps, step)
+}
+
+func (c *cleanup) run() {
+	for i := len(c.steps) - 1; i >= 0; i-- {
+		if err := c.steps[i](); err != nil {
+			c.t.Errorf("cleanup failed: %s", err)
+		}
+	}
+}
+
+// command runs a tool to completion, with its output in the error.
+func command(stdin []byte, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.Errorf("%s %s: %s: %s", name, strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return string(out), nil
+}
+
+// newVolume formats a loop-backed LUKS volume, with `key` enrolled into
+// keyslots 0 to `slots - 1`, and returns its loop device.
+func newVolume(t *testing.T, c *cleanup, luksType string, key []byte, slots int) string {
+	tmpDir, err := ioutil.TempDir("", "integration_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.add(func() error { return os.RemoveAll(tmpDir) })
+
+	img := filepath.Join(tmpDir, "disk.img")
+	fp, err := os.Create(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fp.Truncate(imageSize)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := command(nil, "losetup", "--find", "--show", img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := strings.TrimSpace(out)
+	c.add(func() error {
+		_, err := command(nil, "losetup", "--detach", device)
+		return err
+	})
+
+	if _, err := command(key, "cryptsetup", "luksFormat", "--batch-mode", "--type", luksType,
+		"--iter-time", "1", "--key-slot", "0", "--key-file", "-", device); err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n < slots; n++ {
+		if err := luks.AddKey(device, key, key, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return device
+}
+
+// writeConfig configures volume `name` on `device` under the configuration
+// root `root`, with one keyslot per provider.
+func writeConfig(t *testing.T, root string, device string, name string, disableDiscard *bool, keyslots []config.ProviderJSON) {
+	confDir := common.DeviceConfigDir(filepath.Join(root, config.DevConfigSubdir), device)
+	luks1 := config.CryptsetupLUKS1V1{Name: name, Device: device, DisableDiscard: disableDiscard}
+	if err := common.WriteVolume(confDir, config.VolumeJSON{Kind: config.VolumeCryptsetupLUKS1V1, Value: luks1}); err != nil {
+		t.Fatal(err)
+	}
+	for n, pj := range keyslots {
+		if err := common.WriteKeyslot(confDir, n, pj); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// startServer runs the password agent in the background, until cleanup.
+func startServer(t *testing.T, c *cleanup, root string) {
+	if err := os.MkdirAll(agent.AskPasswordDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	cmd := exec.Command(cryptagentBin, "server", "--config-root", root)
+	cmd.Stdout = &logs
+	cmd.Stderr = &logs
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.add(func() error {
+		cmd.Process.Signal(syscall.SIGTERM)
+		err := cmd.Wait()
+		if t.Failed() {
+			t.Logf("server logs:\n%s", logs.String())
+		}
+		return err
+	})
+}
+
+// attach activates `device` through the binary under test.
+func attach(t *testing.T, c *cleanup, root string, device string, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), attachTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, cryptagentBin, "attach", "--config-root", root, device).CombinedOutput()
+	c.add(func() error {
+		if st, _ := (common.System{}).LookupMapper(name); !st.Active {
+			return nil
+		}
+		_, err := command(nil, "cryptsetup", "close", name)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("attach failed: %s\n%s", err, out)
+	}
+}
+
+// mapperStatus returns the `key: value` fields of `cryptsetup status`.
+func mapperStatus(t *testing.T, name string) map[string]string {
+	out, err := command(nil, "cryptsetup", "status", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]string{}
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		parts := strings.SplitN(sc.Text(), ":", 2)
+		if len(parts) == 2 {
+			fields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return fields
+}
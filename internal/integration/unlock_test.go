@@ -0,0 +1,104 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+func TestUnlock(t *testing.T) {
+	requireHost(t)
+	key := []byte("integration-passphrase")
+	content, caPEM := newContentServer(t, key)
+	defer content.Close()
+	azure := newAzureStandIn(t, key)
+	defer azure.Close()
+
+	contentKeyslot := config.ProviderJSON{Kind: config.ProviderContentV1, Value: config.ContentV1{
+		Source: content.URL + "/key",
+		CertificateAuthorities: []config.ContentV1CertAuth{{
+			Authority: "data:;base64," + base64.StdEncoding.EncodeToString([]byte(caPEM)),
+		}},
+	}}
+	azureKeyslot := config.ProviderJSON{Kind: config.ProviderAzureVaultV1, Value: config.AzureVaultV1{
+		BaseURL:             azure.URL,
+		EncryptionAlgorithm: "RSA-OAEP",
+		KeyName:             "disk",
+		Ciphertext:          base64.RawURLEncoding.EncodeToString([]byte(standInCiphertext)),
+		ManagedIdentityAuth: &config.AzureVaultV1ManagedIdentityAuth{MetadataEndpoint: azure.URL},
+	}}
+	// Nothing listens on port 1, so that this keyslot fails right away.
+	unreachableKeyslot := config.ProviderJSON{Kind: config.ProviderContentV1, Value: config.ContentV1{
+		Source: "https://127.0.0.1:1/key",
+	}}
+
+	disable, enable := true, false
+
+	tests := []struct {
+		name           string
+		luksType       string
+		disableDiscard *bool
+		keyslots       []config.ProviderJSON
+		expDiscards    bool
+	}{
+		{"content_luks1", "luks1", nil, []config.ProviderJSON{contentKeyslot}, false},
+		{"content_luks2", "luks2", &enable, []config.ProviderJSON{contentKeyslot}, true},
+		{"azure_luks2", "luks2", &disable, []config.ProviderJSON{azureKeyslot}, false},
+		{"fallback_luks2", "luks2", nil, []config.ProviderJSON{unreachableKeyslot, contentKeyslot}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &cleanup{t: t}
+			defer c.run()
+
+			root, err := ioutil.TempDir("", "integration_")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.add(func() error { return os.RemoveAll(root) })
+
+			name := "cryptagent_" + tt.name
+			device := newVolume(t, c, tt.luksType, key, len(tt.keyslots))
+			writeConfig(t, root, device, name, tt.disableDiscard, tt.keyslots)
+			startServer(t, c, root)
+			attach(t, c, root, device, name)
+
+			st := mapperStatus(t, name)
+			if st["type"] != strings.ToUpper(tt.luksType) {
+				t.Fatalf("expected type %s, got %+v", strings.ToUpper(tt.luksType), st)
+			}
+			if st["device"] != device {
+				t.Fatalf("expected device %s, got %+v", device, st)
+			}
+			// cryptsetup only lists the flags of the mapping if any is set.
+			if discards := strings.Contains(st["flags"], "discards"); discards != tt.expDiscards {
+				t.Fatalf("expected discards %v, got %+v", tt.expDiscards, st)
+			}
+			if _, err := os.Stat("/dev/mapper/" + name); err != nil {
+				t.Fatalf("unexpected error %q", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging configures log output and its system sinks.
+//
+// Besides stderr, entries are sent to journald as native structured
+// entries, or to the kernel log if journald is not running yet, so that
+// failures in initramfs can be diagnosed after boot.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/go-systemd/journal"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Supported output formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Structured fields for unlock-related entries. They are recorded in the
+// journal as upper-case fields, e.g. `VOLUME=`.
+const (
+	FieldVolume   = "volume"
+	FieldDevice   = "device"
+	FieldProvider = "provider"
+	FieldKeyslot  = "keyslot"
+)
+
+const (
+	identifier = "coreos-cryptagent"
+	kmsgPath   = "/dev/kmsg"
+	// kmsgFacility is LOG_DAEMON, shifted as in syslog priorities.
+	kmsgFacility = 3 << 3
+	// kmsgMaxLen stays below the kernel limit for a single record.
+	kmsgMaxLen = 976
+)
+
+// Setup configures the standard logger to write `format` entries to stderr,
+// and hooks it to journald or, as a fallback, to `/dev/kmsg`.
+func Setup(format string) error {
+	formatter, err := Formatter(format)
+	if err != nil {
+		return err
+	}
+	logrus.SetFormatter(formatter)
+
+	if journal.Enabled() {
+		logrus.AddHook(journalHook{send: journal.Send})
+		// Avoid duplicate entries when stderr already goes to the journal.
+		if stderrIsJournal() {
+			logrus.SetOutput(ioutil.Discard)
+		}
+		return nil
+	}
+	// Only root can write to the kernel log, skip it otherwise.
+	if kmsg, err := os.OpenFile(kmsgPath, os.O_WRONLY, 0); err == nil {
+		logrus.AddHook(kmsgHook{w: kmsg, pid: os.Getpid()})
+	}
+	return nil
+}
+
+// Formatter returns the logrus formatter for `format`.
+func Formatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case FormatText:
+		return &logrus.TextFormatter{}, nil
+	case FormatJSON:
+		return &logrus.JSONFormatter{}, nil
+	default:
+		return nil, errors.Errorf("unsupported log format %q", format)
+	}
+}
+
+// stderrIsJournal checks whether stderr is connected to the journal, as
+// advertised by systemd in `$JOURNAL_STREAM`.
+func stderrIsJournal() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+	return stream == fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+}
+
+// priority maps a logrus level to a syslog priority.
+func priority(level logrus.Level) journal.Priority {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return journal.PriCrit
+	case logrus.ErrorLevel:
+		return journal.PriErr
+	case logrus.WarnLevel:
+		return journal.PriWarning
+	case logrus.InfoLevel:
+		return journal.PriInfo
+	default:
+		return journal.PriDebug
+	}
+}
+
+// journalField translates a logrus field name into a journal field name,
+// or returns an empty string if there is no valid translation.
+func journalField(name string) string {
+	field := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	return strings.TrimLeft(field, "_")
+}
+
+// journalHook sends entries to journald, with their fields.
+type journalHook struct {
+	send func(message string, priority journal.Priority, vars map[string]string) error
+}
+
+// Levels implements the logrus.Hook interface.
+func (h journalHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements the logrus.Hook interface.
+func (h journalHook) Fire(entry *logrus.Entry) error {
+	vars := map[string]string{"SYSLOG_IDENTIFIER": identifier}
+	for k, v := range entry.Data {
+		if field := journalField(k); field != "" {
+			vars[field] = fmt.Sprint(v)
+		}
+	}
+	return h.send(entry.Message, priority(entry.Level), vars)
+}
+
+// kmsgHook writes entries to the kernel log, one record per entry.
+type kmsgHook struct {
+	w   io.Writer
+	pid int
+}
+
+// Levels implements the logrus.Hook interface.
+func (h kmsgHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements the logrus.Hook interface.
+func (h kmsgHook) Fire(entry *logrus.Entry) error {
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	msg := entry.Message
+	for _, k := range keys {
+		msg += fmt.Sprintf(" %s=%v", k, entry.Data[k])
+	}
+	msg = strings.Replace(msg, "\n", " ", -1)
+	if len(msg) > kmsgMaxLen {
+		msg = msg[:kmsgMaxLen]
+	}
+
+	record := fmt.Sprintf("<%d>%s[%d]: %s\n", kmsgFacility|int(priority(entry.Level)), identifier, h.pid, msg)
+	_, err := io.WriteString(h.w, record)
+	return err
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-systemd/journal"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFormatter(t *testing.T) {
+	tests := []struct {
+		format string
+		expErr bool
+	}{
+		{FormatText, false},
+		{FormatJSON, false},
+		{"", true},
+		{"xml", true},
+	}
+
+	for _, tt := range tests {
+		_, err := Formatter(tt.format)
+		if tt.expErr != (err != nil) {
+			t.Fatalf("expected error %v for %q, got %v", tt.expErr, tt.format, err)
+		}
+	}
+}
+
+func TestJournalField(t *testing.T) {
+	tests := []struct {
+		name string
+		exp  string
+	}{
+		{FieldVolume, "VOLUME"},
+		{FieldKeyslot, "KEYSLOT"},
+		{"key-slot.id", "KEY_SLOT_ID"},
+		{"_private", "PRIVATE"},
+		{"__", ""},
+	}
+
+	for _, tt := range tests {
+		if out := journalField(tt.name); out != tt.exp {
+			t.Fatalf("expected %q for %q, got %q", tt.exp, tt.name, out)
+		}
+	}
+}
+
+func newTestEntry() *logrus.Entry {
+	entry := logrus.WithFields(logrus.Fields{
+		FieldVolume:     "luks_vol",
+		FieldDevice:     "/dev/sda2",
+		FieldKeyslot:    1,
+		logrus.ErrorKey: errors.New("no key\navailable"),
+	})
+	entry.Level = logrus.WarnLevel
+	entry.Message = "keyslot 1 failed"
+	return entry
+}
+
+func TestJournalHook(t *testing.T) {
+	var msg string
+	var pri journal.Priority
+	var vars map[string]string
+	hook := journalHook{send: func(m string, p journal.Priority, v map[string]string) error {
+		msg, pri, vars = m, p, v
+		return nil
+	}}
+
+	if err := hook.Fire(newTestEntry()); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if msg != "keyslot 1 failed" || pri != journal.PriWarning {
+		t.Fatalf("unexpected message %q with priority %d", msg, pri)
+	}
+	exp := map[string]string{
+		"SYSLOG_IDENTIFIER": "coreos-cryptagent",
+		"VOLUME":            "luks_vol",
+		"DEVICE":            "/dev/sda2",
+		"KEYSLOT":           "1",
+		"ERROR":             "no key\navailable",
+	}
+	for k, v := range exp {
+		if vars[k] != v {
+			t.Fatalf("expected %s=%q, got %q", k, v, vars[k])
+		}
+	}
+}
+
+func TestKmsgHook(t *testing.T) {
+	var buf bytes.Buffer
+	hook := kmsgHook{w: &buf, pid: 42}
+
+	if err := hook.Fire(newTestEntry()); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	exp := "<28>coreos-cryptagent[42]: keyslot 1 failed device=/dev/sda2 error=no key available keyslot=1 volume=luks_vol\n"
+	if buf.String() != exp {
+		t.Fatalf("expected record %q, got %q", exp, buf.String())
+	}
+
+	buf.Reset()
+	entry := newTestEntry()
+	entry.Message = strings.Repeat("x", 2*kmsgMaxLen)
+	if err := hook.Fire(entry); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if l := len(buf.String()); l > 1024 {
+		t.Fatalf("record too long for the kernel log: %d bytes", l)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package luks wraps cryptsetup operations on LUKS headers.
+//
+// Key material is never written to disk nor passed on the command line;
+// it is streamed to cryptsetup through inherited pipes instead.
+package luks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const cryptsetupBin = "/sbin/cryptsetup"
+
+// generatedKeyLen is the amount of random bytes in a generated key.
+const generatedKeyLen = 32
+
+var (
+	luks1SlotRe = regexp.MustCompile(`^Key Slot (\d+): ENABLED$`)
+	luks2SlotRe = regexp.MustCompile(`^\s+(\d+): \S+`)
+)
+
+// Runner runs cryptsetup commands, feeding each of `keys` through a
+// dedicated pipe (see keyFD). It returns the combined command output.
+type Runner interface {
+	Run(args []string, keys ...[]byte) ([]byte, error)
+}
+
+// Cryptsetup performs LUKS operations through a Runner.
+type Cryptsetup struct {
+	Runner Runner
+}
+
+// Default performs LUKS operations with the system cryptsetup binary.
+var Default = Cryptsetup{Runner: Exec{Path: cryptsetupBin}}
+
+// GenerateKey returns a new random key, suitable for a LUKS keyslot.
+//
+// The key is base64-encoded, so that it can be safely handled as a
+// passphrase by systemd password agents.
+func GenerateKey() ([]byte, error) {
+	raw := make([]byte, generatedKeyLen)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, errors.Wrap(err, "failed to generate random key")
+	}
+	key := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
+	base64.StdEncoding.Encode(key, raw)
+	return key, nil
+}
+
+// ActiveKeyslots returns the sorted list of enabled keyslots on a LUKS
+// device, with the default cryptsetup.
+func ActiveKeyslots(device string) ([]int, error) {
+	return Default.ActiveKeyslots(device)
+}
+
+// AddKey enrolls a key with the default cryptsetup, see Cryptsetup.AddKey.
+func AddKey(device string, key []byte, newKey []byte, slot int) error {
+	return Default.AddKey(device, key, newKey, slot)
+}
+
+// KillSlot wipes a keyslot with the default cryptsetup, see Cryptsetup.KillSlot.
+func KillSlot(device string, key []byte, slot int) error {
+	return Default.KillSlot(device, key, slot)
+}
+
+// TestKey checks a key with the default cryptsetup, see Cryptsetup.TestKey.
+func TestKey(device string, key []byte, slot int) error {
+	return Default.TestKey(device, key, slot)
+}
+
+// ActiveKeyslots returns the sorted list of enabled keyslots on a LUKS device.
+func (c Cryptsetup) ActiveKeyslots(device string) ([]int, error) {
+	if device == "" {
+		return nil, errors.New("empty device path")
+	}
+	out, err := c.Runner.Run([]string{"luksDump", device})
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyslots(out)
+}
+
+// AddKey enrolls `newKey` into keyslot `slot` of a LUKS device, authenticating
+// with an already enrolled `key`.
+func (c Cryptsetup) AddKey(device string, key []byte, newKey []byte, slot int) error {
+	if device == "" {
+		return errors.New("empty device path")
+	}
+	if slot < 0 {
+		return errors.Errorf("invalid keyslot %d", slot)
+	}
+	logrus.Debugf("adding key to slot %d of %s", slot, device)
+	args := []string{
+		"luksAddKey",
+		"--batch-mode",
+		"--key-file", keyFD(0),
+		"--key-slot", strconv.Itoa(slot),
+		device,
+		keyFD(1),
+	}
+	_, err := c.Runner.Run(args, key, newKey)
+	return err
+}
+
+// KillSlot wipes keyslot `slot` of a LUKS device, authenticating with a key
+// enrolled in any other keyslot.
+func (c Cryptsetup) KillSlot(device string, key []byte, slot int) error {
+	if device == "" {
+		return errors.New("empty device path")
+	}
+	if slot < 0 {
+		return errors.Errorf("invalid keyslot %d", slot)
+	}
+	logrus.Debugf("wiping slot %d of %s", slot, device)
+	args := []string{
+		"luksKillSlot",
+		"--batch-mode",
+		"--key-file", keyFD(0),
+		device,
+		strconv.Itoa(slot),
+	}
+	_, err := c.Runner.Run(args, key)
+	return err
+}
+
+// TestKey checks whether `key` opens keyslot `slot` of a LUKS device,
+// without activating it. A negative `slot` checks all keyslots.
+func (c Cryptsetup) TestKey(device string, key []byte, slot int) error {
+	if device == "" {
+		return errors.New("empty device path")
+	}
+	args := []string{
+		"open",
+		"--test-passphrase",
+		"--key-file", keyFD(0),
+	}
+	if slot >= 0 {
+		args = append(args, "--key-slot", strconv.Itoa(slot))
+	}
+	args = append(args, device)
+	_, err := c.Runner.Run(args, key)
+	return err
+}
+
+// parseKeyslots extracts enabled keyslots from `cryptsetup luksDump` output,
+// for both LUKS1 and LUKS2 headers.
+func parseKeyslots(dump []byte) ([]int, error) {
+	slots := []int{}
+	inLuks2Slots := false
+	sc := bufio.NewScanner(bytes.NewReader(dump))
+	for sc.Scan() {
+		line := sc.Text()
+		if inLuks2Slots && line != "" && !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			inLuks2Slots = false
+		}
+		if line == "Keyslots:" {
+			inLuks2Slots = true
+			continue
+		}
+
+		var m []string
+		if inLuks2Slots {
+			m = luks2SlotRe.FindStringSubmatch(line)
+		} else {
+			m = luks1SlotRe.FindStringSubmatch(line)
+		}
+		if m == nil {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, n)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Ints(slots)
+	return slots, nil
+}
+
+// keyFD returns the path of the n-th key pipe, as seen by cryptsetup.
+func keyFD(n int) string {
+	// Extra files start after stdin, stdout and stderr.
+	return fmt.Sprintf("/dev/fd/%d", 3+n)
+}
+
+// Exec is a Runner executing a cryptsetup binary.
+type Exec struct {
+	Path string
+}
+
+// Run implements the Runner interface.
+func (e Exec) Run(args []string, keys ...[]byte) ([]byte, error) {
+	cmd := exec.Command(e.Path, args...)
+	writers := make([]*os.File, 0, len(keys))
+	defer func() {
+		for _, w := range writers {
+			w.Close()
+		}
+	}()
+	for range keys {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		writers = append(writers, w)
+	}
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		go func(w *os.File, key []byte) {
+			w.Write(key)
+			w.Close()
+		}(writers[i], k)
+	}
+	writers = nil
+
+	if err := cmd.Wait(); err != nil {
+		msg := errors.New(out.String())
+		return nil, errors.Wrap(msg, err.Error())
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package luks
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const luks1Dump = `LUKS header information for /dev/loop0
+
+Version:       	1
+Cipher name:   	aes
+Cipher mode:   	xts-plain64
+Hash spec:     	sha256
+Payload offset:	4096
+MK bits:       	256
+UUID:          	2d6d5d8a-32e4-4c1c-a1a1-0bd5ac5b4e2a
+
+Key Slot 0: ENABLED
+	Iterations:         	1000
+	Salt:               	00 11 22 33 44 55 66 77 88 99 aa bb cc dd ee ff
+	Key material offset:	8
+	AF stripes:            	4000
+Key Slot 1: DISABLED
+Key Slot 2: ENABLED
+	Iterations:         	1000
+Key Slot 3: DISABLED
+Key Slot 4: DISABLED
+Key Slot 5: DISABLED
+Key Slot 6: DISABLED
+Key Slot 7: DISABLED
+`
+
+const luks2Dump = `LUKS header information
+Version:       	2
+Epoch:         	5
+Metadata area: 	16384 [bytes]
+UUID:          	6f0c7a8e-1c1b-4a43-9a0d-7d8b5a9e2c11
+Label:         	(no label)
+
+Data segments:
+  0: crypt
+	offset: 16777216 [bytes]
+	cipher: aes-xts-plain64
+
+Keyslots:
+  0: luks2
+	Key:        512 bits
+	Priority:   normal
+	PBKDF:      argon2i
+  3: luks2
+	Key:        512 bits
+Tokens:
+Digests:
+  0: pbkdf2
+	Hash:       sha256
+`
+
+func TestParseKeyslots(t *testing.T) {
+	tests := []struct {
+		dump string
+		exp  []int
+	}{
+		{"", []int{}},
+		{luks1Dump, []int{0, 2}},
+		{luks2Dump, []int{0, 3}},
+	}
+
+	for _, tt := range tests {
+		out, err := parseKeyslots([]byte(tt.dump))
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if !reflect.DeepEqual(out, tt.exp) {
+			t.Fatalf("expected keyslots %v, got %v", tt.exp, out)
+		}
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	k1, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	k2, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if string(k1) == string(k2) {
+		t.Fatalf("expected different keys, got %q twice", k1)
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(k1))
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if len(raw) != generatedKeyLen {
+		t.Fatalf("expected %d random bytes, got %d", generatedKeyLen, len(raw))
+	}
+}
+
+// fakeRunner records cryptsetup invocations, without running anything.
+type fakeRunner struct {
+	args [][]string
+	keys [][][]byte
+	out  []byte
+}
+
+func (f *fakeRunner) Run(args []string, keys ...[]byte) ([]byte, error) {
+	f.args = append(f.args, args)
+	f.keys = append(f.keys, keys)
+	return f.out, nil
+}
+
+func TestCryptsetupArgs(t *testing.T) {
+	fr := &fakeRunner{out: []byte(luks1Dump)}
+	c := Cryptsetup{Runner: fr}
+	cur, next := []byte("cur"), []byte("next")
+
+	slots, err := c.ActiveKeyslots("/dev/sda2")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if len(slots) == 0 {
+		t.Fatalf("expected keyslots from dump, got none")
+	}
+	for _, f := range []func() error{
+		func() error { return c.AddKey("/dev/sda2", cur, next, 3) },
+		func() error { return c.KillSlot("/dev/sda2", cur, 3) },
+		func() error { return c.TestKey("/dev/sda2", next, 3) },
+		func() error { return c.TestKey("/dev/sda2", next, -1) },
+	} {
+		if err := f(); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+
+	expArgs := [][]string{
+		{"luksDump", "/dev/sda2"},
+		{"luksAddKey", "--batch-mode", "--key-file", "/dev/fd/3", "--key-slot", "3", "/dev/sda2", "/dev/fd/4"},
+		{"luksKillSlot", "--batch-mode", "--key-file", "/dev/fd/3", "/dev/sda2", "3"},
+		{"open", "--test-passphrase", "--key-file", "/dev/fd/3", "--key-slot", "3", "/dev/sda2"},
+		{"open", "--test-passphrase", "--key-file", "/dev/fd/3", "/dev/sda2"},
+	}
+	if !reflect.DeepEqual(fr.args, expArgs) {
+		t.Fatalf("expected invocations %q, got %q", expArgs, fr.args)
+	}
+	expKeys := [][][]byte{nil, {cur, next}, {cur}, {next}, {next}}
+	if !reflect.DeepEqual(fr.keys, expKeys) {
+		t.Fatalf("expected keys %q, got %q", expKeys, fr.keys)
+	}
+
+	if err := c.AddKey("", cur, next, 3); err == nil {
+		t.Fatalf("expected error for empty device")
+	}
+	if err := c.KillSlot("/dev/sda2", cur, -1); err == nil {
+		t.Fatalf("expected error for invalid keyslot")
+	}
+	if len(fr.args) != len(expArgs) {
+		t.Fatalf("unexpected invocations %q", fr.args[len(expArgs):])
+	}
+}
+
+func TestExecRun(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "luks_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	bin := filepath.Join(tmpDir, "cryptsetup")
+	script := `#!/bin/sh
+[ "$1" = "fail" ] && { echo "no key available"; exit 2; }
+echo "$@"
+cat /dev/fd/3
+echo
+cat /dev/fd/4
+`
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := Exec{Path: bin}.Run([]string{"open", "/dev/sda2"}, []byte("first"), []byte("second"))
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if exp := "open /dev/sda2\nfirst\nsecond"; string(out) != exp {
+		t.Fatalf("expected output %q, got %q", exp, out)
+	}
+
+	_, err = Exec{Path: bin}.Run([]string{"fail"})
+	if err == nil || !strings.Contains(err.Error(), "no key available") {
+		t.Fatalf("expected cryptsetup failure, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/luks"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// awsKms is the provider for AwsKmsV1.
+type awsKms struct {
+	cfg config.AwsKmsV1
+}
+
+func newAwsKms(cfg config.AwsKmsV1) (*awsKms, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &awsKms{cfg: cfg}, nil
+}
+
+// Key implements the Provider interface.
+func (a *awsKms) Key(ctx context.Context, req Request) ([]byte, error) {
+	if a.cfg.Ciphertext == "" {
+		return nil, errors.New("no ciphertext configured, keyslot not enrolled")
+	}
+	in := struct {
+		CiphertextBlob    string            `json:"CiphertextBlob"`
+		KeyID             string            `json:"KeyId,omitempty"`
+		EncryptionContext map[string]string `json:"EncryptionContext,omitempty"`
+	}{a.cfg.Ciphertext, a.cfg.KeyID, a.cfg.EncryptionContext}
+	var out struct {
+		KeyID     string `json:"KeyId"`
+		Plaintext string `json:"Plaintext"`
+	}
+	if err := a.call(ctx, "Decrypt", in, &out); err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(out.Plaintext)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed kms plaintext")
+	}
+	if len(key) == 0 {
+		return nil, errors.New("empty kms plaintext")
+	}
+	return key, nil
+}
+
+// Enroll implements the Enroller interface.
+//
+// A new random key is encrypted under the configured KMS key and
+// encryption context.
+func (a *awsKms) Enroll(ctx context.Context, req Request) ([]byte, config.ProviderJSON, error) {
+	if a.cfg.KeyID == "" {
+		return nil, config.ProviderJSON{}, errors.New("enrollment requires a kms keyID")
+	}
+	key, err := luks.GenerateKey()
+	if err != nil {
+		return nil, config.ProviderJSON{}, err
+	}
+	in := struct {
+		KeyID             string            `json:"KeyId"`
+		Plaintext         string            `json:"Plaintext"`
+		EncryptionContext map[string]string `json:"EncryptionContext,omitempty"`
+	}{a.cfg.KeyID, base64.StdEncoding.EncodeToString(key), a.cfg.EncryptionContext}
+	var out struct {
+		CiphertextBlob string `json:"CiphertextBlob"`
+	}
+	if err := a.call(ctx, "Encrypt", in, &out); err != nil {
+		return nil, config.ProviderJSON{}, err
+	}
+	if out.CiphertextBlob == "" {
+		return nil, config.ProviderJSON{}, errors.New("empty kms ciphertext")
+	}
+
+	cfg := a.cfg
+	cfg.Ciphertext = out.CiphertextBlob
+	pj := config.ProviderJSON{
+		Kind:  config.ProviderAwsKmsV1,
+		Value: cfg,
+	}
+	return key, pj, nil
+}
+
+// call performs the KMS `action` with a signed request.
+func (a *awsKms) call(ctx context.Context, action string, in interface{}, out interface{}) error {
+	creds, err := a.credentials(ctx)
+	if err != nil {
+		return err
+	}
+
+	endpoint := "https://kms." + a.cfg.Region + ".amazonaws.com/"
+	if a.cfg.Endpoint != "" {
+		endpoint = a.cfg.Endpoint
+	}
+	httpReq, body, err := jsonRequest(endpoint, "application/x-amz-json-1.1", in)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("X-Amz-Target", "TrentService."+action)
+	signV4(httpReq, body, creds, a.cfg.Region, "kms", time.Now())
+
+	if err := doJSON(ctx, cloudClient, httpReq, out); err != nil {
+		return errors.Wrapf(err, "kms %s failed", strings.ToLower(action))
+	}
+	return nil
+}
+
+// credentials returns the static credentials if configured, or the instance
+// profile ones otherwise.
+func (a *awsKms) credentials(ctx context.Context) (awsCredentials, error) {
+	if c := a.cfg.Credentials; c != nil {
+		return awsCredentials{
+			AccessKeyID:     c.AccessKeyID,
+			SecretAccessKey: c.SecretAccessKey,
+			SessionToken:    c.SessionToken,
+		}, nil
+	}
+	return awsInstanceCredentials(ctx, a.cfg.MetadataEndpoint)
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+// newKMSStandIn serves KMS Decrypt, checking SigV4 signatures against
+// `secret` and the encryption context against `encContext`.
+func newKMSStandIn(t *testing.T, secret string, encContext map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		now, err := time.Parse(sigv4DateFormat, r.Header.Get("X-Amz-Date"))
+		if err != nil {
+			http.Error(w, `{"__type": "MissingAuthenticationTokenException"}`, http.StatusBadRequest)
+			return
+		}
+
+		// Re-sign the received request and compare signatures.
+		check, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+		for _, h := range []string{"Content-Type", "X-Amz-Target", "X-Amz-Security-Token"} {
+			if v := r.Header.Get(h); v != "" {
+				check.Header.Set(h, v)
+			}
+		}
+		creds := awsCredentials{AccessKeyID: "AKIDSTATIC", SecretAccessKey: secret, SessionToken: r.Header.Get("X-Amz-Security-Token")}
+		signV4(check, body, creds, "eu-west-1", "kms", now)
+		if check.Header.Get("Authorization") != r.Header.Get("Authorization") {
+			http.Error(w, `{"__type": "InvalidSignatureException"}`, http.StatusBadRequest)
+			return
+		}
+
+		var in struct {
+			CiphertextBlob    string
+			EncryptionContext map[string]string
+		}
+		json.Unmarshal(body, &in)
+		if len(in.EncryptionContext) == 0 {
+			in.EncryptionContext = nil
+		}
+		if in.CiphertextBlob != base64.StdEncoding.EncodeToString([]byte(testCiphertext)) ||
+			!reflect.DeepEqual(in.EncryptionContext, encContext) {
+			http.Error(w, `{"__type": "InvalidCiphertextException"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"Plaintext": base64.StdEncoding.EncodeToString([]byte(testKey))})
+	}))
+}
+
+func TestAwsKmsStaticCredentials(t *testing.T) {
+	encContext := map[string]string{"volume": "data", "node": "node-1"}
+	ts := newKMSStandIn(t, "static-secret", encContext)
+	defer ts.Close()
+
+	creds := &config.AwsKmsV1Credentials{AccessKeyID: "AKIDSTATIC", SecretAccessKey: "static-secret", SessionToken: "session"}
+	tests := []struct {
+		cfg    config.AwsKmsV1
+		expErr bool
+	}{
+		{config.AwsKmsV1{Credentials: creds, EncryptionContext: encContext}, false},
+		{config.AwsKmsV1{Credentials: creds, EncryptionContext: map[string]string{"volume": "data"}}, true},
+		{config.AwsKmsV1{Credentials: creds}, true},
+		{config.AwsKmsV1{Credentials: &config.AwsKmsV1Credentials{AccessKeyID: "AKIDSTATIC", SecretAccessKey: "wrong"}, EncryptionContext: encContext}, true},
+	}
+
+	for i, tt := range tests {
+		cfg := tt.cfg
+		cfg.Region = "eu-west-1"
+		cfg.Endpoint = ts.URL
+		cfg.Ciphertext = base64.StdEncoding.EncodeToString([]byte(testCiphertext))
+		p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderAwsKmsV1, Value: cfg})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		key, err := p.Key(context.Background(), Request{})
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for case %d, got key %q", i, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q for case %d", err, i)
+		}
+		if string(key) != testKey {
+			t.Fatalf("expected key %q, got %q", testKey, key)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/luks"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	// azureVaultResource is the AAD resource for Key Vault tokens.
+	azureVaultResource = "https://vault.azure.net"
+	azureVaultAPI      = "7.0"
+
+	aadAuthorityEndpoint = "https://login.microsoftonline.com"
+	// aadAssertionLifetime is the validity of client assertions.
+	aadAssertionLifetime = 10 * time.Minute
+)
+
+// azureVault is the provider for AzureVaultV1.
+type azureVault struct {
+	cfg config.AzureVaultV1
+}
+
+func newAzureVault(cfg config.AzureVaultV1) (*azureVault, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &azureVault{cfg: cfg}, nil
+}
+
+// Key implements the Provider interface.
+func (a *azureVault) Key(ctx context.Context, req Request) ([]byte, error) {
+	if a.cfg.Ciphertext == "" {
+		return nil, errors.New("no ciphertext configured, keyslot not enrolled")
+	}
+	_, value, err := a.keyOperation(ctx, req, "decrypt", a.cfg.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed vault plaintext")
+	}
+	if len(key) == 0 {
+		return nil, errors.New("empty vault plaintext")
+	}
+	return key, nil
+}
+
+// Enroll implements the Enroller interface.
+//
+// A new random key is wrapped with the vault key. The key version is pinned
+// in the returned configuration, so that later versions of the vault key do
+// not break unwrapping.
+func (a *azureVault) Enroll(ctx context.Context, req Request) ([]byte, config.ProviderJSON, error) {
+	key, err := luks.GenerateKey()
+	if err != nil {
+		return nil, config.ProviderJSON{}, err
+	}
+	kid, value, err := a.keyOperation(ctx, req, "encrypt", base64.RawURLEncoding.EncodeToString(key))
+	if err != nil {
+		return nil, config.ProviderJSON{}, err
+	}
+	if value == "" {
+		return nil, config.ProviderJSON{}, errors.New("empty vault ciphertext")
+	}
+
+	cfg := a.cfg
+	cfg.Ciphertext = value
+	if cfg.KeyVersion == "" {
+		if u, err := url.Parse(kid); err == nil {
+			cfg.KeyVersion = path.Base(u.Path)
+		}
+	}
+	pj := config.ProviderJSON{
+		Kind:  config.ProviderAzureVaultV1,
+		Value: cfg,
+	}
+	return key, pj, nil
+}
+
+// keyOperation runs the Key Vault operation `op` on the base64url `value`,
+// returning the identifier of the key version used and the resulting value.
+func (a *azureVault) keyOperation(ctx context.Context, req Request, op string, value string) (string, string, error) {
+	token, err := a.token(ctx, req)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyPath := "/keys/" + url.PathEscape(a.cfg.KeyName)
+	if a.cfg.KeyVersion != "" {
+		keyPath += "/" + url.PathEscape(a.cfg.KeyVersion)
+	}
+	u := strings.TrimSuffix(a.cfg.BaseURL, "/") + keyPath + "/" + op + "?api-version=" + azureVaultAPI
+	in := struct {
+		Alg   string `json:"alg"`
+		Value string `json:"value"`
+	}{a.cfg.EncryptionAlgorithm, value}
+	httpReq, _, err := jsonRequest(u, "application/json", in)
+	if err != nil {
+		return "", "", err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+
+	var out struct {
+		Kid   string `json:"kid"`
+		Value string `json:"value"`
+	}
+	if err := doJSON(ctx, cloudClient, httpReq, &out); err != nil {
+		return "", "", errors.Wrapf(err, "vault %s failed", op)
+	}
+	return out.Kid, out.Value, nil
+}
+
+// token retrieves an AAD access token for Key Vault.
+func (a *azureVault) token(ctx context.Context, req Request) (string, error) {
+	if mi := a.cfg.ManagedIdentityAuth; mi != nil {
+		return azureManagedIdentityToken(ctx, mi.MetadataEndpoint, azureVaultResource, mi.ClientID)
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("resource", azureVaultResource)
+	var authority, tenant string
+	if pa := a.cfg.PasswordAuth; pa != nil {
+		authority, tenant = pa.AuthorityEndpoint, pa.TenantID
+		form.Set("client_id", pa.AppID)
+		form.Set("client_secret", pa.Password)
+	}
+	if cc := a.cfg.ClientCertificateAuth; cc != nil {
+		authority, tenant = cc.AuthorityEndpoint, cc.TenantID
+		cert, err := clientCertificate(ctx, req, config.ContentV1ClientCert{
+			Certificate:   cc.Certificate,
+			Key:           cc.Key,
+			KeyPassphrase: cc.KeyPassphrase,
+		})
+		if err != nil {
+			return "", err
+		}
+		assertion, err := clientAssertion(cert, cc.AppID, aadTokenURL(authority, tenant), time.Now())
+		if err != nil {
+			return "", err
+		}
+		form.Set("client_id", cc.AppID)
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", assertion)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, aadTokenURL(authority, tenant), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tok oauthToken
+	if err := doJSON(ctx, cloudClient, httpReq, &tok); err != nil {
+		return "", errors.Wrap(err, "failed to get AAD token")
+	}
+	if tok.AccessToken == "" {
+		return "", errors.New("empty AAD token")
+	}
+	return tok.AccessToken, nil
+}
+
+// aadTokenURL returns the OAuth2 token endpoint of an Azure AD tenant.
+func aadTokenURL(authority string, tenant string) string {
+	if authority == "" {
+		authority = aadAuthorityEndpoint
+	}
+	return strings.TrimSuffix(authority, "/") + "/" + url.PathEscape(tenant) + "/oauth2/token"
+}
+
+// clientAssertion builds an RS256-signed JWT, identifying the certificate by
+// its SHA-1 thumbprint as required by Azure AD.
+func clientAssertion(cert tls.Certificate, appID string, audience string, now time.Time) (string, error) {
+	key, ok := cert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.Errorf("unsupported client key type %T, RSA required", cert.PrivateKey)
+	}
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("empty client certificate")
+	}
+	thumbprint := sha1.Sum(cert.Certificate[0])
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	header := map[string]string{
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	}
+	claims := map[string]interface{}{
+		"aud": audience,
+		"iss": appID,
+		"sub": appID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"exp": now.Add(aadAssertionLifetime).Unix(),
+	}
+	return signJWT(key, header, claims)
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+// newRSACert generates a self-signed RSA certificate and its PEM encodings.
+func newRSACert(t *testing.T) (*rsa.PrivateKey, string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "app"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return key, string(certPEM), string(keyPEM)
+}
+
+func TestAzureVaultAuth(t *testing.T) {
+	key, certPEM, keyPEM := newRSACert(t)
+	_, otherCertPEM, otherKeyPEM := newRSACert(t)
+	ec := newTestCert(t, "app", nil)
+	ts := newCloudStandIn(t, &key.PublicKey)
+	defer ts.Close()
+
+	tests := []struct {
+		cfg    config.AzureVaultV1
+		expErr bool
+	}{
+		{
+			config.AzureVaultV1{ManagedIdentityAuth: &config.AzureVaultV1ManagedIdentityAuth{
+				ClientID: "user-assigned", MetadataEndpoint: ts.URL,
+			}},
+			false,
+		},
+		{
+			config.AzureVaultV1{ManagedIdentityAuth: &config.AzureVaultV1ManagedIdentityAuth{
+				ClientID: "unknown", MetadataEndpoint: ts.URL,
+			}},
+			true,
+		},
+		{
+			config.AzureVaultV1{PasswordAuth: &config.AzureVaultV1PasswordAuth{
+				TenantID: "tenant", AppID: "app", Password: "app-password", AuthorityEndpoint: ts.URL,
+			}},
+			false,
+		},
+		{
+			config.AzureVaultV1{PasswordAuth: &config.AzureVaultV1PasswordAuth{
+				TenantID: "tenant", AppID: "app", Password: "wrong", AuthorityEndpoint: ts.URL,
+			}},
+			true,
+		},
+		{
+			config.AzureVaultV1{ClientCertificateAuth: &config.AzureVaultV1ClientCertificateAuth{
+				TenantID: "tenant", AppID: "app", Certificate: certPEM, Key: keyPEM, AuthorityEndpoint: ts.URL,
+			}},
+			false,
+		},
+		{
+			// Certificate not registered for the application.
+			config.AzureVaultV1{ClientCertificateAuth: &config.AzureVaultV1ClientCertificateAuth{
+				TenantID: "tenant", AppID: "app", Certificate: otherCertPEM, Key: otherKeyPEM, AuthorityEndpoint: ts.URL,
+			}},
+			true,
+		},
+		{
+			// Azure AD only accepts RSA client assertions.
+			config.AzureVaultV1{ClientCertificateAuth: &config.AzureVaultV1ClientCertificateAuth{
+				TenantID: "tenant", AppID: "app", Certificate: ec.certPEM, Key: ec.keyPEM(), AuthorityEndpoint: ts.URL,
+			}},
+			true,
+		},
+	}
+
+	for i, tt := range tests {
+		cfg := tt.cfg
+		cfg.BaseURL = ts.URL
+		cfg.EncryptionAlgorithm = "RSA-OAEP"
+		cfg.KeyName = "disk"
+		cfg.KeyVersion = "v1"
+		cfg.Ciphertext = base64.RawURLEncoding.EncodeToString([]byte(testCiphertext))
+		p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderAzureVaultV1, Value: cfg})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		out, err := p.Key(context.Background(), Request{})
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for case %d, got key %q", i, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q for case %d", err, i)
+		}
+		if string(out) != testKey {
+			t.Fatalf("expected key %q, got %q", testKey, out)
+		}
+	}
+}
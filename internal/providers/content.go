@@ -0,0 +1,239 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultHTTPResponseHeaders is the default timeout (in seconds) for
+	// receiving response headers.
+	defaultHTTPResponseHeaders = 10
+	// maxContentSize is the maximum accepted size for fetched content.
+	maxContentSize = 1 << 20
+)
+
+// content is the provider for ContentV1.
+type content struct {
+	cfg    config.ContentV1
+	source *url.URL
+}
+
+func newContent(cfg config.ContentV1) (*content, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(cfg.Source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid content source %q", cfg.Source)
+	}
+	if err := validateVerification(cfg.Verification); err != nil {
+		return nil, errors.Wrap(err, "invalid source verification")
+	}
+	for _, ca := range cfg.CertificateAuthorities {
+		if err := validateVerification(ca.Verification); err != nil {
+			return nil, errors.Wrap(err, "invalid certificate authority verification")
+		}
+	}
+
+	return &content{cfg: cfg, source: u}, nil
+}
+
+// Key implements the Provider interface.
+func (c *content) Key(ctx context.Context, req Request) ([]byte, error) {
+	var body []byte
+	var err error
+	switch c.source.Scheme {
+	case "http", "https":
+		body, err = c.fetchHTTP(ctx, req, c.source, nil)
+	case "s3":
+		body, err = c.fetchS3(ctx, req)
+	case "data":
+		body, err = decodeDataURL(c.source)
+	case "file":
+		body, err = c.readFile()
+	case "tftp":
+		body, err = c.fetchTFTP(ctx)
+	default:
+		err = errors.Errorf("unsupported content source scheme %q", c.source.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > maxContentSize {
+		return nil, errors.Errorf("content from %s exceeds %d bytes", c.source, maxContentSize)
+	}
+	if len(body) == 0 {
+		return nil, errors.Errorf("empty content from %s", c.source)
+	}
+	if err := verify(body, c.cfg.Verification); err != nil {
+		return nil, errors.Wrapf(err, "failed to verify %s", c.source)
+	}
+	if c.cfg.Envelope != nil {
+		body, err = openEnvelope(ctx, req, *c.cfg.Envelope, body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open envelope from %s", c.source)
+		}
+		if len(body) == 0 {
+			return nil, errors.Errorf("empty envelope content from %s", c.source)
+		}
+	}
+
+	return body, nil
+}
+
+// Enroll implements the Enroller interface.
+//
+// Content is owned by the remote source, thus enrolling just fetches the
+// current key and keeps the configuration as is.
+func (c *content) Enroll(ctx context.Context, req Request) ([]byte, config.ProviderJSON, error) {
+	key, err := c.Key(ctx, req)
+	if err != nil {
+		return nil, config.ProviderJSON{}, err
+	}
+	pj := config.ProviderJSON{
+		Kind:  config.ProviderContentV1,
+		Value: c.cfg,
+	}
+	return key, pj, nil
+}
+
+// fetchHTTP retrieves `u`, signing the request with `sign` if not nil.
+func (c *content) fetchHTTP(ctx context.Context, req Request, u *url.URL, sign func(*http.Request)) ([]byte, error) {
+	client, err := c.httpClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if sign != nil {
+		sign(httpReq)
+	}
+	resp, err := client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch %s", c.source)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to fetch %s: %s", c.source, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxContentSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", c.source)
+	}
+	return body, nil
+}
+
+// fetchS3 retrieves an `s3://bucket/key` object with a signed request.
+func (c *content) fetchS3(ctx context.Context, req Request) ([]byte, error) {
+	opts := c.cfg.S3
+	endpoint := "https://s3." + opts.Region + ".amazonaws.com"
+	if opts.Endpoint != "" {
+		endpoint = opts.Endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid s3 endpoint %q", endpoint)
+	}
+	bucket, key := c.source.Host, strings.TrimPrefix(c.source.Path, "/")
+	if opts.PathStyle {
+		u.Path = "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+
+	creds := awsCredentials{
+		AccessKeyID:     opts.AccessKeyID,
+		SecretAccessKey: opts.SecretAccessKey,
+		SessionToken:    opts.SessionToken,
+	}
+	if creds.AccessKeyID == "" {
+		if creds, err = awsInstanceCredentials(ctx, opts.MetadataEndpoint); err != nil {
+			return nil, err
+		}
+	}
+	sign := func(r *http.Request) {
+		signV4(r, nil, creds, opts.Region, "s3", time.Now())
+	}
+	return c.fetchHTTP(ctx, req, u, sign)
+}
+
+// readFile reads a `file://` source, under the configured root.
+func (c *content) readFile() ([]byte, error) {
+	root := bootDir
+	if c.cfg.File != nil {
+		root = c.cfg.File.Root
+	}
+	path, err := filePath(c.source, root)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return ioutil.ReadAll(io.LimitReader(fp, maxContentSize+1))
+}
+
+// fetchTFTP retrieves a `tftp://host[:port]/path` source.
+func (c *content) fetchTFTP(ctx context.Context) ([]byte, error) {
+	timeout, retries := tftpDefaultTimeout, tftpDefaultRetries
+	if c.cfg.TFTP != nil {
+		if c.cfg.TFTP.Timeout > 0 {
+			timeout = time.Duration(c.cfg.TFTP.Timeout) * time.Second
+		}
+		if c.cfg.TFTP.Retries > 0 {
+			retries = c.cfg.TFTP.Retries
+		}
+	}
+	return tftpGet(ctx, c.source.Host, c.source.Path, timeout, retries, maxContentSize)
+}
+
+func (c *content) httpClient(ctx context.Context, req Request) (*http.Client, error) {
+	headers, total := defaultHTTPResponseHeaders, 0
+	if c.cfg.Timeouts != nil {
+		headers = c.cfg.Timeouts.HTTPResponseHeaders
+		total = c.cfg.Timeouts.HTTPTotal
+	}
+
+	tlsConfig, err := tlsClientConfig(ctx, req, c.cfg.CertificateAuthorities, c.cfg.ClientCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Transport: httpTransport(tlsConfig, time.Duration(headers)*time.Second),
+		Timeout:   time.Duration(total) * time.Second,
+	}
+	return client, nil
+}
@@ -0,0 +1,336 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+const testKey = "sekrit-volume-key"
+
+func dataURL(content string) string {
+	return "data:;base64," + base64.StdEncoding.EncodeToString([]byte(content))
+}
+
+func hashOf(content string) *config.ContentV1Verification {
+	sum := sha512.Sum512([]byte(content))
+	return &config.ContentV1Verification{Hash: "sha512-" + hex.EncodeToString(sum[:])}
+}
+
+func serverCA(ts *httptest.Server) string {
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}
+	return string(pem.EncodeToMemory(block))
+}
+
+func TestContentKey(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/key.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testKey))
+	}))
+	defer ts.Close()
+	caPEM := serverCA(ts)
+	ca := []config.ContentV1CertAuth{{Authority: dataURL(caPEM), Verification: hashOf(caPEM)}}
+	tamperedCA := []config.ContentV1CertAuth{{Authority: dataURL(caPEM + "\n"), Verification: hashOf(caPEM)}}
+
+	tests := []struct {
+		cfg    config.ContentV1
+		expErr bool
+	}{
+		{
+			config.ContentV1{Source: ts.URL + "/key.txt", CertificateAuthorities: ca},
+			false,
+		},
+		{
+			config.ContentV1{Source: ts.URL + "/missing", CertificateAuthorities: ca},
+			true,
+		},
+		{
+			// Unknown self-signed server certificate.
+			config.ContentV1{Source: ts.URL + "/key.txt"},
+			true,
+		},
+		{
+			config.ContentV1{Source: ts.URL + "/key.txt", CertificateAuthorities: tamperedCA},
+			true,
+		},
+		{
+			config.ContentV1{Source: ts.URL + "/key.txt", CertificateAuthorities: ca, Verification: hashOf(testKey)},
+			false,
+		},
+		{
+			config.ContentV1{Source: ts.URL + "/key.txt", CertificateAuthorities: ca, Verification: hashOf("other")},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderContentV1, Value: tt.cfg})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		key, err := p.Key(context.Background(), Request{})
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for %s, got key %q", tt.cfg.Source, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if string(key) != testKey {
+			t.Fatalf("expected key %q, got %q", testKey, key)
+		}
+	}
+}
+
+func TestContentConfig(t *testing.T) {
+	tests := []struct {
+		source string
+		expErr bool
+	}{
+		{"", true},
+		{"ftp://localhost/key.txt", true},
+		{"https://localhost/key.txt", false},
+	}
+
+	for _, tt := range tests {
+		_, err := newContent(config.ContentV1{Source: tt.source})
+		if tt.expErr && err == nil {
+			t.Fatalf("expected error for source %q", tt.source)
+		}
+		if !tt.expErr && err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+
+	hashes := []struct {
+		hash   string
+		expErr bool
+	}{
+		{"", true},
+		{"md5-d41d8cd98f00b204e9800998ecf8427e", true},
+		{"sha512-0123", true},
+		{"sha512-zz", true},
+		{hashOf("").Hash, false},
+	}
+	for _, tt := range hashes {
+		cfg := config.ContentV1{
+			Source:       "https://localhost/key.txt",
+			Verification: &config.ContentV1Verification{Hash: tt.hash},
+		}
+		_, err := newContent(cfg)
+		if tt.expErr && err == nil {
+			t.Fatalf("expected error for hash %q", tt.hash)
+		}
+		if !tt.expErr && err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+}
+
+func TestReadLocalResource(t *testing.T) {
+	tests := []struct {
+		url    string
+		exp    string
+		expErr bool
+	}{
+		{"data:,plain%20text", "plain text", false},
+		{"data:text/plain;base64,c2VrcmV0", "sekret", false},
+		{"data:nocomma", "", true},
+		{"-----BEGIN CERTIFICATE-----\nMIIB\n", "-----BEGIN CERTIFICATE-----\nMIIB\n", false},
+		{"file:///etc/shadow", "", true},
+		{"file:///boot/../etc/shadow", "", true},
+		{"file://host/boot/ca.pem", "", true},
+		{"https://localhost/ca.pem", "", true},
+	}
+
+	for _, tt := range tests {
+		out, err := readLocalResource(tt.url)
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for %q", tt.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if string(out) != tt.exp {
+			t.Fatalf("expected %q, got %q", tt.exp, out)
+		}
+	}
+}
+
+// serveTFTP answers a single read request for `path` with `content`, from a
+// dedicated transfer port as per RFC 1350.
+func serveTFTP(t *testing.T, conn *net.UDPConn, path string, content []byte) {
+	buf := make([]byte, 516)
+	n, client, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return
+	}
+	xfer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer xfer.Close()
+
+	fields := strings.Split(string(buf[2:n]), "\x00")
+	if binary.BigEndian.Uint16(buf[0:2]) != tftpOpRRQ || fields[0] != path || fields[1] != "octet" {
+		pkt := []byte{0, tftpOpError, 0, 1}
+		xfer.WriteToUDP(append(pkt, []byte("File not found\x00")...), client)
+		return
+	}
+	for block := 1; ; block++ {
+		start := (block - 1) * tftpBlockSize
+		end := start + tftpBlockSize
+		if end > len(content) {
+			end = len(content)
+		}
+		pkt := make([]byte, 4, 4+end-start)
+		binary.BigEndian.PutUint16(pkt[0:2], tftpOpData)
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(block))
+		pkt = append(pkt, content[start:end]...)
+		xfer.WriteToUDP(pkt, client)
+		xfer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := xfer.ReadFromUDP(buf); err != nil {
+			t.Error(err)
+			return
+		}
+		if end-start < tftpBlockSize {
+			return
+		}
+	}
+}
+
+func TestContentSchemes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "providers_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(filepath.Join(tmpDir, "keys"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "keys", "node.key"), []byte(testKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A multi-block payload exercises TFTP acknowledgements.
+	bigKey := strings.Repeat("k", 3*tftpBlockSize)
+	tftpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tftpConn.Close()
+	go serveTFTP(t, tftpConn, "keys/node.key", []byte(bigKey))
+
+	// S3 stand-in, checking path-style addressing and request signing.
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		static := strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/")
+		instance := strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDINSTANCE/") && r.Header.Get("X-Amz-Security-Token") == "instance-session"
+		if !(static || instance) || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("X-Amz-Content-Sha256") == "" || r.URL.Path != "/bucket/keys/node.key" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testKey))
+	}))
+	defer s3.Close()
+	s3Opts := &config.ContentV1S3{
+		Endpoint:        s3.URL,
+		Region:          "eu-west-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	}
+	imds := newCloudStandIn(t, nil)
+	defer imds.Close()
+	s3InstanceOpts := &config.ContentV1S3{
+		Endpoint:         s3.URL,
+		Region:           "eu-west-1",
+		MetadataEndpoint: imds.URL,
+		PathStyle:        true,
+	}
+
+	tests := []struct {
+		cfg config.ContentV1
+		exp string
+	}{
+		{
+			config.ContentV1{Source: dataURL(testKey)},
+			testKey,
+		},
+		{
+			config.ContentV1{Source: "file://" + filepath.Join(tmpDir, "keys", "node.key"), File: &config.ContentV1File{Root: tmpDir}},
+			testKey,
+		},
+		{
+			config.ContentV1{Source: "file://" + tmpDir + "/../" + filepath.Base(tmpDir) + "/keys/node.key", File: &config.ContentV1File{Root: tmpDir}},
+			testKey,
+		},
+		{
+			config.ContentV1{Source: "tftp://" + tftpConn.LocalAddr().String() + "/keys/node.key"},
+			bigKey,
+		},
+		{
+			config.ContentV1{Source: "s3://bucket/keys/node.key", S3: s3Opts},
+			testKey,
+		},
+		{
+			config.ContentV1{Source: "s3://bucket/keys/node.key", S3: s3InstanceOpts},
+			testKey,
+		},
+	}
+
+	for _, tt := range tests {
+		p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderContentV1, Value: tt.cfg})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		key, err := p.Key(context.Background(), Request{})
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %q", tt.cfg.Source, err)
+		}
+		if string(key) != tt.exp {
+			t.Fatalf("expected key %q from %s, got %q", tt.exp, tt.cfg.Source, key)
+		}
+	}
+}
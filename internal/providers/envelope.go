@@ -0,0 +1,139 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// aesgcmInfo is the HKDF info for AESGCM envelope keys.
+const aesgcmInfo = "coreos-cryptagent ContentV1 AESGCM"
+
+// openEnvelope decrypts a payload, retrieving the key material through the
+// envelope nested provider.
+func openEnvelope(ctx context.Context, req Request, env config.ContentV1Envelope, payload []byte) ([]byte, error) {
+	if env.Key == nil {
+		return nil, errors.New("envelope without key provider")
+	}
+	p, err := FromConfig(*env.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid envelope key provider")
+	}
+	secret, err := p.Key(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve envelope key")
+	}
+
+	switch env.Kind {
+	case config.EnvelopeJWE:
+		return openJWE(payload, secret)
+	case config.EnvelopeAge:
+		return openAge(payload, secret)
+	case config.EnvelopeAESGCM:
+		return openAESGCM(payload, secret)
+	default:
+		return nil, errors.Errorf("unsupported envelope kind %q", env.Kind)
+	}
+}
+
+// openJWE decrypts a JWE compact serialization with a symmetric key, either
+// as raw bytes or as an `oct` JWK. Only direct encryption and AES key wrap
+// are accepted as key management algorithms.
+func openJWE(payload []byte, secret []byte) ([]byte, error) {
+	obj, err := jose.ParseEncrypted(strings.TrimSpace(string(payload)))
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed JWE")
+	}
+	switch alg := jose.KeyAlgorithm(obj.Header.Algorithm); alg {
+	case jose.DIRECT, jose.A128KW, jose.A192KW, jose.A256KW:
+	default:
+		return nil, errors.Errorf("unsupported JWE algorithm %q", alg)
+	}
+
+	key := secret
+	var jwk jose.JSONWebKey
+	// Random raw keys may look like JSON too, thus only a valid JWK is
+	// taken as such.
+	if bytes.HasPrefix(bytes.TrimSpace(secret), []byte("{")) && jwk.UnmarshalJSON(secret) == nil {
+		k, ok := jwk.Key.([]byte)
+		if !ok {
+			return nil, errors.New("unsupported JWK, expected an oct key")
+		}
+		key = k
+	}
+	plain, err := obj.Decrypt(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt JWE")
+	}
+	return plain, nil
+}
+
+// openAge decrypts an age v1 file with the X25519 identities of an age
+// identity file.
+func openAge(payload []byte, secret []byte) ([]byte, error) {
+	identities, err := age.ParseIdentities(bytes.NewReader(secret))
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed age identity")
+	}
+	r, err := age.Decrypt(bytes.NewReader(payload), identities...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt age file")
+	}
+	// Decryption does not expand the payload, which is bounded already.
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt age payload")
+	}
+	return plain, nil
+}
+
+// openAESGCM decrypts a nonce-prefixed AES-256-GCM payload, with the key
+// derived from `secret` via HKDF-SHA256.
+func openAESGCM(payload []byte, secret []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(aesgcmInfo)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("AESGCM payload too short")
+	}
+	nonce, ciphertext := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt AESGCM payload")
+	}
+	return plain, nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"golang.org/x/crypto/hkdf"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	return b
+}
+
+func sealAESGCM(t *testing.T, secret []byte, plain []byte) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(aesgcmInfo)), key)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := randomBytes(t, aead.NonceSize())
+	return aead.Seal(nonce, nonce, plain, nil)
+}
+
+func sealJWE(t *testing.T, alg jose.KeyAlgorithm, enc jose.ContentEncryption, key []byte, plain []byte) []byte {
+	encrypter, err := jose.NewEncrypter(enc, jose.Recipient{Algorithm: alg, Key: key}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	obj, err := encrypter.Encrypt(plain)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	out, err := obj.CompactSerialize()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	return []byte(out)
+}
+
+func sealAge(t *testing.T, recipient age.Recipient, plain []byte) []byte {
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, recipient)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	return out.Bytes()
+}
+
+func TestAgeLargePayload(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	secret := []byte("# created: now\n" + identity.String() + "\n")
+	// age encrypts its payload in 64 KiB chunks.
+	const chunkSize = 64 * 1024
+	for _, size := range []int{1, chunkSize, chunkSize + 1, 3*chunkSize - 7} {
+		plain := randomBytes(t, size)
+		out, err := openAge(sealAge(t, identity.Recipient(), plain), secret)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if !bytes.Equal(out, plain) {
+			t.Fatalf("payload mismatch for size %d", size)
+		}
+	}
+}
+
+func TestContentEnvelope(t *testing.T) {
+	symKey := randomBytes(t, 32)
+	kek := randomBytes(t, 16)
+	jwk, _ := json.Marshal(map[string]string{"kty": "oct", "k": base64.RawURLEncoding.EncodeToString(symKey)})
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	ageSecret, otherAgeSecret := identity.String(), other.String()
+	// Corrupt the checksum by changing its last character.
+	last := "Q"
+	if strings.HasSuffix(ageSecret, last) {
+		last = "P"
+	}
+	badAgeSecret := ageSecret[:len(ageSecret)-1] + last
+
+	key := func(secret []byte) *config.ProviderJSON {
+		v := config.ContentV1{Source: "data:;base64," + base64.StdEncoding.EncodeToString(secret)}
+		return &config.ProviderJSON{Kind: config.ProviderContentV1, Value: v}
+	}
+	sealed := func(payload []byte) string {
+		return "data:;base64," + base64.StdEncoding.EncodeToString(payload)
+	}
+	plain := []byte(testKey)
+	tampered := sealAESGCM(t, symKey, plain)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		source string
+		env    config.ContentV1Envelope
+		expErr bool
+	}{
+		{
+			sealed(sealAESGCM(t, symKey, plain)),
+			config.ContentV1Envelope{Kind: config.EnvelopeAESGCM, Key: key(symKey)},
+			false,
+		},
+		{
+			sealed(tampered),
+			config.ContentV1Envelope{Kind: config.EnvelopeAESGCM, Key: key(symKey)},
+			true,
+		},
+		{
+			sealed(sealAESGCM(t, symKey, plain)),
+			config.ContentV1Envelope{Kind: config.EnvelopeAESGCM, Key: key(kek)},
+			true,
+		},
+		{
+			sealed(sealJWE(t, jose.DIRECT, jose.A256GCM, symKey, plain)),
+			config.ContentV1Envelope{Kind: config.EnvelopeJWE, Key: key(symKey)},
+			false,
+		},
+		{
+			sealed(sealJWE(t, jose.DIRECT, jose.A256GCM, symKey, plain)),
+			config.ContentV1Envelope{Kind: config.EnvelopeJWE, Key: key(jwk)},
+			false,
+		},
+		{
+			sealed(sealJWE(t, jose.A128KW, jose.A256GCM, kek, plain)),
+			config.ContentV1Envelope{Kind: config.EnvelopeJWE, Key: key(kek)},
+			false,
+		},
+		{
+			sealed(sealJWE(t, jose.A128KW, jose.A128CBC_HS256, kek, plain)),
+			config.ContentV1Envelope{Kind: config.EnvelopeJWE, Key: key(kek)},
+			false,
+		},
+		{
+			sealed(sealJWE(t, jose.PBES2_HS256_A128KW, jose.A128GCM, kek, plain)),
+			config.ContentV1Envelope{Kind: config.EnvelopeJWE, Key: key(kek)},
+			true,
+		},
+		{
+			sealed(sealJWE(t, jose.A128KW, jose.A128GCM, kek, plain)),
+			config.ContentV1Envelope{Kind: config.EnvelopeJWE, Key: key(symKey)},
+			true,
+		},
+		{
+			sealed(sealAge(t, identity.Recipient(), plain)),
+			config.ContentV1Envelope{Kind: config.EnvelopeAge, Key: key([]byte(ageSecret))},
+			false,
+		},
+		{
+			sealed(sealAge(t, identity.Recipient(), plain)),
+			config.ContentV1Envelope{Kind: config.EnvelopeAge, Key: key([]byte(otherAgeSecret))},
+			true,
+		},
+		{
+			sealed(sealAge(t, identity.Recipient(), plain)),
+			config.ContentV1Envelope{Kind: config.EnvelopeAge, Key: key([]byte(badAgeSecret))},
+			true,
+		},
+	}
+
+	for i, tt := range tests {
+		env := tt.env
+		cfg := config.ContentV1{Source: tt.source, Envelope: &env}
+		p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderContentV1, Value: cfg})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		out, err := p.Key(context.Background(), Request{})
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for case %d, got key %q", i, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q for case %d", err, i)
+		}
+		if string(out) != testKey {
+			t.Fatalf("expected key %q, got %q", testKey, out)
+		}
+	}
+}
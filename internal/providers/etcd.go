@@ -0,0 +1,205 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// defaultEtcdTimeout is the default timeout (in seconds) of etcd requests.
+const defaultEtcdTimeout = 10
+
+// etcd is the provider for EtcdV1, using the v3 JSON gateway.
+type etcd struct {
+	cfg config.EtcdV1
+
+	// State of the last successful Key, for one-time reads.
+	client   *http.Client
+	endpoint string
+	token    string
+	revision int64
+	lease    int64
+}
+
+func newEtcd(cfg config.EtcdV1) (*etcd, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &etcd{cfg: cfg}, nil
+}
+
+// etcdKeyValue is a key-value pair from the v3 JSON gateway, where 64-bit
+// integers are encoded as strings.
+type etcdKeyValue struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+	Lease       string `json:"lease"`
+}
+
+// Key implements the Provider interface.
+func (e *etcd) Key(ctx context.Context, req Request) ([]byte, error) {
+	client, err := e.httpClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	failures := []string{}
+	for _, ep := range e.cfg.Endpoints {
+		ep = strings.TrimSuffix(ep, "/")
+		key, err := e.get(ctx, req, client, ep)
+		if err == nil {
+			return key, nil
+		}
+		failures = append(failures, err.Error())
+	}
+	return nil, errors.Errorf("all etcd endpoints failed: %s", strings.Join(failures, "; "))
+}
+
+// get reads the configured key from a single endpoint.
+func (e *etcd) get(ctx context.Context, req Request, client *http.Client, endpoint string) ([]byte, error) {
+	token := ""
+	if e.cfg.Auth != nil {
+		var err error
+		if token, err = e.authenticate(ctx, req, client, endpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	in := map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(e.cfg.Key))}
+	var out struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	if err := e.call(ctx, client, endpoint, "/v3/kv/range", token, in, &out); err != nil {
+		return nil, err
+	}
+	if len(out.Kvs) == 0 {
+		return nil, errors.Errorf("key %q not found on %s", e.cfg.Key, endpoint)
+	}
+	kv := out.Kvs[0]
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "malformed value from %s", endpoint)
+	}
+	if len(value) == 0 {
+		return nil, errors.Errorf("empty value for key %q on %s", e.cfg.Key, endpoint)
+	}
+
+	e.client, e.endpoint, e.token = client, endpoint, token
+	e.revision, _ = strconv.ParseInt(kv.ModRevision, 10, 64)
+	e.lease, _ = strconv.ParseInt(kv.Lease, 10, 64)
+	return value, nil
+}
+
+// Commit implements the Committer interface. In one-time-read mode, the key
+// is deleted if it has not been modified since it was read, and its lease is
+// revoked.
+func (e *etcd) Commit(ctx context.Context, req Request) error {
+	if !e.cfg.OneTimeRead {
+		return nil
+	}
+	if e.client == nil {
+		return errors.New("no key read to commit")
+	}
+
+	key := base64.StdEncoding.EncodeToString([]byte(e.cfg.Key))
+	txn := map[string]interface{}{
+		"compare": []map[string]interface{}{{
+			"key":          key,
+			"target":       "MOD",
+			"result":       "EQUAL",
+			"mod_revision": strconv.FormatInt(e.revision, 10),
+		}},
+		"success": []map[string]interface{}{{
+			"request_delete_range": map[string]string{"key": key},
+		}},
+	}
+	var out struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := e.call(ctx, e.client, e.endpoint, "/v3/kv/txn", e.token, txn, &out); err != nil {
+		return errors.Wrap(err, "failed to delete one-time key")
+	}
+	if !out.Succeeded {
+		return errors.Errorf("key %q was modified after being read, not deleted", e.cfg.Key)
+	}
+	if e.lease != 0 {
+		in := map[string]string{"ID": strconv.FormatInt(e.lease, 10)}
+		if err := e.call(ctx, e.client, e.endpoint, "/v3/lease/revoke", e.token, in, &struct{}{}); err != nil {
+			return errors.Wrap(err, "failed to revoke one-time key lease")
+		}
+	}
+	return nil
+}
+
+// authenticate exchanges the configured credentials for a token.
+func (e *etcd) authenticate(ctx context.Context, req Request, client *http.Client, endpoint string) (string, error) {
+	p, err := FromConfig(*e.cfg.Auth.Password)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid etcd password provider")
+	}
+	password, err := p.Key(ctx, req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to retrieve etcd password")
+	}
+
+	in := map[string]string{"name": e.cfg.Auth.Username, "password": string(password)}
+	var out struct {
+		Token string `json:"token"`
+	}
+	if err := e.call(ctx, client, endpoint, "/v3/auth/authenticate", "", in, &out); err != nil {
+		return "", errors.Wrap(err, "etcd authentication failed")
+	}
+	if out.Token == "" {
+		return "", errors.Errorf("empty etcd token from %s", endpoint)
+	}
+	return out.Token, nil
+}
+
+// call performs a single gateway request.
+func (e *etcd) call(ctx context.Context, client *http.Client, endpoint string, path string, token string, in interface{}, out interface{}) error {
+	httpReq, _, err := jsonRequest(endpoint+path, "application/json", in)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		httpReq.Header.Set("Authorization", token)
+	}
+	return doJSON(ctx, client, httpReq, out)
+}
+
+func (e *etcd) httpClient(ctx context.Context, req Request) (*http.Client, error) {
+	tlsConfig, err := tlsClientConfig(ctx, req, e.cfg.CertificateAuthorities, e.cfg.ClientCertificate)
+	if err != nil {
+		return nil, err
+	}
+	timeout := defaultEtcdTimeout
+	if e.cfg.Timeout > 0 {
+		timeout = e.cfg.Timeout
+	}
+	client := &http.Client{
+		Transport: httpTransport(tlsConfig, 0),
+		Timeout:   time.Duration(timeout) * time.Second,
+	}
+	return client, nil
+}
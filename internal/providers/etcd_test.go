@@ -0,0 +1,266 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+// etcdStub is a minimal in-memory stand-in for the etcd v3 JSON gateway.
+type etcdStub struct {
+	mu       sync.Mutex
+	kvs      map[string]etcdKeyValue
+	revision int64
+	leases   map[int64][]string
+	password string
+}
+
+func newEtcdStub(password string) *etcdStub {
+	return &etcdStub{
+		kvs:      map[string]etcdKeyValue{},
+		leases:   map[int64][]string{},
+		password: password,
+	}
+}
+
+func (s *etcdStub) put(key string, value string, lease int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revision++
+	s.kvs[key] = etcdKeyValue{
+		Key:         base64.StdEncoding.EncodeToString([]byte(key)),
+		Value:       base64.StdEncoding.EncodeToString([]byte(value)),
+		ModRevision: strconv.FormatInt(s.revision, 10),
+		Lease:       strconv.FormatInt(lease, 10),
+	}
+	if lease != 0 {
+		s.leases[lease] = append(s.leases[lease], key)
+	}
+}
+
+func (s *etcdStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var in map[string]json.RawMessage
+	json.NewDecoder(r.Body).Decode(&in)
+	decodeKey := func(raw json.RawMessage) string {
+		var k string
+		json.Unmarshal(raw, &k)
+		b, _ := base64.StdEncoding.DecodeString(k)
+		return string(b)
+	}
+
+	if r.URL.Path == "/v3/auth/authenticate" {
+		var name, password string
+		json.Unmarshal(in["name"], &name)
+		json.Unmarshal(in["password"], &password)
+		if name != "root" || password != s.password {
+			http.Error(w, `{"error": "authentication failed"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "etcd-token"})
+		return
+	}
+	if s.password != "" && r.Header.Get("Authorization") != "etcd-token" {
+		http.Error(w, `{"error": "user name is empty"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		out := map[string]interface{}{}
+		if kv, ok := s.kvs[decodeKey(in["key"])]; ok {
+			out["kvs"] = []etcdKeyValue{kv}
+		}
+		json.NewEncoder(w).Encode(out)
+	case "/v3/kv/txn":
+		var txn struct {
+			Compare []struct {
+				Key         string `json:"key"`
+				ModRevision string `json:"mod_revision"`
+			}
+		}
+		json.Unmarshal(in["compare"], &txn.Compare)
+		raw, _ := json.Marshal(txn.Compare[0].Key)
+		key := decodeKey(raw)
+		kv, ok := s.kvs[key]
+		succeeded := ok && kv.ModRevision == txn.Compare[0].ModRevision
+		if succeeded {
+			delete(s.kvs, key)
+		}
+		json.NewEncoder(w).Encode(map[string]bool{"succeeded": succeeded})
+	case "/v3/lease/revoke":
+		var id string
+		json.Unmarshal(in["ID"], &id)
+		lease, _ := strconv.ParseInt(id, 10, 64)
+		for _, k := range s.leases[lease] {
+			delete(s.kvs, k)
+		}
+		delete(s.leases, lease)
+		w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEtcdKey(t *testing.T) {
+	stub := newEtcdStub("")
+	stub.put("/cryptagent/node-1", testKey, 0)
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		cfg    config.EtcdV1
+		expErr bool
+	}{
+		{config.EtcdV1{Endpoints: []string{ts.URL}, Key: "/cryptagent/node-1"}, false},
+		{config.EtcdV1{Endpoints: []string{down.URL, ts.URL}, Key: "/cryptagent/node-1"}, false},
+		{config.EtcdV1{Endpoints: []string{down.URL}, Key: "/cryptagent/node-1"}, true},
+		{config.EtcdV1{Endpoints: []string{ts.URL}, Key: "/cryptagent/node-2"}, true},
+	}
+
+	for i, tt := range tests {
+		p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderEtcdV1, Value: tt.cfg})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		key, err := p.Key(context.Background(), Request{})
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for case %d, got key %q", i, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q for case %d", err, i)
+		}
+		if string(key) != testKey {
+			t.Fatalf("expected key %q, got %q", testKey, key)
+		}
+	}
+}
+
+func TestEtcdHTTPClient(t *testing.T) {
+	e, err := newEtcd(config.EtcdV1{Endpoints: []string{"https://127.0.0.1:2379"}, Key: "/cryptagent/node-1", Timeout: 5})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	client, err := e.httpClient(context.Background(), Request{})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		t.Fatalf("expected a transport honouring proxy settings, got %#v", client.Transport)
+	}
+	if client.Timeout != 5*time.Second {
+		t.Fatalf("expected timeout 5s, got %s", client.Timeout)
+	}
+}
+
+func TestEtcdAuth(t *testing.T) {
+	stub := newEtcdStub("etcd-password")
+	stub.put("/cryptagent/node-1", testKey, 0)
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+
+	password := func(p string) *config.ProviderJSON {
+		return &config.ProviderJSON{Kind: config.ProviderContentV1, Value: config.ContentV1{Source: "data:," + p}}
+	}
+	for _, tt := range []struct {
+		auth   *config.EtcdV1Auth
+		expErr bool
+	}{
+		{&config.EtcdV1Auth{Username: "root", Password: password("etcd-password")}, false},
+		{&config.EtcdV1Auth{Username: "root", Password: password("wrong")}, true},
+		{nil, true},
+	} {
+		cfg := config.EtcdV1{Endpoints: []string{ts.URL}, Key: "/cryptagent/node-1", Auth: tt.auth}
+		p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderEtcdV1, Value: cfg})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		_, err = p.Key(context.Background(), Request{})
+		if tt.expErr && err == nil {
+			t.Fatalf("expected error for auth %+v", tt.auth)
+		}
+		if !tt.expErr && err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+}
+
+func TestEtcdOneTimeRead(t *testing.T) {
+	stub := newEtcdStub("")
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+	ctx := context.Background()
+
+	for _, lease := range []int64{0, 7587} {
+		stub.put("/cryptagent/node-1", testKey, lease)
+		cfg := config.EtcdV1{Endpoints: []string{ts.URL}, Key: "/cryptagent/node-1", OneTimeRead: true}
+		p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderEtcdV1, Value: cfg})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		c, ok := p.(Committer)
+		if !ok {
+			t.Fatalf("expected EtcdV1 to be a Committer")
+		}
+		if _, err := c.Key(ctx, Request{}); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		// Reading alone must not consume the key.
+		if _, err := c.Key(ctx, Request{}); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if err := c.Commit(ctx, Request{}); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if _, err := c.Key(ctx, Request{}); err == nil {
+			t.Fatalf("expected one-time key to be deleted (lease %d)", lease)
+		}
+		if len(stub.leases) != 0 {
+			t.Fatalf("expected lease %d to be revoked", lease)
+		}
+	}
+
+	// A key rewritten after being read is left alone.
+	stub.put("/cryptagent/node-1", testKey, 0)
+	cfg := config.EtcdV1{Endpoints: []string{ts.URL}, Key: "/cryptagent/node-1", OneTimeRead: true}
+	p, _ := FromConfig(config.ProviderJSON{Kind: config.ProviderEtcdV1, Value: cfg})
+	if _, err := p.Key(ctx, Request{}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	stub.put("/cryptagent/node-1", "rotated-key", 0)
+	if err := p.(Committer).Commit(ctx, Request{}); err == nil {
+		t.Fatalf("expected error committing a modified key")
+	}
+	if _, err := p.Key(ctx, Request{}); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	// execProtocolVersion is the version of the ExecV1 stdin/stdout protocol.
+	execProtocolVersion = 1
+	// defaultExecTimeout is the default runtime limit (in seconds) for ExecV1.
+	defaultExecTimeout = 30
+	// execPath is the PATH exposed to ExecV1 executables.
+	execPath = "/usr/sbin:/usr/bin:/sbin:/bin"
+	// execOutputGrace bounds the wait for output still held by processes
+	// which escaped the process group.
+	execOutputGrace = time.Second
+)
+
+// execProvider is the provider for ExecV1.
+type execProvider struct {
+	cfg     config.ExecV1
+	timeout time.Duration
+}
+
+func newExec(cfg config.ExecV1) (*execProvider, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultExecTimeout
+	}
+
+	p := &execProvider{
+		cfg:     cfg,
+		timeout: time.Duration(timeout) * time.Second,
+	}
+	return p, nil
+}
+
+// Key implements the Provider interface.
+func (p *execProvider) Key(ctx context.Context, req Request) ([]byte, error) {
+	in, err := json.Marshal(config.ExecV1Request{
+		Version:    execProtocolVersion,
+		Device:     req.Device,
+		VolumeName: req.VolumeName,
+		Keyslot:    req.Keyslot,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	cmd := exec.Command(p.cfg.Path, p.cfg.Args...)
+	cmd.Env = p.env()
+
+	stdout, stderr, runErr := runGroup(ctx, cmd, in)
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, errors.Errorf("%s timed out after %s", p.cfg.Path, p.timeout)
+	}
+
+	var resp config.ExecV1Response
+	if err := json.Unmarshal(stdout, &resp); err != nil {
+		if runErr != nil {
+			msg := errors.New(string(stderr))
+			return nil, errors.Wrap(msg, runErr.Error())
+		}
+		return nil, errors.Wrapf(err, "failed to decode response from %s", p.cfg.Path)
+	}
+	if resp.Error != nil {
+		return nil, errors.Errorf("%s failed: %s: %s", p.cfg.Path, resp.Error.Code, resp.Error.Message)
+	}
+	if runErr != nil {
+		return nil, errors.Wrapf(runErr, "%s failed", p.cfg.Path)
+	}
+	if resp.Key == "" {
+		return nil, errors.Errorf("empty key from %s", p.cfg.Path)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(resp.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode key from %s", p.cfg.Path)
+	}
+	return key, nil
+}
+
+// runGroup runs `cmd` in its own process group, with `in` as standard input,
+// and returns its standard output and error.
+//
+// The whole group is killed once the executable exits or `ctx` is done, so
+// that background children can neither outlive it nor hold its output open
+// past the deadline. For the same reason, cmd.Wait is not used: it also
+// waits for all writers of the output pipes to go away.
+func runGroup(ctx context.Context, cmd *exec.Cmd, in []byte) ([]byte, []byte, error) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	go func() {
+		stdin.Write(in)
+		stdin.Close()
+	}()
+	var stdout, stderr bytes.Buffer
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		io.Copy(&stdout, stdoutPipe)
+		readers.Done()
+	}()
+	go func() {
+		io.Copy(&stderr, stderrPipe)
+		readers.Done()
+	}()
+	exited := make(chan *os.ProcessState, 1)
+	go func() {
+		state, _ := cmd.Process.Wait()
+		exited <- state
+	}()
+
+	var state *os.ProcessState
+	select {
+	case state = <-exited:
+	case <-ctx.Done():
+	}
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	if state == nil {
+		state = <-exited
+	}
+
+	// Processes which moved to another group may still hold the pipes.
+	outputDone := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(outputDone)
+	}()
+	select {
+	case <-outputDone:
+	case <-time.After(execOutputGrace):
+		stdoutPipe.Close()
+		stderrPipe.Close()
+		<-outputDone
+	}
+
+	if state == nil {
+		return stdout.Bytes(), stderr.Bytes(), errors.New("failed to wait for process")
+	}
+	if !state.Success() {
+		return stdout.Bytes(), stderr.Bytes(), &exec.ExitError{ProcessState: state}
+	}
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
+
+// env returns the environment for the executable, which does not inherit
+// anything from cryptagent besides a default PATH.
+func (p *execProvider) env() []string {
+	env := []string{"PATH=" + execPath}
+	names := make([]string, 0, len(p.cfg.Env))
+	for k := range p.cfg.Env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		env = append(env, k+"="+p.cfg.Env[k])
+	}
+	return env
+}
@@ -0,0 +1,159 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+func writeScript(t *testing.T, dir string, name string, body string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExecKey(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "providers_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(testKey))
+	// The plugin only answers for the expected request, and checks that
+	// arguments and environment are passed through.
+	okScript := writeScript(t, tmpDir, "ok", `
+read req
+case "$req" in
+  *'"volumeName":"luks_vol"'*'"keyslot":2'*) ;;
+  *) echo '{"error":{"code":"BadRequest","message":"unexpected request"}}'; exit 1;;
+esac
+[ "$1" = "--profile" ] && [ "$GATEWAY" = "hsm" ] || exit 3
+echo '{"key":"`+encoded+`"}'
+`)
+	errScript := writeScript(t, tmpDir, "err", `
+echo '{"error":{"code":"Unavailable","message":"gateway down"}}'
+exit 1
+`)
+	garbageScript := writeScript(t, tmpDir, "garbage", `
+echo 'not json' ; echo 'crashed' >&2 ; exit 2
+`)
+	slowScript := writeScript(t, tmpDir, "slow", `
+exec sleep 10
+`)
+	// Background children inherit the output pipes, and must neither delay
+	// the answer nor the timeout.
+	forkScript := writeScript(t, tmpDir, "fork", `
+sleep 10 &
+echo '{"key":"`+encoded+`"}'
+`)
+	forkSlowScript := writeScript(t, tmpDir, "fork-slow", `
+sleep 10 &
+sleep 10
+`)
+
+	req := Request{
+		Device:     "/dev/loop0",
+		VolumeName: "luks_vol",
+		Keyslot:    2,
+	}
+	tests := []struct {
+		cfg    config.ExecV1
+		expErr string
+	}{
+		{
+			config.ExecV1{Path: okScript, Args: []string{"--profile"}, Env: map[string]string{"GATEWAY": "hsm"}},
+			"",
+		},
+		{
+			config.ExecV1{Path: errScript},
+			"Unavailable: gateway down",
+		},
+		{
+			config.ExecV1{Path: garbageScript},
+			"crashed",
+		},
+		{
+			config.ExecV1{Path: slowScript, Timeout: 1},
+			"timed out",
+		},
+		{
+			config.ExecV1{Path: forkScript, Timeout: 5},
+			"",
+		},
+		{
+			config.ExecV1{Path: forkSlowScript, Timeout: 1},
+			"timed out",
+		},
+	}
+
+	for _, tt := range tests {
+		p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderExecV1, Value: tt.cfg})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		start := time.Now()
+		key, err := p.Key(context.Background(), req)
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Fatalf("%s took %s, expected at most its timeout", tt.cfg.Path, elapsed)
+		}
+		if tt.expErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.expErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if string(key) != testKey {
+			t.Fatalf("expected key %q, got %q", testKey, key)
+		}
+	}
+}
+
+func TestExecConfig(t *testing.T) {
+	tests := []struct {
+		cfg    config.ExecV1
+		expErr bool
+	}{
+		{config.ExecV1{}, true},
+		{config.ExecV1{Path: "relative/plugin"}, true},
+		{config.ExecV1{Path: "/bin/plugin", Timeout: -1}, true},
+		{config.ExecV1{Path: "/bin/plugin", Timeout: config.MaxExecV1Timeout + 1}, true},
+		{config.ExecV1{Path: "/bin/plugin"}, false},
+	}
+
+	for _, tt := range tests {
+		_, err := newExec(tt.cfg)
+		if tt.expErr && err == nil {
+			t.Fatalf("expected error for %+v", tt.cfg)
+		}
+		if !tt.expErr && err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/internal/luks"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	gcpKmsEndpoint   = "https://cloudkms.googleapis.com"
+	gcpTokenEndpoint = "https://oauth2.googleapis.com/token"
+	gcpKmsScope      = "https://www.googleapis.com/auth/cloudkms"
+	// gcpAssertionLifetime is the validity of service account assertions.
+	gcpAssertionLifetime = time.Hour
+)
+
+// gcpServiceAccountKey is the relevant part of a service account JSON key.
+type gcpServiceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// gcpKms is the provider for GcpKmsV1.
+type gcpKms struct {
+	cfg config.GcpKmsV1
+}
+
+func newGcpKms(cfg config.GcpKmsV1) (*gcpKms, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &gcpKms{cfg: cfg}, nil
+}
+
+// Key implements the Provider interface.
+func (g *gcpKms) Key(ctx context.Context, req Request) ([]byte, error) {
+	if g.cfg.Ciphertext == "" {
+		return nil, errors.New("no ciphertext configured, keyslot not enrolled")
+	}
+	in := struct {
+		Ciphertext string `json:"ciphertext"`
+	}{g.cfg.Ciphertext}
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := g.call(ctx, req, "decrypt", in, &out); err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(out.Plaintext)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed kms plaintext")
+	}
+	if len(key) == 0 {
+		return nil, errors.New("empty kms plaintext")
+	}
+	return key, nil
+}
+
+// Enroll implements the Enroller interface.
+//
+// A new random key is encrypted with the primary version of the configured
+// key.
+func (g *gcpKms) Enroll(ctx context.Context, req Request) ([]byte, config.ProviderJSON, error) {
+	key, err := luks.GenerateKey()
+	if err != nil {
+		return nil, config.ProviderJSON{}, err
+	}
+	in := struct {
+		Plaintext string `json:"plaintext"`
+	}{base64.StdEncoding.EncodeToString(key)}
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := g.call(ctx, req, "encrypt", in, &out); err != nil {
+		return nil, config.ProviderJSON{}, err
+	}
+	if out.Ciphertext == "" {
+		return nil, config.ProviderJSON{}, errors.New("empty kms ciphertext")
+	}
+
+	cfg := g.cfg
+	cfg.Ciphertext = out.Ciphertext
+	pj := config.ProviderJSON{
+		Kind:  config.ProviderGcpKmsV1,
+		Value: cfg,
+	}
+	return key, pj, nil
+}
+
+// call invokes the cryptoKeys `method` on the configured key.
+func (g *gcpKms) call(ctx context.Context, req Request, method string, in interface{}, out interface{}) error {
+	token, err := g.token(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	endpoint := gcpKmsEndpoint
+	if g.cfg.Endpoint != "" {
+		endpoint = g.cfg.Endpoint
+	}
+	name := fmt.Sprintf("projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s",
+		url.PathEscape(g.cfg.Project), url.PathEscape(g.cfg.Location),
+		url.PathEscape(g.cfg.KeyRing), url.PathEscape(g.cfg.Key))
+	u := strings.TrimSuffix(endpoint, "/") + "/v1/" + name + ":" + method
+
+	httpReq, _, err := jsonRequest(u, "application/json", in)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	if err := doJSON(ctx, cloudClient, httpReq, out); err != nil {
+		return errors.Wrapf(err, "kms %s failed", method)
+	}
+	return nil
+}
+
+// token retrieves an access token for the service account key if configured,
+// or for the instance service account otherwise.
+func (g *gcpKms) token(ctx context.Context, req Request) (string, error) {
+	if g.cfg.ServiceAccountKey == "" {
+		return gceAccessToken(ctx, g.cfg.MetadataEndpoint)
+	}
+	sa, key, err := readServiceAccountKey(req.Roots, g.cfg.ServiceAccountKey)
+	if err != nil {
+		return "", err
+	}
+	tokenURI := sa.TokenURI
+	if tokenURI == "" {
+		tokenURI = gcpTokenEndpoint
+	}
+
+	now := time.Now()
+	assertion, err := signJWT(key, map[string]string{"kid": sa.PrivateKeyID}, map[string]interface{}{
+		"iss":   sa.ClientEmail,
+		"scope": gcpKmsScope,
+		"aud":   tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(gcpAssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	httpReq, err := http.NewRequest(http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tok oauthToken
+	if err := doJSON(ctx, cloudClient, httpReq, &tok); err != nil {
+		return "", errors.Wrap(err, "failed to get service account token")
+	}
+	if tok.AccessToken == "" {
+		return "", errors.New("empty service account token")
+	}
+	return tok.AccessToken, nil
+}
+
+// readServiceAccountKey parses an inline service account JSON key, or one
+// stored under `roots`.
+func readServiceAccountKey(roots common.Roots, s string) (gcpServiceAccountKey, *rsa.PrivateKey, error) {
+	var sa gcpServiceAccountKey
+	data := []byte(s)
+	if !strings.HasPrefix(strings.TrimSpace(s), "{") {
+		path, err := configPath(roots, s)
+		if err != nil {
+			return sa, nil, err
+		}
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return sa, nil, errors.Wrap(err, "failed to read service account key")
+		}
+	}
+	if err := json.Unmarshal(data, &sa); err != nil {
+		return sa, nil, errors.Wrap(err, "malformed service account key")
+	}
+	if sa.Type != "service_account" || sa.ClientEmail == "" {
+		return sa, nil, errors.Errorf("unsupported service account key type %q", sa.Type)
+	}
+
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return sa, nil, errors.New("failed to decode service account private key PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return sa, nil, errors.Wrap(err, "invalid service account private key")
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return sa, nil, errors.Errorf("unsupported service account key type %T, RSA required", parsed)
+	}
+	return sa, key, nil
+}
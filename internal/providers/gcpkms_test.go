@@ -0,0 +1,111 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+func TestGcpKmsServiceAccountKey(t *testing.T) {
+	key, _, keyPEM := newRSACert(t)
+	_, _, otherKeyPEM := newRSACert(t)
+	kms := newCloudStandIn(t, nil)
+	defer kms.Close()
+
+	var tokenURL string
+	oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+			http.Error(w, `{"error": "invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims struct{ Iss, Scope, Aud string }
+		json.Unmarshal(payload, &claims)
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig) != nil ||
+			claims.Iss != "unlock@p.iam.gserviceaccount.com" || claims.Scope != gcpKmsScope || claims.Aud != tokenURL {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": testAccessToken, "token_type": "Bearer", "expires_in": 3600})
+	}))
+	defer oauth.Close()
+	tokenURL = oauth.URL + "/token"
+
+	saKey := func(pemKey string) string {
+		b, _ := json.Marshal(map[string]string{
+			"type":           "service_account",
+			"client_email":   "unlock@p.iam.gserviceaccount.com",
+			"private_key_id": "0123abcd",
+			"private_key":    pemKey,
+			"token_uri":      tokenURL,
+		})
+		return string(b)
+	}
+
+	tests := []struct {
+		saKey  string
+		expErr bool
+	}{
+		{saKey(keyPEM), false},
+		{saKey(otherKeyPEM), true},
+		{saKey("not a key"), true},
+		{`{"type": "authorized_user"}`, true},
+		{"/etc/sa.json", true},
+	}
+
+	for i, tt := range tests {
+		cfg := config.GcpKmsV1{
+			Project:           "p",
+			Location:          "global",
+			KeyRing:           "ring",
+			Key:               "disk",
+			Ciphertext:        base64.StdEncoding.EncodeToString([]byte(testCiphertext)),
+			ServiceAccountKey: tt.saKey,
+			Endpoint:          kms.URL,
+		}
+		p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderGcpKmsV1, Value: cfg})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		out, err := p.Key(context.Background(), Request{})
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for case %d, got key %q", i, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q for case %d", err, i)
+		}
+		if string(out) != testKey {
+			t.Fatalf("expected key %q, got %q", testKey, out)
+		}
+	}
+}
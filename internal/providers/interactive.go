@@ -0,0 +1,265 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+	"unsafe"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultInteractiveTries is the default number of passphrase prompts.
+	defaultInteractiveTries = 3
+	// defaultInteractiveTTY is the default terminal to prompt on.
+	defaultInteractiveTTY = "/dev/console"
+	// plymouthSocket is the (abstract) socket of the Plymouth daemon.
+	plymouthSocket = "@/org/freedesktop/plymouthd"
+	// Plymouth protocol answers.
+	plymouthAck  = 0x06
+	plymouthNack = 0x15
+)
+
+// consoleLock serializes terminal prompts, as concurrent unlocks would
+// otherwise interleave their prompts and split the typed input.
+var consoleLock = make(chan struct{}, 1)
+
+// nativeEndian is the byte order of the host, which Plymouth uses for the
+// answer size.
+var nativeEndian = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// interactive is the provider for InteractiveV1.
+type interactive struct {
+	cfg   config.InteractiveV1
+	tries int
+	tty   string
+	// plymouthSocket is overridden in tests.
+	plymouthSocket string
+	// asked counts the prompts so far, to report mistyped passphrases.
+	asked int
+}
+
+func newInteractive(cfg config.InteractiveV1) (*interactive, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	i := &interactive{
+		cfg:            cfg,
+		tries:          defaultInteractiveTries,
+		tty:            defaultInteractiveTTY,
+		plymouthSocket: plymouthSocket,
+	}
+	if cfg.Tries > 0 {
+		i.tries = cfg.Tries
+	}
+	if cfg.TTY != "" {
+		i.tty = cfg.TTY
+	}
+	return i, nil
+}
+
+// Tries implements the Retrier interface.
+func (i *interactive) Tries() int {
+	return i.tries
+}
+
+// Key implements the Provider interface.
+func (i *interactive) Key(ctx context.Context, req Request) ([]byte, error) {
+	name := req.VolumeName
+	if name == "" {
+		name = req.Device
+	}
+	prompt := fmt.Sprintf("Please enter passphrase for disk %s", name)
+	if i.asked > 0 {
+		prompt = fmt.Sprintf("Wrong passphrase, try again (%d/%d). %s", i.asked+1, i.tries, prompt)
+	}
+	i.asked++
+
+	var pass []byte
+	conn, err := net.Dial("unix", i.plymouthSocket)
+	if err == nil {
+		defer conn.Close()
+		pass, err = askPlymouth(ctx, conn, prompt)
+	} else {
+		pass, err = askTTY(ctx, i.tty, prompt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(pass) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return pass, nil
+}
+
+// askPlymouth asks for a password with the Plymouth socket protocol, as
+// systemd does.
+func askPlymouth(ctx context.Context, conn net.Conn, prompt string) ([]byte, error) {
+	if len(prompt) > 254 {
+		prompt = prompt[:254]
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock pending reads.
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	packet := append([]byte{'*', 2, byte(len(prompt) + 1)}, prompt...)
+	if _, err := conn.Write(append(packet, 0)); err != nil {
+		return nil, errors.Wrap(err, "failed to send plymouth request")
+	}
+
+	var answer [5]byte
+	if _, err := io.ReadFull(conn, answer[:1]); err != nil {
+		return nil, errors.Wrap(err, "failed to read plymouth answer")
+	}
+	switch answer[0] {
+	case plymouthAck:
+	case plymouthNack:
+		return nil, errors.New("passphrase prompt cancelled")
+	default:
+		return nil, errors.Errorf("unexpected plymouth answer 0x%02x", answer[0])
+	}
+	if _, err := io.ReadFull(conn, answer[1:]); err != nil {
+		return nil, errors.Wrap(err, "failed to read plymouth answer")
+	}
+	size := nativeEndian.Uint32(answer[1:])
+	if size > maxContentSize {
+		return nil, errors.Errorf("plymouth answer exceeds %d bytes", maxContentSize)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, errors.Wrap(err, "failed to read plymouth answer")
+	}
+	// The answer is a list of NUL-terminated strings.
+	if n := bytes.IndexByte(buf, 0); n >= 0 {
+		buf = buf[:n]
+	}
+	return buf, nil
+}
+
+// askTTY asks for a password on the terminal at `path`, without echo. The
+// prompt is abandoned once `ctx` is done.
+func askTTY(ctx context.Context, path string, prompt string) ([]byte, error) {
+	select {
+	case consoleLock <- struct{}{}:
+		defer func() { <-consoleLock }()
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "passphrase prompt cancelled")
+	}
+
+	tty, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "no plymouth and failed to open terminal")
+	}
+	defer tty.Close()
+	// Fd() would switch the terminal to blocking mode, in which reads
+	// cannot be interrupted, thus ioctls go through the raw connection.
+	raw, err := tty.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var state *unix.Termios
+	ctlErr := raw.Control(func(fd uintptr) {
+		if state, err = unix.IoctlGetTermios(int(fd), unix.TCGETS); err != nil {
+			return
+		}
+		noEcho := *state
+		noEcho.Lflag &^= unix.ECHO
+		noEcho.Lflag |= unix.ICANON | unix.ISIG
+		noEcho.Iflag |= unix.ICRNL
+		err = unix.IoctlSetTermios(int(fd), unix.TCSETS, &noEcho)
+	})
+	if ctlErr != nil || err != nil {
+		return nil, errors.Errorf("no plymouth and %s is not a terminal", path)
+	}
+	defer raw.Control(func(fd uintptr) {
+		unix.IoctlSetTermios(int(fd), unix.TCSETS, state)
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock the pending read, or close the terminal if it
+			// does not support deadlines.
+			if tty.SetReadDeadline(time.Now()) != nil {
+				tty.Close()
+			}
+		case <-done:
+		}
+	}()
+
+	fmt.Fprintf(tty, "%s: ", prompt)
+	pass, err := readPasswordLine(tty)
+	fmt.Fprintln(tty)
+	if ctx.Err() != nil {
+		return nil, errors.Wrap(ctx.Err(), "passphrase prompt cancelled")
+	}
+	return pass, err
+}
+
+// readPasswordLine reads a line from a terminal in canonical mode.
+func readPasswordLine(r io.Reader) ([]byte, error) {
+	var buf [1]byte
+	var line []byte
+	for {
+		n, err := r.Read(buf[:])
+		if n > 0 {
+			switch buf[0] {
+			case '\n':
+				return line, nil
+			case '\r':
+			default:
+				if len(line) >= maxContentSize {
+					return nil, errors.Errorf("passphrase exceeds %d bytes", maxContentSize)
+				}
+				line = append(line, buf[0])
+			}
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"golang.org/x/sys/unix"
+)
+
+// servePlymouth answers each password request on `l` with the next entry
+// of `answers`, and sends the received prompts on the returned channel.
+func servePlymouth(l net.Listener, answers [][]byte) <-chan string {
+	prompts := make(chan string, len(answers))
+	go func() {
+		defer close(prompts)
+		for _, answer := range answers {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			head := make([]byte, 3)
+			if _, err := io.ReadFull(conn, head); err != nil || string(head[:2]) != "*\x02" {
+				conn.Close()
+				return
+			}
+			prompt := make([]byte, head[2])
+			io.ReadFull(conn, prompt)
+			prompts <- strings.TrimSuffix(string(prompt), "\x00")
+
+			if answer == nil {
+				conn.Write([]byte{plymouthNack})
+			} else {
+				out := []byte{plymouthAck, 0, 0, 0, 0}
+				nativeEndian.PutUint32(out[1:], uint32(len(answer)+1))
+				conn.Write(append(append(out, answer...), 0))
+			}
+			conn.Close()
+		}
+	}()
+	return prompts
+}
+
+func TestInteractivePlymouth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptagent-plymouth")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "plymouthd")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	defer l.Close()
+	prompts := servePlymouth(l, [][]byte{[]byte("typo"), []byte(testKey), nil})
+
+	p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderInteractiveV1, Value: config.InteractiveV1{}})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	i := p.(*interactive)
+	i.plymouthSocket = sock
+	if i.Tries() != defaultInteractiveTries {
+		t.Fatalf("expected %d tries, got %d", defaultInteractiveTries, i.Tries())
+	}
+
+	req := Request{Device: "/dev/sda2", VolumeName: "luks_root", Keyslot: 7}
+	for _, exp := range []string{"typo", testKey} {
+		key, err := i.Key(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if string(key) != exp {
+			t.Fatalf("expected key %q, got %q", exp, key)
+		}
+	}
+	if _, err := i.Key(context.Background(), req); err == nil {
+		t.Fatalf("expected error for cancelled prompt")
+	}
+
+	first, second := <-prompts, <-prompts
+	if first != "Please enter passphrase for disk luks_root" {
+		t.Fatalf("unexpected first prompt %q", first)
+	}
+	if !strings.HasPrefix(second, "Wrong passphrase") || !strings.HasSuffix(second, "luks_root") {
+		t.Fatalf("unexpected retry prompt %q", second)
+	}
+}
+
+func TestInteractiveNoTerminal(t *testing.T) {
+	cfg := config.InteractiveV1{Tries: 1, TTY: "/dev/null"}
+	p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderInteractiveV1, Value: cfg})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	i := p.(*interactive)
+	i.plymouthSocket = "@/coreos-cryptagent/test/no-plymouth"
+	if _, err := i.Key(context.Background(), Request{VolumeName: "luks_root"}); err == nil {
+		t.Fatalf("expected error without plymouth nor terminal")
+	}
+}
+
+// openPTY opens a pseudo-terminal, returning its master side and the path
+// of its slave side.
+func openPTY(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminal: %s", err)
+	}
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		t.Fatalf("unexpected error %q", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		t.Fatalf("unexpected error %q", err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestInteractiveTerminal(t *testing.T) {
+	master, slave := openPTY(t)
+	defer master.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go master.Write([]byte(testKey + "\r"))
+	pass, err := askTTY(ctx, slave, "Please enter passphrase")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if string(pass) != testKey {
+		t.Fatalf("expected passphrase %q, got %q", testKey, pass)
+	}
+
+	// Nobody types, the prompt must be abandoned with the context.
+	start := time.Now()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := askTTY(ctx, slave, "Please enter passphrase"); err == nil {
+		t.Fatalf("expected error for expired prompt")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("prompt outlived its context by %s", elapsed)
+	}
+
+	// Prompts are serialized, a pending one blocks the next.
+	consoleLock <- struct{}{}
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = askTTY(ctx, slave, "Please enter passphrase")
+	<-consoleLock
+	if err == nil {
+		t.Fatalf("expected error while another prompt is pending")
+	}
+}
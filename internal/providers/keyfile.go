@@ -0,0 +1,272 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultKeyFileTimeout is the default time (in seconds) to wait for
+	// the key file device to appear.
+	defaultKeyFileTimeout = 30
+	// keyFilePollInterval is the delay between checks for the device.
+	keyFilePollInterval = 250 * time.Millisecond
+	// keyFileMountFlags are the flags for temporary mounts of key devices.
+	keyFileMountFlags = syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+)
+
+// keyFile is the provider for KeyFileV1.
+type keyFile struct {
+	cfg     config.KeyFileV1
+	timeout time.Duration
+
+	// Host locations, overridden in tests.
+	diskDir     string
+	mountInfo   string
+	filesystems string
+	mountDir    string
+}
+
+func newKeyFile(cfg config.KeyFileV1) (*keyFile, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	timeout := defaultKeyFileTimeout
+	if cfg.Timeout > 0 {
+		timeout = cfg.Timeout
+	}
+	kf := &keyFile{
+		cfg:         cfg,
+		timeout:     time.Duration(timeout) * time.Second,
+		diskDir:     "/dev/disk",
+		mountInfo:   "/proc/self/mountinfo",
+		filesystems: "/proc/filesystems",
+		mountDir:    "/run/coreos-cryptagent",
+	}
+	return kf, nil
+}
+
+// Key implements the Provider interface.
+func (k *keyFile) Key(ctx context.Context, req Request) ([]byte, error) {
+	dev, err := k.waitDevice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if k.cfg.Path == "" {
+		return k.read(dev)
+	}
+
+	mnt, err := findMount(k.mountInfo, dev)
+	if err != nil {
+		return nil, err
+	}
+	if mnt == "" {
+		mnt, err = k.mount(dev)
+		if err != nil {
+			return nil, err
+		}
+		defer k.unmount(mnt)
+	}
+	// Cleaning the absolute path first ensures that it cannot escape the mountpoint.
+	return k.read(filepath.Join(mnt, filepath.Clean("/"+k.cfg.Path)))
+}
+
+// devicePath translates the configured device into a path under /dev.
+func (k *keyFile) devicePath() string {
+	dev := k.cfg.Device
+	if strings.HasPrefix(dev, "/") {
+		return dev
+	}
+	parts := strings.SplitN(dev, "=", 2)
+	// udev escapes slashes and whitespaces in symlink names.
+	value := strings.NewReplacer("/", `\x2f`, " ", `\x20`).Replace(parts[1])
+	return filepath.Join(k.diskDir, "by-"+strings.ToLower(parts[0]), value)
+}
+
+// waitDevice polls for the device node, until the configured timeout.
+func (k *keyFile) waitDevice(ctx context.Context) (string, error) {
+	path := k.devicePath()
+	deadline := time.Now().Add(k.timeout)
+	for {
+		dev, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return dev, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "failed to resolve %s", path)
+		}
+		if time.Now().After(deadline) {
+			return "", errors.Errorf("timed out waiting for device %s", k.cfg.Device)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(keyFilePollInterval):
+		}
+	}
+}
+
+// read returns the key at the configured offset and size of `path`.
+func (k *keyFile) read(path string) ([]byte, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	if _, err := fp.Seek(k.cfg.Offset, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "failed to seek %s", path)
+	}
+
+	limit := int64(maxContentSize + 1)
+	if k.cfg.Size > 0 && k.cfg.Size < limit {
+		limit = k.cfg.Size
+	}
+	key, err := ioutil.ReadAll(io.LimitReader(fp, limit))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	if len(key) > maxContentSize {
+		return nil, errors.Errorf("key file %s exceeds %d bytes", path, maxContentSize)
+	}
+	if k.cfg.Size > 0 && int64(len(key)) != k.cfg.Size {
+		return nil, errors.Errorf("key file %s is too short, expected %d bytes", path, k.cfg.Size)
+	}
+	if len(key) == 0 {
+		return nil, errors.Errorf("empty key file %s", path)
+	}
+	return key, nil
+}
+
+// mount mounts `dev` read-only on a temporary directory, trying all known
+// filesystem types unless one is configured.
+func (k *keyFile) mount(dev string) (string, error) {
+	fsTypes := []string{k.cfg.FsType}
+	if k.cfg.FsType == "" {
+		var err error
+		fsTypes, err = blockFilesystems(k.filesystems)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(k.mountDir, 0700); err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(k.mountDir, "keyfile-")
+	if err != nil {
+		return "", err
+	}
+	for _, fsType := range fsTypes {
+		if err := syscall.Mount(dev, dir, fsType, keyFileMountFlags, ""); err == nil {
+			return dir, nil
+		}
+	}
+	os.Remove(dir)
+	return "", errors.Errorf("failed to mount %s read-only (tried %s)", dev, strings.Join(fsTypes, ", "))
+}
+
+// unmount releases a temporary mount. Failures are only logged, as the key
+// has already been read.
+func (k *keyFile) unmount(dir string) {
+	if err := syscall.Unmount(dir, 0); err != nil {
+		logrus.Warnf("failed to unmount %s: %s", dir, err)
+		return
+	}
+	os.Remove(dir)
+}
+
+// findMount returns the mountpoint of `dev` from a mountinfo file, or an
+// empty string if it is not mounted.
+func findMount(mountInfo string, dev string) (string, error) {
+	fp, err := os.Open(mountInfo)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		// See proc(5), optional fields end with a single "-".
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+3 {
+			continue
+		}
+		source, err := filepath.EvalSymlinks(unescapeMountInfo(fields[sep+2]))
+		if err == nil && source == dev {
+			return unescapeMountInfo(fields[4]), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// unescapeMountInfo decodes the octal escapes (e.g. `\040`) of mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(v))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// blockFilesystems lists the filesystem types requiring a block device, from
+// /proc/filesystems.
+func blockFilesystems(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fsTypes := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 1 {
+			fsTypes = append(fsTypes, fields[0])
+		}
+	}
+	if len(fsTypes) == 0 {
+		return nil, errors.Errorf("no block filesystems in %s", path)
+	}
+	return fsTypes, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+// newTestKeyFile returns a KeyFileV1 provider looking up devices under a
+// temporary `dir`, where `sdb1` is labeled "KEYS".
+func newTestKeyFile(t *testing.T, dir string, cfg config.KeyFileV1) *keyFile {
+	p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderKeyFileV1, Value: cfg})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	kf := p.(*keyFile)
+	kf.diskDir = filepath.Join(dir, "disk")
+	kf.mountInfo = filepath.Join(dir, "mountinfo")
+	kf.mountDir = filepath.Join(dir, "run")
+	kf.timeout = 2 * time.Second
+	return kf
+}
+
+func TestKeyFileRaw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptagent-keyfile")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "disk", "by-label"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "sdb1"), []byte("0123456789abcdef"), 0600); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	os.Symlink("../../sdb1", filepath.Join(dir, "disk", "by-label", "KEYS"))
+
+	tests := []struct {
+		offset int64
+		size   int64
+		exp    string
+		expErr bool
+	}{
+		{0, 4, "0123", false},
+		{10, 6, "abcdef", false},
+		{10, 7, "", true},
+		{20, 1, "", true},
+	}
+
+	for _, tt := range tests {
+		cfg := config.KeyFileV1{Device: "LABEL=KEYS", Offset: tt.offset, Size: tt.size}
+		key, err := newTestKeyFile(t, dir, cfg).Key(context.Background(), Request{})
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for offset %d size %d", tt.offset, tt.size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if string(key) != tt.exp {
+			t.Fatalf("expected key %q, got %q", tt.exp, key)
+		}
+	}
+}
+
+func TestKeyFileMounted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptagent-keyfile")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "disk", "by-uuid"), 0755)
+	os.MkdirAll(filepath.Join(dir, "mnt point", "luks"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sdb1"), []byte{}, 0600)
+	os.Symlink("../../sdb1", filepath.Join(dir, "disk", "by-uuid", "1234-ABCD"))
+	if err := ioutil.WriteFile(filepath.Join(dir, "mnt point", "luks", "root.key"), []byte(testKey), 0600); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	escaped := strings.Replace(dir, " ", `\040`, -1)
+	mountInfo := strings.Join([]string{
+		"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw",
+		"45 22 8:17 / " + escaped + `/mnt\040point rw,relatime shared:30 - vfat ` + escaped + "/sdb1 rw",
+		"",
+	}, "\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "mountinfo"), []byte(mountInfo), 0600); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	cfg := config.KeyFileV1{Device: "UUID=1234-ABCD", Path: "/luks/../luks/root.key"}
+	key, err := newTestKeyFile(t, dir, cfg).Key(context.Background(), Request{})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if string(key) != testKey {
+		t.Fatalf("expected key %q, got %q", testKey, key)
+	}
+}
+
+func TestKeyFileWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cryptagent-keyfile")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "disk", "by-partlabel"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sdb2"), []byte(testKey), 0600)
+
+	cfg := config.KeyFileV1{Device: "PARTLABEL=usb keys", Size: int64(len(testKey))}
+	kf := newTestKeyFile(t, dir, cfg)
+	kf.timeout = 100 * time.Millisecond
+	if _, err := kf.Key(context.Background(), Request{}); err == nil {
+		t.Fatalf("expected timeout error")
+	}
+
+	kf.timeout = 5 * time.Second
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		os.Symlink("../../sdb2", filepath.Join(dir, "disk", "by-partlabel", `usb\x20keys`))
+	}()
+	key, err := kf.Key(context.Background(), Request{})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if string(key) != testKey {
+		t.Fatalf("expected key %q, got %q", testKey, key)
+	}
+}
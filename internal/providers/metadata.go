@@ -0,0 +1,225 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	awsMetadataEndpoint   = "http://169.254.169.254"
+	gceMetadataEndpoint   = "http://metadata.google.internal"
+	azureMetadataEndpoint = "http://169.254.169.254"
+
+	// awsIMDSTokenTTL is the lifetime (in seconds) of IMDSv2 session tokens.
+	awsIMDSTokenTTL = "300"
+	// metadataTimeout bounds every single request to a metadata service.
+	metadataTimeout = 10 * time.Second
+	// cloudTimeout bounds every single request to a cloud KMS.
+	cloudTimeout = 30 * time.Second
+	// maxResponseSize is the maximum accepted size for metadata and KMS
+	// responses.
+	maxResponseSize = 1 << 20
+)
+
+// metadataClient is used for link-local metadata services, which must never
+// be reached through a proxy.
+var metadataClient = &http.Client{
+	Transport: &http.Transport{Proxy: nil},
+	Timeout:   metadataTimeout,
+}
+
+// cloudClient is used for cloud KMS APIs.
+var cloudClient = &http.Client{
+	Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+	Timeout:   cloudTimeout,
+}
+
+// doRequest performs an HTTP request and returns the body of a 200 response.
+func doRequest(ctx context.Context, client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read response from %s", req.URL.Host)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := strings.TrimSpace(string(body))
+		if len(msg) > 256 {
+			msg = msg[:256]
+		}
+		return nil, errors.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, msg)
+	}
+	return body, nil
+}
+
+// doJSON performs an HTTP request and decodes a JSON response into `out`.
+func doJSON(ctx context.Context, client *http.Client, req *http.Request, out interface{}) error {
+	body, err := doRequest(ctx, client, req)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return errors.Wrapf(err, "malformed response from %s", req.URL.Host)
+	}
+	return nil
+}
+
+// awsInstanceCredentials retrieves the instance profile credentials from the
+// EC2 metadata service, using an IMDSv2 session token.
+func awsInstanceCredentials(ctx context.Context, endpoint string) (awsCredentials, error) {
+	if endpoint == "" {
+		endpoint = awsMetadataEndpoint
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	tokenReq, err := http.NewRequest(http.MethodPut, endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", awsIMDSTokenTTL)
+	token, err := doRequest(ctx, metadataClient, tokenReq)
+	if err != nil {
+		return awsCredentials{}, errors.Wrap(err, "failed to get IMDS session token")
+	}
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, endpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return req, nil
+	}
+
+	const credsPath = "/latest/meta-data/iam/security-credentials/"
+	rolesReq, err := get(credsPath)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	roles, err := doRequest(ctx, metadataClient, rolesReq)
+	if err != nil {
+		return awsCredentials{}, errors.Wrap(err, "failed to get instance profile")
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, errors.New("no instance profile attached")
+	}
+
+	credsReq, err := get(credsPath + url.PathEscape(role))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var creds struct {
+		Code            string `json:"Code"`
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+	}
+	if err := doJSON(ctx, metadataClient, credsReq, &creds); err != nil {
+		return awsCredentials{}, errors.Wrap(err, "failed to get instance credentials")
+	}
+	if creds.Code != "Success" {
+		return awsCredentials{}, errors.Errorf("instance credentials unavailable: %s", creds.Code)
+	}
+	return awsCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+	}, nil
+}
+
+// oauthToken is the common part of OAuth2 token responses.
+type oauthToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+}
+
+// gceAccessToken retrieves an access token for the default service account
+// from the GCE metadata server.
+func gceAccessToken(ctx context.Context, endpoint string) (string, error) {
+	if endpoint == "" {
+		endpoint = gceMetadataEndpoint
+	}
+	u := strings.TrimSuffix(endpoint, "/") + "/computeMetadata/v1/instance/service-accounts/default/token"
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var tok oauthToken
+	if err := doJSON(ctx, metadataClient, req, &tok); err != nil {
+		return "", errors.Wrap(err, "failed to get service account token")
+	}
+	if tok.AccessToken == "" {
+		return "", errors.New("empty service account token")
+	}
+	return tok.AccessToken, nil
+}
+
+// azureManagedIdentityToken retrieves an access token for `resource` from
+// the Azure instance metadata service, for the user-assigned identity
+// `clientID` or the system-assigned one if empty.
+func azureManagedIdentityToken(ctx context.Context, endpoint string, resource string, clientID string) (string, error) {
+	if endpoint == "" {
+		endpoint = azureMetadataEndpoint
+	}
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", resource)
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	u := strings.TrimSuffix(endpoint, "/") + "/metadata/identity/oauth2/token?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	var tok oauthToken
+	if err := doJSON(ctx, metadataClient, req, &tok); err != nil {
+		return "", errors.Wrap(err, "failed to get managed identity token")
+	}
+	if tok.AccessToken == "" {
+		return "", errors.New("empty managed identity token")
+	}
+	return tok.AccessToken, nil
+}
+
+// jsonRequest builds a POST request with a JSON body.
+func jsonRequest(u string, contentType string, in interface{}) (*http.Request, []byte, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return req, body, nil
+}
@@ -0,0 +1,421 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+const (
+	testIMDSToken   = "imds-session-token"
+	testAccessToken = "cloud-access-token"
+	testCiphertext  = "wrapped-key"
+)
+
+// newCloudStandIn serves the AWS, GCE and Azure metadata endpoints together
+// with the matching KMS decrypt endpoints. Azure AD client assertions are
+// verified against `aadKey`.
+func newCloudStandIn(t *testing.T, aadKey *rsa.PublicKey) *httptest.Server {
+	mux := http.NewServeMux()
+
+	// AWS IMDSv2 and KMS.
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			http.Error(w, "missing ttl", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(testIMDSToken))
+	})
+	mux.HandleFunc("/latest/meta-data/iam/security-credentials/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-aws-ec2-metadata-token") != testIMDSToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") {
+			w.Write([]byte("node-role\n"))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"Code":            "Success",
+			"AccessKeyId":     "AKIDINSTANCE",
+			"SecretAccessKey": "instance-secret",
+			"Token":           "instance-session",
+		})
+	})
+	mux.HandleFunc("/kms/", func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		target := r.Header.Get("X-Amz-Target")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDINSTANCE/") || !strings.Contains(auth, "/kms/aws4_request") ||
+			r.Header.Get("X-Amz-Security-Token") != "instance-session" || (target != "TrentService.Decrypt" && target != "TrentService.Encrypt") {
+			http.Error(w, `{"__type": "AccessDeniedException"}`, http.StatusBadRequest)
+			return
+		}
+		var in struct{ CiphertextBlob, KeyId, Plaintext string }
+		json.NewDecoder(r.Body).Decode(&in)
+		if target == "TrentService.Encrypt" {
+			plain, err := base64.StdEncoding.DecodeString(in.Plaintext)
+			if err != nil || in.KeyId != "alias/disk" {
+				http.Error(w, `{"__type": "NotFoundException"}`, http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"KeyId": in.KeyId, "CiphertextBlob": base64.StdEncoding.EncodeToString(standInWrap(plain))})
+			return
+		}
+		blob, _ := base64.StdEncoding.DecodeString(in.CiphertextBlob)
+		plain, ok := standInUnwrap(blob)
+		if !ok {
+			http.Error(w, `{"__type": "InvalidCiphertextException"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"Plaintext": base64.StdEncoding.EncodeToString(plain)})
+	})
+
+	// GCE metadata server and Cloud KMS.
+	mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/default/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing flavor", http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": testAccessToken, "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/v1/projects/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testAccessToken {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		var in struct{ Ciphertext, Plaintext string }
+		json.NewDecoder(r.Body).Decode(&in)
+		switch r.URL.Path {
+		case "/v1/projects/p/locations/global/keyRings/ring/cryptoKeys/disk:decrypt":
+			blob, _ := base64.StdEncoding.DecodeString(in.Ciphertext)
+			plain, ok := standInUnwrap(blob)
+			if !ok {
+				http.Error(w, "invalid ciphertext", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plain)})
+		case "/v1/projects/p/locations/global/keyRings/ring/cryptoKeys/disk:encrypt":
+			plain, _ := base64.StdEncoding.DecodeString(in.Plaintext)
+			json.NewEncoder(w).Encode(map[string]string{"ciphertext": base64.StdEncoding.EncodeToString(standInWrap(plain))})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	// Azure IMDS and Key Vault.
+	mux.HandleFunc("/metadata/identity/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != azureVaultResource {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if id := r.URL.Query().Get("client_id"); id != "" && id != "user-assigned" {
+			http.Error(w, "identity not found", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": testAccessToken, "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/tenant/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "client_credentials" || r.PostForm.Get("resource") != azureVaultResource ||
+			r.PostForm.Get("client_id") != "app" {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case r.PostForm.Get("client_secret") == "app-password":
+		case verifyAssertion(r.PostForm.Get("client_assertion"), aadKey, "http://"+r.Host+r.URL.Path):
+		default:
+			http.Error(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": testAccessToken, "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/keys/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testAccessToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var in struct{ Alg, Value string }
+		json.Unmarshal(body, &in)
+		value, err := base64.RawURLEncoding.DecodeString(in.Value)
+		if err != nil || in.Alg != "RSA-OAEP" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		kid := "http://" + r.Host + "/keys/disk/v1"
+		switch r.URL.Path {
+		case "/keys/disk/v1/decrypt":
+			plain, ok := standInUnwrap(value)
+			if !ok {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"kid": kid, "value": base64.RawURLEncoding.EncodeToString(plain)})
+		case "/keys/disk/encrypt", "/keys/disk/v1/encrypt":
+			json.NewEncoder(w).Encode(map[string]string{"kid": kid, "value": base64.RawURLEncoding.EncodeToString(standInWrap(value))})
+		default:
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}
+	})
+
+	return httptest.NewServer(mux)
+}
+
+// standInWrap "encrypts" `plain` for the KMS stand-ins, reversibly.
+func standInWrap(plain []byte) []byte {
+	return append([]byte("wrapped:"), plain...)
+}
+
+// standInUnwrap reverses standInWrap, and maps testCiphertext to testKey.
+func standInUnwrap(ciphertext []byte) ([]byte, bool) {
+	if string(ciphertext) == testCiphertext {
+		return []byte(testKey), true
+	}
+	if !bytes.HasPrefix(ciphertext, []byte("wrapped:")) {
+		return nil, false
+	}
+	return ciphertext[len("wrapped:"):], true
+}
+
+// verifyAssertion checks the signature and audience of a client assertion.
+func verifyAssertion(assertion string, key *rsa.PublicKey, audience string) bool {
+	parts := strings.Split(assertion, ".")
+	if key == nil || len(parts) != 3 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+		return false
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims struct {
+		Aud string `json:"aud"`
+		Iss string `json:"iss"`
+	}
+	json.Unmarshal(payload, &claims)
+	return claims.Aud == audience && claims.Iss == "app"
+}
+
+func TestCloudProviders(t *testing.T) {
+	ts := newCloudStandIn(t, nil)
+	defer ts.Close()
+	std := base64.StdEncoding.EncodeToString([]byte(testCiphertext))
+	urlsafe := base64.RawURLEncoding.EncodeToString([]byte(testCiphertext))
+	mi := &config.AzureVaultV1ManagedIdentityAuth{MetadataEndpoint: ts.URL}
+
+	tests := []struct {
+		pj     config.ProviderJSON
+		expErr bool
+	}{
+		{
+			config.ProviderJSON{Kind: config.ProviderAwsKmsV1, Value: config.AwsKmsV1{
+				Region: "us-east-1", Ciphertext: std, Endpoint: ts.URL + "/kms/", MetadataEndpoint: ts.URL,
+			}},
+			false,
+		},
+		{
+			config.ProviderJSON{Kind: config.ProviderAwsKmsV1, Value: config.AwsKmsV1{
+				Region: "us-east-1", Ciphertext: base64.StdEncoding.EncodeToString([]byte("other")), Endpoint: ts.URL + "/kms/", MetadataEndpoint: ts.URL,
+			}},
+			true,
+		},
+		{
+			config.ProviderJSON{Kind: config.ProviderGcpKmsV1, Value: config.GcpKmsV1{
+				Project: "p", Location: "global", KeyRing: "ring", Key: "disk", Ciphertext: std, Endpoint: ts.URL, MetadataEndpoint: ts.URL,
+			}},
+			false,
+		},
+		{
+			config.ProviderJSON{Kind: config.ProviderGcpKmsV1, Value: config.GcpKmsV1{
+				Project: "p", Location: "global", KeyRing: "ring", Key: "other", Ciphertext: std, Endpoint: ts.URL, MetadataEndpoint: ts.URL,
+			}},
+			true,
+		},
+		{
+			config.ProviderJSON{Kind: config.ProviderAzureVaultV1, Value: config.AzureVaultV1{
+				BaseURL: ts.URL, EncryptionAlgorithm: "RSA-OAEP", KeyName: "disk", KeyVersion: "v1", Ciphertext: urlsafe, ManagedIdentityAuth: mi,
+			}},
+			false,
+		},
+		{
+			config.ProviderJSON{Kind: config.ProviderAzureVaultV1, Value: config.AzureVaultV1{
+				BaseURL: ts.URL, EncryptionAlgorithm: "RSA-OAEP-256", KeyName: "disk", KeyVersion: "v1", Ciphertext: urlsafe, ManagedIdentityAuth: mi,
+			}},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		p, err := FromConfig(tt.pj)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		key, err := p.Key(context.Background(), Request{})
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for %s, got key %q", tt.pj.Kind, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q for %s", err, tt.pj.Kind)
+		}
+		if string(key) != testKey {
+			t.Fatalf("expected key %q, got %q", testKey, key)
+		}
+	}
+}
+
+func TestCloudEnroll(t *testing.T) {
+	ts := newCloudStandIn(t, nil)
+	defer ts.Close()
+	mi := &config.AzureVaultV1ManagedIdentityAuth{MetadataEndpoint: ts.URL}
+
+	tests := []struct {
+		pj     config.ProviderJSON
+		expErr bool
+	}{
+		{
+			config.ProviderJSON{Kind: config.ProviderAwsKmsV1, Value: config.AwsKmsV1{
+				Region: "us-east-1", KeyID: "alias/disk", Endpoint: ts.URL + "/kms/", MetadataEndpoint: ts.URL,
+			}},
+			false,
+		},
+		{
+			config.ProviderJSON{Kind: config.ProviderAwsKmsV1, Value: config.AwsKmsV1{
+				Region: "us-east-1", Endpoint: ts.URL + "/kms/", MetadataEndpoint: ts.URL,
+			}},
+			true,
+		},
+		{
+			config.ProviderJSON{Kind: config.ProviderGcpKmsV1, Value: config.GcpKmsV1{
+				Project: "p", Location: "global", KeyRing: "ring", Key: "disk", Endpoint: ts.URL, MetadataEndpoint: ts.URL,
+			}},
+			false,
+		},
+		{
+			config.ProviderJSON{Kind: config.ProviderAzureVaultV1, Value: config.AzureVaultV1{
+				BaseURL: ts.URL, EncryptionAlgorithm: "RSA-OAEP", KeyName: "disk", ManagedIdentityAuth: mi,
+			}},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		p, err := FromConfig(tt.pj)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if _, err := p.Key(context.Background(), Request{}); err == nil {
+			t.Fatalf("expected error for %s without ciphertext", tt.pj.Kind)
+		}
+		key, pj, err := p.(Enroller).Enroll(context.Background(), Request{})
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for %s", tt.pj.Kind)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q for %s", err, tt.pj.Kind)
+		}
+		if len(key) == 0 || string(key) == testKey {
+			t.Fatalf("expected a new random key, got %q", key)
+		}
+
+		// The enrolled configuration must unwrap the same key.
+		p, err = FromConfig(pj)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		out, err := p.Key(context.Background(), Request{})
+		if err != nil {
+			t.Fatalf("unexpected error %q for %s", err, tt.pj.Kind)
+		}
+		if !bytes.Equal(out, key) {
+			t.Fatalf("expected key %q, got %q", key, out)
+		}
+	}
+}
+
+func TestMetadataTokens(t *testing.T) {
+	ts := newCloudStandIn(t, nil)
+	defer ts.Close()
+	ctx := context.Background()
+
+	creds, err := awsInstanceCredentials(ctx, ts.URL)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if creds.AccessKeyID != "AKIDINSTANCE" || creds.SecretAccessKey != "instance-secret" || creds.SessionToken != "instance-session" {
+		t.Fatalf("unexpected instance credentials %+v", creds)
+	}
+
+	tok, err := gceAccessToken(ctx, ts.URL)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if tok != testAccessToken {
+		t.Fatalf("expected token %q, got %q", testAccessToken, tok)
+	}
+
+	for _, clientID := range []string{"", "user-assigned"} {
+		tok, err = azureManagedIdentityToken(ctx, ts.URL, azureVaultResource, clientID)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if tok != testAccessToken {
+			t.Fatalf("expected token %q, got %q", testAccessToken, tok)
+		}
+	}
+	if _, err := azureManagedIdentityToken(ctx, ts.URL, azureVaultResource, "unknown"); err == nil {
+		t.Fatalf("expected error for unknown identity")
+	}
+
+	if _, err := gceAccessToken(ctx, ts.URL+"/missing"); err == nil {
+		t.Fatalf("expected error for unknown metadata endpoint")
+	}
+}
+
+func TestAwsInstanceCredentialsWithoutRole(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			w.Write([]byte(testIMDSToken))
+		}
+	}))
+	defer ts.Close()
+
+	if _, err := awsInstanceCredentials(context.Background(), ts.URL); err == nil {
+		t.Fatalf("expected error without instance profile")
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+// +build cgo
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"sync"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/miekg/pkcs11"
+	"github.com/pkg/errors"
+)
+
+// pkcs11Mu serializes all module accesses, as modules are process-wide.
+var pkcs11Mu sync.Mutex
+
+// pkcs11Module is the subset of a PKCS#11 module used by the provider.
+type pkcs11Module interface {
+	Initialize() error
+	Finalize() error
+	Destroy()
+	GetSlotList(tokenPresent bool) ([]uint, error)
+	GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error)
+	OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error)
+	CloseSession(sh pkcs11.SessionHandle) error
+	Login(sh pkcs11.SessionHandle, userType uint, pin string) error
+	Logout(sh pkcs11.SessionHandle) error
+	FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error
+	FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error)
+	FindObjectsFinal(sh pkcs11.SessionHandle) error
+	UnwrapKey(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, unwrappingKey pkcs11.ObjectHandle, wrappedKey []byte, a []*pkcs11.Attribute) (pkcs11.ObjectHandle, error)
+	GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error)
+	DestroyObject(sh pkcs11.SessionHandle, oh pkcs11.ObjectHandle) error
+}
+
+// loadPkcs11Module loads a module from its path.
+func loadPkcs11Module(path string) (pkcs11Module, error) {
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return nil, errors.Errorf("failed to load module %s", path)
+	}
+	return ctx, nil
+}
+
+// pkcs11Provider is the provider for Pkcs11V1.
+type pkcs11Provider struct {
+	cfg  config.Pkcs11V1
+	load func(path string) (pkcs11Module, error)
+}
+
+func newPkcs11(cfg config.Pkcs11V1) (*pkcs11Provider, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &pkcs11Provider{cfg: cfg, load: loadPkcs11Module}, nil
+}
+
+// unwrapMechanism returns the RSA mechanism for the configured algorithm.
+func unwrapMechanism(name string) (*pkcs11.Mechanism, error) {
+	switch name {
+	case "RSA-OAEP":
+		params := pkcs11.NewOAEPParams(pkcs11.CKM_SHA_1, pkcs11.CKG_MGF1_SHA1, pkcs11.CKZ_DATA_SPECIFIED, nil)
+		return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params), nil
+	case "RSA-OAEP-256":
+		params := pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKZ_DATA_SPECIFIED, nil)
+		return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params), nil
+	case "RSA1_5":
+		return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), nil
+	default:
+		return nil, errors.Errorf("unsupported mechanism %q", name)
+	}
+}
+
+// Key implements the Provider interface.
+func (p *pkcs11Provider) Key(ctx context.Context, req Request) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(p.cfg.Ciphertext)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed ciphertext")
+	}
+	mech, err := unwrapMechanism(p.cfg.Mechanism)
+	if err != nil {
+		return nil, err
+	}
+	pinProvider, err := FromConfig(*p.cfg.Pin)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid pin provider")
+	}
+	pin, err := pinProvider.Key(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve pin")
+	}
+	pin = bytes.TrimRight(pin, "\r\n")
+
+	pkcs11Mu.Lock()
+	defer pkcs11Mu.Unlock()
+
+	m, err := p.load(p.cfg.Module)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Destroy()
+
+	switch err := m.Initialize(); err {
+	case nil:
+		defer m.Finalize()
+	case pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED):
+		// The module is shared with another user in the same process.
+	default:
+		return nil, errors.Wrap(err, "C_Initialize failed")
+	}
+
+	slot, err := findTokenSlot(m, p.cfg.TokenLabel)
+	if err != nil {
+		return nil, err
+	}
+	session, err := m.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, errors.Wrap(err, "C_OpenSession failed")
+	}
+	defer m.CloseSession(session)
+
+	switch err := m.Login(session, pkcs11.CKU_USER, string(pin)); err {
+	case nil:
+		defer m.Logout(session)
+	case pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN):
+	default:
+		return nil, errors.Wrap(err, "C_Login failed")
+	}
+
+	key, err := findPrivateKey(m, session, p.cfg.KeyLabel)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapSecret(m, session, mech, key, ciphertext)
+}
+
+// findTokenSlot returns the slot of the token labeled `label`.
+func findTokenSlot(m pkcs11Module, label string) (uint, error) {
+	slots, err := m.GetSlotList(true)
+	if err != nil {
+		return 0, errors.Wrap(err, "C_GetSlotList failed")
+	}
+	for _, slot := range slots {
+		info, err := m.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if info.Label == label {
+			return slot, nil
+		}
+	}
+	return 0, errors.Errorf("token %q not found", label)
+}
+
+// findPrivateKey returns the only private key labeled `label`.
+func findPrivateKey(m pkcs11Module, session pkcs11.SessionHandle, label string) (pkcs11.ObjectHandle, error) {
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := m.FindObjectsInit(session, tmpl); err != nil {
+		return 0, errors.Wrap(err, "C_FindObjectsInit failed")
+	}
+	handles, _, err := m.FindObjects(session, 2)
+	m.FindObjectsFinal(session)
+	if err != nil {
+		return 0, errors.Wrap(err, "C_FindObjects failed")
+	}
+	switch len(handles) {
+	case 0:
+		return 0, errors.Errorf("private key %q not found", label)
+	case 1:
+		return handles[0], nil
+	default:
+		return 0, errors.Errorf("multiple private keys labeled %q", label)
+	}
+}
+
+// unwrapSecret unwraps `wrapped` into a session-only generic secret, whose
+// value is read back and then destroyed.
+func unwrapSecret(m pkcs11Module, session pkcs11.SessionHandle, mech *pkcs11.Mechanism, key pkcs11.ObjectHandle, wrapped []byte) ([]byte, error) {
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+	}
+	secret, err := m.UnwrapKey(session, []*pkcs11.Mechanism{mech}, key, wrapped, tmpl)
+	if err != nil {
+		return nil, errors.Wrap(err, "C_UnwrapKey failed")
+	}
+	defer m.DestroyObject(session, secret)
+
+	attrs, err := m.GetAttributeValue(session, secret, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)})
+	if err != nil {
+		return nil, errors.Wrap(err, "C_GetAttributeValue failed")
+	}
+	if len(attrs) != 1 || len(attrs[0].Value) == 0 {
+		return nil, errors.New("empty unwrapped key")
+	}
+	return attrs[0].Value, nil
+}
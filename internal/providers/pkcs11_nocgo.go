@@ -0,0 +1,31 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !cgo
+// +build !cgo
+
+package providers
+
+import (
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// newPkcs11 fails, as loading PKCS#11 modules requires cgo.
+func newPkcs11(cfg config.Pkcs11V1) (Provider, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("Pkcs11V1 is not supported by this build (cgo disabled)")
+}
@@ -0,0 +1,302 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+// +build cgo
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/miekg/pkcs11"
+)
+
+func pkcs11Config(module string, token string, pin string, key string, mech string, ciphertext []byte) config.ProviderJSON {
+	pinSource := config.ContentV1{Source: "data:," + pin}
+	return config.ProviderJSON{
+		Kind: config.ProviderPkcs11V1,
+		Value: config.Pkcs11V1{
+			Module:     module,
+			TokenLabel: token,
+			Pin:        &config.ProviderJSON{Kind: config.ProviderContentV1, Value: pinSource},
+			KeyLabel:   key,
+			Mechanism:  mech,
+			Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+		},
+	}
+}
+
+func TestPkcs11InvalidModule(t *testing.T) {
+	for _, module := range []string{"/nonexistent/libpkcs11.so", "/proc/self/exe"} {
+		p, err := FromConfig(pkcs11Config(module, "token", "1234", "key", "RSA-OAEP", []byte("x")))
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if _, err := p.Key(context.Background(), Request{}); err == nil {
+			t.Fatalf("expected error loading %s", module)
+		}
+	}
+}
+
+// fakePkcs11 is an in-memory token holding RSA private keys, unwrapping
+// with CKM_RSA_PKCS or CKM_RSA_PKCS_OAEP (SHA-256 only).
+type fakePkcs11 struct {
+	label    string
+	pin      string
+	keys     map[string][]*rsa.PrivateKey
+	loggedIn bool
+	found    []pkcs11.ObjectHandle
+	objects  map[pkcs11.ObjectHandle][]byte
+	next     pkcs11.ObjectHandle
+	sessions int
+	inits    int
+}
+
+func (f *fakePkcs11) Initialize() error { f.inits++; return nil }
+func (f *fakePkcs11) Finalize() error   { f.inits--; return nil }
+func (f *fakePkcs11) Destroy()          {}
+
+func (f *fakePkcs11) GetSlotList(tokenPresent bool) ([]uint, error) {
+	return []uint{0, 1}, nil
+}
+
+func (f *fakePkcs11) GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error) {
+	if slotID == 1 {
+		return pkcs11.TokenInfo{Label: f.label}, nil
+	}
+	return pkcs11.TokenInfo{Label: "other"}, nil
+}
+
+func (f *fakePkcs11) OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error) {
+	if slotID != 1 {
+		return 0, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	f.sessions++
+	return 1, nil
+}
+
+func (f *fakePkcs11) CloseSession(sh pkcs11.SessionHandle) error {
+	f.sessions--
+	f.loggedIn = false
+	return nil
+}
+
+func (f *fakePkcs11) Login(sh pkcs11.SessionHandle, userType uint, pin string) error {
+	if pin != f.pin {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	f.loggedIn = true
+	return nil
+}
+
+func (f *fakePkcs11) Logout(sh pkcs11.SessionHandle) error {
+	f.loggedIn = false
+	return nil
+}
+
+func (f *fakePkcs11) FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error {
+	if !f.loggedIn {
+		return pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+	f.found = nil
+	for _, a := range temp {
+		if a.Type == pkcs11.CKA_LABEL {
+			for i := range f.keys[string(a.Value)] {
+				f.found = append(f.found, pkcs11.ObjectHandle(i))
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakePkcs11) FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	if len(f.found) > max {
+		return f.found[:max], true, nil
+	}
+	return f.found, false, nil
+}
+
+func (f *fakePkcs11) FindObjectsFinal(sh pkcs11.SessionHandle) error {
+	f.found = nil
+	return nil
+}
+
+func (f *fakePkcs11) UnwrapKey(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, unwrappingKey pkcs11.ObjectHandle, wrappedKey []byte, a []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	for _, attr := range a {
+		if attr.Type == pkcs11.CKA_TOKEN && !bytes.Equal(attr.Value, []byte{0}) {
+			return 0, pkcs11.Error(pkcs11.CKR_TEMPLATE_INCONSISTENT)
+		}
+	}
+	key := f.keys["unlock"][unwrappingKey]
+	var plain []byte
+	var err error
+	switch m[0].Mechanism {
+	case pkcs11.CKM_RSA_PKCS:
+		plain, err = rsa.DecryptPKCS1v15(nil, key, wrappedKey)
+	case pkcs11.CKM_RSA_PKCS_OAEP:
+		plain, err = rsa.DecryptOAEP(sha256.New(), nil, key, wrappedKey, nil)
+	default:
+		return 0, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	if err != nil {
+		return 0, pkcs11.Error(pkcs11.CKR_WRAPPED_KEY_INVALID)
+	}
+	f.next++
+	f.objects[f.next] = plain
+	return f.next, nil
+}
+
+func (f *fakePkcs11) GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	value, ok := f.objects[o]
+	if !ok {
+		return nil, pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	return []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, value)}, nil
+}
+
+func (f *fakePkcs11) DestroyObject(sh pkcs11.SessionHandle, oh pkcs11.ObjectHandle) error {
+	delete(f.objects, oh)
+	return nil
+}
+
+func TestPkcs11Unwrap(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	oaep256, _ := rsa.EncryptOAEP(sha256.New(), rand.Reader, &priv.PublicKey, []byte(testKey), nil)
+	pkcs1, _ := rsa.EncryptPKCS1v15(rand.Reader, &priv.PublicKey, []byte(testKey))
+
+	tests := []struct {
+		pj     config.ProviderJSON
+		keys   map[string][]*rsa.PrivateKey
+		expErr bool
+	}{
+		{pkcs11Config("/fake.so", "test", "1234", "unlock", "RSA-OAEP-256", oaep256), nil, false},
+		{pkcs11Config("/fake.so", "test", "1234", "unlock", "RSA1_5", pkcs1), nil, false},
+		{pkcs11Config("/fake.so", "test", "1234", "unlock", "RSA1_5", oaep256), nil, true},
+		{pkcs11Config("/fake.so", "test", "0000", "unlock", "RSA-OAEP-256", oaep256), nil, true},
+		{pkcs11Config("/fake.so", "missing", "1234", "unlock", "RSA-OAEP-256", oaep256), nil, true},
+		{pkcs11Config("/fake.so", "test", "1234", "missing", "RSA-OAEP-256", oaep256), nil, true},
+		{pkcs11Config("/fake.so", "test", "1234", "unlock", "RSA-OAEP-256", oaep256), map[string][]*rsa.PrivateKey{"unlock": {priv, priv}}, true},
+	}
+
+	for i, tt := range tests {
+		keys := tt.keys
+		if keys == nil {
+			keys = map[string][]*rsa.PrivateKey{"unlock": {priv}}
+		}
+		fake := &fakePkcs11{label: "test", pin: "1234", keys: keys, objects: map[pkcs11.ObjectHandle][]byte{}}
+		p, err := newPkcs11(tt.pj.Value.(config.Pkcs11V1))
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		p.load = func(string) (pkcs11Module, error) { return fake, nil }
+
+		key, err := p.Key(context.Background(), Request{})
+		if fake.sessions != 0 || fake.inits != 0 || fake.loggedIn || len(fake.objects) != 0 {
+			t.Fatalf("case %d left module state behind: %+v", i, fake)
+		}
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for case %d, got key %q", i, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q for case %d", err, i)
+		}
+		if string(key) != testKey {
+			t.Fatalf("expected key %q, got %q", testKey, key)
+		}
+	}
+}
+
+// TestPkcs11SoftHSM runs against a real token, e.g. SoftHSM:
+//
+//	softhsm2-util --init-token --free --label test --pin 1234 --so-pin 0000
+//	pkcs11-tool --module $MODULE --login --pin 1234 --token-label test \
+//	  --keypairgen --key-type rsa:2048 --label unlock
+//	pkcs11-tool --module $MODULE --token-label test --read-object \
+//	  --type pubkey --label unlock -o unlock.der
+//
+// with PKCS11_TEST_MODULE, PKCS11_TEST_TOKEN, PKCS11_TEST_PIN,
+// PKCS11_TEST_KEY and PKCS11_TEST_PUBKEY (DER or PEM) set accordingly.
+func TestPkcs11SoftHSM(t *testing.T) {
+	module := os.Getenv("PKCS11_TEST_MODULE")
+	if module == "" {
+		t.Skip("PKCS11_TEST_MODULE not set")
+	}
+	token, pin, label := os.Getenv("PKCS11_TEST_TOKEN"), os.Getenv("PKCS11_TEST_PIN"), os.Getenv("PKCS11_TEST_KEY")
+	der, err := ioutil.ReadFile(os.Getenv("PKCS11_TEST_PUBKEY"))
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PublicKey(der); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+	}
+	pub := parsed.(*rsa.PublicKey)
+
+	oaep256, _ := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, []byte(testKey), nil)
+	pkcs1, _ := rsa.EncryptPKCS1v15(rand.Reader, pub, []byte(testKey))
+	tests := []struct {
+		pj     config.ProviderJSON
+		expErr bool
+	}{
+		{pkcs11Config(module, token, pin, label, "RSA-OAEP-256", oaep256), false},
+		{pkcs11Config(module, token, pin, label, "RSA1_5", pkcs1), false},
+		{pkcs11Config(module, token, pin, label, "RSA-OAEP", oaep256), true},
+		{pkcs11Config(module, token, pin+"0", label, "RSA-OAEP-256", oaep256), true},
+		{pkcs11Config(module, token, pin, label+"-missing", "RSA-OAEP-256", oaep256), true},
+		{pkcs11Config(module, token+"-missing", pin, label, "RSA-OAEP-256", oaep256), true},
+	}
+
+	for i, tt := range tests {
+		p, err := FromConfig(tt.pj)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		key, err := p.Key(context.Background(), Request{})
+		if tt.expErr {
+			if err == nil {
+				t.Fatalf("expected error for case %d, got key %q", i, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q for case %d", err, i)
+		}
+		if string(key) != testKey {
+			t.Fatalf("expected key %q, got %q", testKey, key)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package providers implements key retrieval for all provider kinds
+// described in `pkg/config`.
+package providers
+
+import (
+	"context"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// Request describes the keyslot a key is retrieved for.
+type Request struct {
+	Device     string
+	VolumeName string
+	Keyslot    int
+	// Roots are the active configuration roots, under which configured
+	// files (e.g. PEM keys) must be. The default roots are used if empty.
+	Roots common.Roots
+}
+
+// Provider retrieves the key for a single keyslot.
+type Provider interface {
+	// Key returns the key material for the keyslot.
+	Key(ctx context.Context, req Request) ([]byte, error)
+}
+
+// Enroller is a Provider which can set up a new keyslot.
+type Enroller interface {
+	Provider
+	// Enroll returns a new key and the configuration to retrieve it later.
+	Enroll(ctx context.Context, req Request) ([]byte, config.ProviderJSON, error)
+}
+
+// Committer is a Provider which must be notified once its key has
+// unlocked the volume, e.g. to invalidate single-use keys.
+type Committer interface {
+	Provider
+	// Commit is called on the same instance as a successful Key, once the
+	// volume has been activated with the key.
+	Commit(ctx context.Context, req Request) error
+}
+
+// Retrier is a Provider whose Key may be called again on the same instance
+// when the previous key failed verification, e.g. to prompt for a mistyped
+// passphrase.
+type Retrier interface {
+	Provider
+	// Tries returns the maximum number of calls to Key.
+	Tries() int
+}
+
+// FromConfig returns the Provider for a keyslot configuration.
+func FromConfig(pj config.ProviderJSON) (Provider, error) {
+	switch pj.Kind {
+	case config.ProviderContentV1:
+		cfg, ok := pj.Value.(config.ContentV1)
+		if !ok {
+			return nil, errors.Errorf("unexpected value type %T for ContentV1", pj.Value)
+		}
+		return newContent(cfg)
+	case config.ProviderExecV1:
+		cfg, ok := pj.Value.(config.ExecV1)
+		if !ok {
+			return nil, errors.Errorf("unexpected value type %T for ExecV1", pj.Value)
+		}
+		return newExec(cfg)
+	case config.ProviderAzureVaultV1:
+		cfg, ok := pj.Value.(config.AzureVaultV1)
+		if !ok {
+			return nil, errors.Errorf("unexpected value type %T for AzureVaultV1", pj.Value)
+		}
+		return newAzureVault(cfg)
+	case config.ProviderAwsKmsV1:
+		cfg, ok := pj.Value.(config.AwsKmsV1)
+		if !ok {
+			return nil, errors.Errorf("unexpected value type %T for AwsKmsV1", pj.Value)
+		}
+		return newAwsKms(cfg)
+	case config.ProviderGcpKmsV1:
+		cfg, ok := pj.Value.(config.GcpKmsV1)
+		if !ok {
+			return nil, errors.Errorf("unexpected value type %T for GcpKmsV1", pj.Value)
+		}
+		return newGcpKms(cfg)
+	case config.ProviderPkcs11V1:
+		cfg, ok := pj.Value.(config.Pkcs11V1)
+		if !ok {
+			return nil, errors.Errorf("unexpected value type %T for Pkcs11V1", pj.Value)
+		}
+		return newPkcs11(cfg)
+	case config.ProviderEtcdV1:
+		cfg, ok := pj.Value.(config.EtcdV1)
+		if !ok {
+			return nil, errors.Errorf("unexpected value type %T for EtcdV1", pj.Value)
+		}
+		return newEtcd(cfg)
+	case config.ProviderKeyFileV1:
+		cfg, ok := pj.Value.(config.KeyFileV1)
+		if !ok {
+			return nil, errors.Errorf("unexpected value type %T for KeyFileV1", pj.Value)
+		}
+		return newKeyFile(cfg)
+	case config.ProviderInteractiveV1:
+		cfg, ok := pj.Value.(config.InteractiveV1)
+		if !ok {
+			return nil, errors.Errorf("unexpected value type %T for InteractiveV1", pj.Value)
+		}
+		return newInteractive(cfg)
+	default:
+		return nil, errors.Errorf("unsupported provider kind %s", pj.Kind)
+	}
+}
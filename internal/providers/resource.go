@@ -0,0 +1,149 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// bootDir is the default and only allowed root for `file:` URLs of content
+// sources and local resources, respectively.
+const bootDir = "/boot"
+
+var hashFuncs = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// readLocalResource returns an inline PEM document as is, or the content of
+// a `data:` URL or of a `file:` URL under `/boot`.
+func readLocalResource(rawURL string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(rawURL), pemPrefix) {
+		return []byte(rawURL), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid resource URL")
+	}
+	switch u.Scheme {
+	case "data":
+		return decodeDataURL(u)
+	case "file":
+		path, err := filePath(u, bootDir)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadFile(path)
+	default:
+		return nil, errors.Errorf("unsupported resource scheme %q", u.Scheme)
+	}
+}
+
+// filePath returns the local path of a `file:` URL, which must be absolute
+// and under `root` once cleaned.
+func filePath(u *url.URL, root string) (string, error) {
+	if u.Host != "" {
+		return "", errors.Errorf("file URL %q must not have a host", u)
+	}
+	if !filepath.IsAbs(u.Path) {
+		return "", errors.Errorf("file URL %q is not absolute", u)
+	}
+	path := filepath.Clean(u.Path)
+	prefix := filepath.Clean(root)
+	if prefix != string(filepath.Separator) {
+		prefix += string(filepath.Separator)
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return "", errors.Errorf("file URL %q is not under %s", u, root)
+	}
+	return path, nil
+}
+
+// decodeDataURL decodes the payload of an RFC 2397 `data:` URL.
+func decodeDataURL(u *url.URL) ([]byte, error) {
+	// Data URLs are opaque, payload is after the first comma.
+	opaque := u.Opaque
+	i := strings.Index(opaque, ",")
+	if i < 0 {
+		return nil, errors.New("malformed data URL, missing comma")
+	}
+	meta, payload := opaque[:i], opaque[i+1:]
+
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed data URL payload")
+	}
+	if strings.HasSuffix(meta, ";base64") {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	return []byte(data), nil
+}
+
+// validateVerification checks the format of an expected digest.
+func validateVerification(v *config.ContentV1Verification) error {
+	if v == nil {
+		return nil
+	}
+	_, _, err := parseHash(v.Hash)
+	return err
+}
+
+// verify checks `data` against an expected digest, if any.
+func verify(data []byte, v *config.ContentV1Verification) error {
+	if v == nil {
+		return nil
+	}
+	newHash, expected, err := parseHash(v.Hash)
+	if err != nil {
+		return err
+	}
+	h := newHash()
+	h.Write(data)
+	if subtle.ConstantTimeCompare(h.Sum(nil), expected) != 1 {
+		return errors.New("content does not match the expected hash")
+	}
+	return nil
+}
+
+func parseHash(s string) (func() hash.Hash, []byte, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, nil, errors.Errorf("malformed hash %q, expected <function>-<digest>", s)
+	}
+	newHash, ok := hashFuncs[parts[0]]
+	if !ok {
+		return nil, nil, errors.Errorf("unsupported hash function %q", parts[0])
+	}
+	digest, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "malformed %s digest", parts[0])
+	}
+	if len(digest) != newHash().Size() {
+		return nil, nil, errors.Errorf("malformed %s digest, expected %d bytes", parts[0], newHash().Size())
+	}
+	return newHash, digest, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TFTP opcodes, as per RFC 1350.
+const (
+	tftpOpRRQ   = 1
+	tftpOpData  = 3
+	tftpOpAck   = 4
+	tftpOpError = 5
+)
+
+const (
+	tftpDefaultPort    = "69"
+	tftpBlockSize      = 512
+	tftpDefaultTimeout = 2 * time.Second
+	tftpDefaultRetries = 5
+)
+
+// tftpGet retrieves a file from a TFTP server in octet mode, retransmitting
+// the last packet on every timeout.
+func tftpGet(ctx context.Context, host string, path string, timeout time.Duration, retries int, maxSize int) ([]byte, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, tftpDefaultPort)
+	}
+	server, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	var rrq bytes.Buffer
+	binary.Write(&rrq, binary.BigEndian, uint16(tftpOpRRQ))
+	rrq.WriteString(strings.TrimPrefix(path, "/"))
+	rrq.WriteByte(0)
+	rrq.WriteString("octet")
+	rrq.WriteByte(0)
+
+	last := rrq.Bytes()
+	dest := server
+	var peer *net.UDPAddr
+	var out bytes.Buffer
+	expected := uint16(1)
+	buf := make([]byte, 4+tftpBlockSize)
+	for attempt := 0; ; {
+		if _, err := conn.WriteToUDP(last, dest); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && attempt < retries {
+				attempt++
+				continue
+			}
+			return nil, errors.Wrapf(err, "tftp transfer from %s failed", host)
+		}
+		// The server answers from a new port (TID), which is then fixed
+		// for the whole transfer.
+		if peer == nil {
+			peer = from
+			dest = from
+		} else if !from.IP.Equal(peer.IP) || from.Port != peer.Port {
+			continue
+		}
+		if n < 4 {
+			return nil, errors.New("short tftp packet")
+		}
+
+		switch binary.BigEndian.Uint16(buf[0:2]) {
+		case tftpOpData:
+			block := binary.BigEndian.Uint16(buf[2:4])
+			ack := make([]byte, 4)
+			binary.BigEndian.PutUint16(ack[0:2], tftpOpAck)
+			binary.BigEndian.PutUint16(ack[2:4], block)
+			if block != expected {
+				// Duplicate of an already acknowledged block.
+				last = ack
+				continue
+			}
+			out.Write(buf[4:n])
+			if out.Len() > maxSize {
+				return nil, errors.Errorf("tftp content exceeds %d bytes", maxSize)
+			}
+			last = ack
+			attempt = 0
+			expected++
+			if n-4 < tftpBlockSize {
+				conn.WriteToUDP(ack, dest)
+				return out.Bytes(), nil
+			}
+		case tftpOpError:
+			msg := strings.TrimRight(string(buf[4:n]), "\x00")
+			return nil, errors.Errorf("tftp error %d: %s", binary.BigEndian.Uint16(buf[2:4]), msg)
+		default:
+			return nil, errors.Errorf("unexpected tftp opcode %d", binary.BigEndian.Uint16(buf[0:2]))
+		}
+	}
+}
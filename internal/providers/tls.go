@@ -0,0 +1,148 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+const pemPrefix = "-----BEGIN "
+
+// readPEM returns an inline PEM document as is, or otherwise reads it from
+// an absolute path under one of `roots`.
+func readPEM(roots common.Roots, s string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(s), pemPrefix) {
+		return []byte(s), nil
+	}
+	path, err := configPath(roots, s)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// configPath validates that `path` is an absolute path under one of the
+// configuration `roots`, or of the default ones if empty.
+func configPath(roots common.Roots, path string) (string, error) {
+	if len(roots) == 0 {
+		roots = common.Roots(config.DefaultConfigRoots)
+	}
+	if !filepath.IsAbs(path) {
+		return "", errors.Errorf("path %q is not absolute", path)
+	}
+	clean := filepath.Clean(path)
+	for _, root := range roots {
+		if strings.HasPrefix(clean, filepath.Clean(root)+string(filepath.Separator)) {
+			return clean, nil
+		}
+	}
+	return "", errors.Errorf("path %q is not under %s", path, strings.Join(roots, ", "))
+}
+
+// clientCertificate loads a TLS client certificate, decrypting its private
+// key through the passphrase provider if needed.
+func clientCertificate(ctx context.Context, req Request, cc config.ContentV1ClientCert) (tls.Certificate, error) {
+	certPEM, err := readPEM(req.Roots, cc.Certificate)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to read client certificate")
+	}
+	keyPEM, err := readPEM(req.Roots, cc.Key)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to read client key")
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return tls.Certificate{}, errors.New("failed to decode client key PEM")
+	}
+	if x509.IsEncryptedPEMBlock(block) {
+		if cc.KeyPassphrase == nil {
+			return tls.Certificate{}, errors.New("client key is encrypted, but no passphrase provider is configured")
+		}
+		p, err := FromConfig(*cc.KeyPassphrase)
+		if err != nil {
+			return tls.Certificate{}, errors.Wrap(err, "invalid client key passphrase provider")
+		}
+		pass, err := p.Key(ctx, req)
+		if err != nil {
+			return tls.Certificate{}, errors.Wrap(err, "failed to retrieve client key passphrase")
+		}
+		der, err := x509.DecryptPEMBlock(block, pass)
+		if err != nil {
+			return tls.Certificate{}, errors.Wrap(err, "failed to decrypt client key")
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "invalid client certificate")
+	}
+	return cert, nil
+}
+
+// tlsClientConfig builds a TLS configuration trusting the given certificate
+// authorities (or the system ones if none), and presenting the client
+// certificate if not nil.
+func tlsClientConfig(ctx context.Context, req Request, cas []config.ContentV1CertAuth, cc *config.ContentV1ClientCert) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if len(cas) > 0 {
+		pool := x509.NewCertPool()
+		for _, ca := range cas {
+			bundle, err := readLocalResource(ca.Authority)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read certificate authority")
+			}
+			if err := verify(bundle, ca.Verification); err != nil {
+				return nil, errors.Wrap(err, "failed to verify certificate authority")
+			}
+			if !pool.AppendCertsFromPEM(bundle) {
+				return nil, errors.New("failed to parse PEM certificate authority")
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cc != nil {
+		cert, err := clientCertificate(ctx, req, *cc)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// httpTransport returns a transport to key servers using `tlsConfig`, which
+// honours the proxy environment variables. `headers` bounds the wait for
+// response headers, if not zero.
+func httpTransport(tlsConfig *tls.Config, headers time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSClientConfig:       tlsConfig,
+		ResponseHeaderTimeout: headers,
+	}
+}
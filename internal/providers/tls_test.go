@@ -0,0 +1,223 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package providers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+)
+
+// testCert is a generated certificate, with its PEM encodings.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+	keyDER  []byte
+}
+
+func (tc testCert) keyPEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: tc.keyDER}))
+}
+
+// newTestCert generates a certificate signed by `parent`, or a self-signed
+// CA if `parent` is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyDER:  keyDER,
+	}
+}
+
+func TestContentClientCertificate(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	server := newTestCert(t, "localhost", &ca)
+	client := newTestCert(t, "node-1", &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "node-1" {
+			http.Error(w, "unknown node", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(testKey))
+	}))
+	serverCert, err := tls.X509KeyPair([]byte(server.certPEM), []byte(server.keyPEM()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "providers_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pass := "key-passphrase"
+	passScript := writeScript(t, tmpDir, "pass", `
+echo '{"key":"`+base64.StdEncoding.EncodeToString([]byte(pass))+`"}'
+`)
+	passProvider := &config.ProviderJSON{
+		Kind:  config.ProviderExecV1,
+		Value: config.ExecV1{Path: passScript},
+	}
+	encBlock, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", client.keyDER, []byte(pass), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encKeyPEM := string(pem.EncodeToMemory(encBlock))
+
+	// Files are looked up under the active configuration roots.
+	confRoot := filepath.Join(tmpDir, "etc")
+	certPath := filepath.Join(confRoot, "node.crt")
+	keyPath := filepath.Join(confRoot, "node.key")
+	if err := os.MkdirAll(confRoot, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certPath, []byte(client.certPEM), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, []byte(client.keyPEM()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cc     *config.ContentV1ClientCert
+		roots  common.Roots
+		expErr string
+	}{
+		{
+			&config.ContentV1ClientCert{Certificate: client.certPEM, Key: client.keyPEM()},
+			nil,
+			"",
+		},
+		{
+			&config.ContentV1ClientCert{Certificate: client.certPEM, Key: encKeyPEM, KeyPassphrase: passProvider},
+			nil,
+			"",
+		},
+		{
+			&config.ContentV1ClientCert{Certificate: client.certPEM, Key: encKeyPEM},
+			nil,
+			"no passphrase provider",
+		},
+		{
+			&config.ContentV1ClientCert{Certificate: client.certPEM, Key: "/etc/shadow"},
+			nil,
+			"is not under",
+		},
+		{
+			&config.ContentV1ClientCert{Certificate: certPath, Key: keyPath},
+			common.Roots{confRoot},
+			"",
+		},
+		{
+			&config.ContentV1ClientCert{Certificate: certPath, Key: keyPath},
+			nil,
+			"is not under",
+		},
+		{
+			nil,
+			nil,
+			"failed to fetch",
+		},
+	}
+
+	for _, tt := range tests {
+		cfg := config.ContentV1{
+			Source:                 ts.URL,
+			CertificateAuthorities: []config.ContentV1CertAuth{{Authority: dataURL(ca.certPEM)}},
+			ClientCertificate:      tt.cc,
+		}
+		p, err := FromConfig(config.ProviderJSON{Kind: config.ProviderContentV1, Value: cfg})
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		key, err := p.Key(context.Background(), Request{Roots: tt.roots})
+		if tt.expErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.expErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if string(key) != testKey {
+			t.Fatalf("expected key %q, got %q", testKey, key)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package remote implements the remote unlock API, which lets operators
+// answer pending systemd-cryptsetup password requests over mutual TLS.
+package remote
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/agent"
+	"github.com/coreos/coreos-cryptagent/internal/audit"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// volumesPath is the API prefix for pending volumes.
+	volumesPath = "/v1/volumes/"
+	// maxPassphraseSize is the maximum accepted passphrase size.
+	maxPassphraseSize = 8 << 10
+	// shutdownTimeout bounds the graceful shutdown of the server.
+	shutdownTimeout = 5 * time.Second
+	// provider is the key source name of remote unlocks in audit records.
+	provider = "remote"
+)
+
+// Volume is a pending password request, as exposed by the API.
+type Volume struct {
+	// ID identifies the request, as the name of its `ask.*` file.
+	ID      string `json:"id"`
+	Volume  string `json:"volume"`
+	Message string `json:"message,omitempty"`
+}
+
+// Handler serves the remote unlock API for the password requests queued in
+// an ask-password directory. `GET /v1/volumes/` lists pending volumes, and
+// `POST /v1/volumes/<id>` answers request `<id>` with the request body.
+type Handler struct {
+	Dir string
+	// Audit records answered requests, if not nil.
+	Audit *audit.Log
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, volumesPath) {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, volumesPath)
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		h.list(w, r)
+	case id != "" && r.Method == http.MethodPost:
+		h.answer(w, r, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h Handler) list(w http.ResponseWriter, r *http.Request) {
+	reqs, err := agent.Pending(h.Dir)
+	if err != nil {
+		logrus.Errorf("remote: %s", err)
+		http.Error(w, "failed to list pending requests", http.StatusInternalServerError)
+		return
+	}
+	vols := []Volume{}
+	for _, req := range reqs {
+		target, ok := req.Volume()
+		if !ok {
+			continue
+		}
+		vols = append(vols, Volume{
+			ID:      filepath.Base(req.Path),
+			Volume:  target,
+			Message: req.Message,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vols)
+}
+
+func (h Handler) answer(w http.ResponseWriter, r *http.Request, id string) {
+	pass, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPassphraseSize+1))
+	if err != nil {
+		http.Error(w, "failed to read passphrase", http.StatusBadRequest)
+		return
+	}
+	if len(pass) == 0 || len(pass) > maxPassphraseSize {
+		http.Error(w, "invalid passphrase size", http.StatusBadRequest)
+		return
+	}
+
+	reqs, err := agent.Pending(h.Dir)
+	if err != nil {
+		logrus.Errorf("remote: %s", err)
+		http.Error(w, "failed to list pending requests", http.StatusInternalServerError)
+		return
+	}
+	for _, req := range reqs {
+		target, ok := req.Volume()
+		if !ok || filepath.Base(req.Path) != id {
+			continue
+		}
+		err := req.Reply(pass)
+		h.audit(target, peerName(r), err)
+		if err != nil {
+			logrus.Errorf("remote: %s", err)
+			http.Error(w, "failed to forward passphrase", http.StatusBadGateway)
+			return
+		}
+		logrus.Infof("remote: answered password request for %s from %s", target, peerName(r))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// audit records a passphrase forwarded for `target`, by client `peer`.
+func (h Handler) audit(target string, peer string, err error) {
+	if h.Audit == nil {
+		return
+	}
+	rec := audit.Record{
+		Time:        time.Now().UTC(),
+		Keyslot:     -1,
+		Provider:    provider,
+		Identifiers: map[string]string{"client": peer},
+		Result:      audit.ResultForwarded,
+	}
+	if filepath.IsAbs(target) {
+		rec.Device = target
+	} else {
+		rec.Volume = target
+	}
+	if err != nil {
+		rec.Result = audit.ResultFailure
+		rec.ErrorClass = audit.ClassProvider
+	}
+	if err := h.Audit.Append(rec); err != nil {
+		logrus.Warnf("remote: failed to write audit record to %s: %s", h.Audit.Path, err)
+	}
+}
+
+// peerName returns the common name of the client certificate.
+func peerName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return r.RemoteAddr
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// TLSConfig returns a server configuration requiring client certificates
+// signed by the CAs in `clientCAFile`.
+func TLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load server certificate")
+	}
+	pemCAs, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCAs) {
+		return nil, errors.Errorf("no certificates in %s", clientCAFile)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return cfg, nil
+}
+
+// ListenAndServe serves the remote unlock API on `addr` with handler `h`,
+// until `ctx` is done.
+func ListenAndServe(ctx context.Context, addr string, tlsConfig *tls.Config, h Handler) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServeTLS("", "")
+	}()
+
+	select {
+	case err := <-errs:
+		return errors.Wrapf(err, "remote unlock server on %s failed", addr)
+	case <-ctx.Done():
+		shutCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return srv.Shutdown(shutCtx)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/audit"
+)
+
+// testCert is a generated certificate with its PEM encodings.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert generates a certificate signed by `parent`, or a self-signed
+// CA if `parent` is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeFile(t *testing.T, dir string, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func clientFor(t *testing.T, client testCert, ca testCert) *http.Client {
+	cert, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+		},
+	}
+	return &http.Client{Transport: transport}
+}
+
+func TestRemoteUnlock(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "remote_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ca := newTestCert(t, "test-ca", nil)
+	server := newTestCert(t, "node-1", &ca)
+	operator := newTestCert(t, "operator", &ca)
+	otherCA := newTestCert(t, "other-ca", nil)
+	intruder := newTestCert(t, "intruder", &otherCA)
+	tlsConfig, err := TLSConfig(
+		writeFile(t, tmpDir, "server.crt", server.certPEM),
+		writeFile(t, tmpDir, "server.key", server.keyPEM),
+		writeFile(t, tmpDir, "ca.crt", ca.certPEM),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	askDir := filepath.Join(tmpDir, "ask-password")
+	os.Mkdir(askDir, 0755)
+	sck := filepath.Join(askDir, "sck.abc")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sck, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeFile(t, askDir, "ask.abc", []byte("[Ask]\nSocket="+sck+"\nId=cryptsetup:luks_vol\nMessage=Please enter passphrase for disk luks_vol!\n"))
+	writeFile(t, askDir, "ask.def", []byte("[Ask]\nSocket="+sck+"\nId=other:foo\n"))
+
+	al := &audit.Log{Path: filepath.Join(tmpDir, "audit.log")}
+	ts := httptest.NewUnstartedServer(Handler{Dir: askDir, Audit: al})
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	if _, err := clientFor(t, intruder, ca).Get(ts.URL + volumesPath); err == nil {
+		t.Fatalf("expected error for unknown client CA")
+	}
+
+	client := clientFor(t, operator, ca)
+	resp, err := client.Get(ts.URL + volumesPath)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	var vols []Volume
+	err = json.NewDecoder(resp.Body).Decode(&vols)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	exp := Volume{ID: "ask.abc", Volume: "luks_vol", Message: "Please enter passphrase for disk luks_vol!"}
+	if len(vols) != 1 || vols[0] != exp {
+		t.Fatalf("expected [%+v], got %+v", exp, vols)
+	}
+
+	tests := []struct {
+		id   string
+		body string
+		exp  int
+	}{
+		{"ask.def", "sekrit", http.StatusNotFound},
+		{"ask.xyz", "sekrit", http.StatusNotFound},
+		{"ask.abc", "", http.StatusBadRequest},
+		{"ask.abc", "sekrit", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		resp, err := client.Post(ts.URL+volumesPath+tt.id, "application/octet-stream", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.exp {
+			t.Fatalf("expected status %d for %s, got %d", tt.exp, tt.id, resp.StatusCode)
+		}
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if string(buf[:n]) != "+sekrit" {
+		t.Fatalf("expected reply %q, got %q", "+sekrit", buf[:n])
+	}
+
+	recs, err := al.Read()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if len(recs) != 1 || recs[0].Volume != "luks_vol" || recs[0].Result != audit.ResultForwarded || recs[0].Identifiers["client"] != "operator" {
+		t.Fatalf("unexpected audit records %+v", recs)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unlock
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/coreos-cryptagent/internal/audit"
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/internal/logging"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// SystemdCryptsetup is the default path of the systemd-cryptsetup helper.
+const SystemdCryptsetup = "/lib/systemd/systemd-cryptsetup"
+
+// Plan describes what Attach would do for a device, after the key for the
+// volume was retrieved and verified.
+type Plan struct {
+	Device      string `json:"device"`
+	BlockDevice string `json:"blockDevice"`
+	Volume      string `json:"volume"`
+	ConfigDir   string `json:"configDir"`
+	// Command is the systemd-cryptsetup invocation run by Attach.
+	Command     []string          `json:"command"`
+	Keyslot     int               `json:"keyslot"`
+	Provider    string            `json:"provider"`
+	Identifiers map[string]string `json:"identifiers,omitempty"`
+}
+
+// Attach activates the volume configured for device `pathIn`, by running
+// the systemd-cryptsetup compatible `helper`.
+//
+// The key is not passed to the helper, which instead asks for it through
+// the password agent protocol.
+func Attach(sys common.System, helper string, pathIn string) error {
+	blockPath, _, luks1, err := lookupVolume(sys, pathIn)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		logging.FieldVolume: luks1.Name,
+		logging.FieldDevice: blockPath,
+	}).Debugf("unlocking volume %s on device %s", luks1.Name, blockPath)
+	args, err := helperArgs(luks1, blockPath)
+	if err != nil {
+		return err
+	}
+	if err := runHelper(helper, args); err != nil {
+		return errors.Wrap(err, "failed to run systemd-crypsetup")
+	}
+
+	return nil
+}
+
+// PlanAttach goes through Attach for device `pathIn` up to key verification,
+// without activating the volume. The verified key is not committed.
+func (u Unlocker) PlanAttach(ctx context.Context, sys common.System, helper string, pathIn string) (Plan, error) {
+	var plan Plan
+	blockPath, confDir, luks1, err := lookupVolume(sys, pathIn)
+	if err != nil {
+		return plan, err
+	}
+	args, err := helperArgs(luks1, blockPath)
+	if err != nil {
+		return plan, err
+	}
+
+	res, err := u.Key(ctx, confDir)
+	if err != nil {
+		return plan, err
+	}
+	return newPlan(pathIn, blockPath, confDir, luks1, append([]string{helper}, args...), res.Keyslot, res.Provider)
+}
+
+// PlanCheck is like PlanAttach, but retrieves and verifies the key of every
+// keyslot instead of stopping at the first one which opens the volume. The
+// plan uses the first verified keyslot, as Attach would.
+func (u Unlocker) PlanCheck(ctx context.Context, sys common.System, helper string, pathIn string) (Plan, []KeyslotCheck, error) {
+	blockPath, confDir, luks1, err := lookupVolume(sys, pathIn)
+	if err != nil {
+		return Plan{}, nil, err
+	}
+	args, err := helperArgs(luks1, blockPath)
+	if err != nil {
+		return Plan{}, nil, err
+	}
+
+	checks, err := u.Check(ctx, confDir)
+	if err != nil {
+		return Plan{}, nil, err
+	}
+	for _, c := range checks {
+		if c.Err == nil {
+			plan, err := newPlan(pathIn, blockPath, confDir, luks1, append([]string{helper}, args...), c.Keyslot, c.Provider)
+			return plan, checks, err
+		}
+	}
+	return Plan{}, checks, errors.Errorf("all keyslots failed for volume %s", luks1.Name)
+}
+
+// newPlan describes the activation of volume `luks1` with the verified key
+// of keyslot `n`.
+func newPlan(pathIn string, blockPath string, confDir string, luks1 config.CryptsetupLUKS1V1, command []string, n int, provider config.ProviderKind) (Plan, error) {
+	pj, err := common.ReadKeyslot(confDir, n)
+	if err != nil {
+		return Plan{}, err
+	}
+	plan := Plan{
+		Device:      pathIn,
+		BlockDevice: blockPath,
+		Volume:      luks1.Name,
+		ConfigDir:   confDir,
+		Command:     command,
+		Keyslot:     n,
+		Provider:    provider.String(),
+		Identifiers: audit.Identifiers(pj),
+	}
+	return plan, nil
+}
+
+// lookupVolume returns the `/dev/block` entry, the configuration directory
+// and the volume configuration for device `pathIn`.
+func lookupVolume(sys common.System, pathIn string) (string, string, config.CryptsetupLUKS1V1, error) {
+	var luks1 config.CryptsetupLUKS1V1
+	blockPath, err := sys.LookupBlockdev(pathIn)
+	if err != nil {
+		return "", "", luks1, errors.Wrap(err, "failed reverse block lookup")
+	}
+	confDir, err := sys.LookupConfigDir(pathIn)
+	if err != nil {
+		return "", "", luks1, errors.Wrap(err, "failed config directory lookup")
+	}
+	vj, err := common.ReadVolume(confDir)
+	if err != nil {
+		return "", "", luks1, errors.Wrap(err, "failed to read volume configuration")
+	}
+	luks1, ok := vj.Value.(config.CryptsetupLUKS1V1)
+	if !ok {
+		return "", "", luks1, errors.Errorf("unsupported volume kind %s", vj.Kind)
+	}
+	return blockPath, confDir, luks1, nil
+}
+
+// helperArgs returns the systemd-cryptsetup arguments to attach volume
+// `luks1` on `path`, with the key asked through the password agent protocol.
+func helperArgs(luks1 config.CryptsetupLUKS1V1, path string) ([]string, error) {
+	if luks1.Name == "" {
+		return nil, errors.New("empty input volume name")
+	}
+	if path == "" {
+		return nil, errors.New("empty input path")
+	}
+	args := []string{"attach", luks1.Name, path, "-"}
+	if opts := common.CryptsetupOptions(luks1); len(opts) > 0 {
+		args = append(args, strings.Join(opts, ","))
+	}
+	return args, nil
+}
+
+func runHelper(helper string, args []string) error {
+	cmd := exec.Command(helper, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := errors.New(string(out))
+		return errors.Wrap(msg, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package unlock retrieves verified keys for configured volumes.
+package unlock
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/audit"
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/internal/logging"
+	"github.com/coreos/coreos-cryptagent/internal/luks"
+	"github.com/coreos/coreos-cryptagent/internal/providers"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// mapperDir is where activated volumes appear, by name.
+var mapperDir = "/dev/mapper"
+
+// activePollInterval is how often WaitActive checks for the volume.
+const activePollInterval = 200 * time.Millisecond
+
+// Result records which keyslot provided a verified key.
+type Result struct {
+	// Volume is the configured volume name.
+	Volume   string
+	Keyslot  int
+	Provider config.ProviderKind
+	Key      []byte
+
+	// committer is the provider which returned Key, if it must be
+	// notified once the volume is unlocked.
+	committer providers.Committer
+	req       providers.Request
+}
+
+// NeedsCommit reports whether the keyslot provider must be notified with
+// Commit once the volume is unlocked.
+func (r Result) NeedsCommit() bool {
+	return r.committer != nil
+}
+
+// Commit notifies the keyslot provider that its key unlocked the volume,
+// e.g. to consume one-time keys. It must only be called once the volume is
+// active, so that a failed activation leaves the key available.
+func (r Result) Commit(ctx context.Context) error {
+	if r.committer == nil {
+		return nil
+	}
+	return r.committer.Commit(ctx, r.req)
+}
+
+// WaitActive waits for volume `name` to appear under `/dev/mapper`, until
+// `ctx` is done.
+func WaitActive(ctx context.Context, name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return errors.Errorf("invalid volume name %q", name)
+	}
+	path := filepath.Join(mapperDir, name)
+	ticker := time.NewTicker(activePollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "%s did not appear", path)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Unlocker retrieves verified keys for configured volumes.
+//
+// Retrieving a key has no side effects on providers: callers which use the
+// key to activate the volume must call Commit on the Result afterwards.
+type Unlocker struct {
+	// Cryptsetup verifies keys against LUKS headers.
+	Cryptsetup luks.Cryptsetup
+	// Audit records each keyslot attempt, if not nil.
+	Audit *audit.Log
+	// Roots are the active configuration roots, passed on to providers.
+	Roots common.Roots
+}
+
+// Key retrieves the key for the volume configured in `confDir`.
+//
+// Configured keyslots are tried in ascending order, and the first key which
+// opens its keyslot in the LUKS header is returned.
+func (u Unlocker) Key(ctx context.Context, confDir string) (Result, error) {
+	var res Result
+	luks1, reqs, err := u.keyslotRequests(confDir)
+	if err != nil {
+		return res, err
+	}
+
+	failures := []string{}
+	for _, req := range reqs {
+		n := req.Keyslot
+		r, err := u.keyslot(ctx, confDir, req)
+		if err == nil {
+			return r, nil
+		}
+		log := logrus.WithFields(requestFields(req))
+		if r.Provider != config.ProviderInvalid {
+			log = log.WithField(logging.FieldProvider, r.Provider.String())
+		}
+		log.Warnf("keyslot %d of volume %s: %s", n, luks1.Name, err)
+		failures = append(failures, fmt.Sprintf("keyslot %d: %s", n, err))
+	}
+
+	return res, errors.Errorf("all keyslots failed for volume %s: %s", luks1.Name, strings.Join(failures, "; "))
+}
+
+// KeyslotCheck is the outcome of verifying a single keyslot.
+type KeyslotCheck struct {
+	Keyslot  int
+	Provider config.ProviderKind
+	// Err is nil if the keyslot provider returned a verified key.
+	Err error
+}
+
+// Check retrieves and verifies the key of every keyslot configured in
+// `confDir`, instead of stopping at the first one which opens the volume.
+// Keys are neither returned nor committed.
+func (u Unlocker) Check(ctx context.Context, confDir string) ([]KeyslotCheck, error) {
+	_, reqs, err := u.keyslotRequests(confDir)
+	if err != nil {
+		return nil, err
+	}
+	checks := make([]KeyslotCheck, 0, len(reqs))
+	for _, req := range reqs {
+		r, err := u.keyslot(ctx, confDir, req)
+		checks = append(checks, KeyslotCheck{Keyslot: req.Keyslot, Provider: r.Provider, Err: err})
+	}
+	return checks, nil
+}
+
+// keyslotRequests returns the volume configured in `confDir`, and a key
+// request for each of its keyslots, in ascending order.
+func (u Unlocker) keyslotRequests(confDir string) (config.CryptsetupLUKS1V1, []providers.Request, error) {
+	vj, err := common.ReadVolume(confDir)
+	if err != nil {
+		return config.CryptsetupLUKS1V1{}, nil, err
+	}
+	luks1, ok := vj.Value.(config.CryptsetupLUKS1V1)
+	if !ok {
+		return luks1, nil, errors.Errorf("unsupported volume kind %s", vj.Kind)
+	}
+	slots, err := common.Keyslots(confDir)
+	if err != nil {
+		return luks1, nil, err
+	}
+	if len(slots) == 0 {
+		return luks1, nil, errors.Errorf("no keyslots configured in %s", confDir)
+	}
+	reqs := make([]providers.Request, 0, len(slots))
+	for _, n := range slots {
+		reqs = append(reqs, providers.Request{
+			Device:     luks1.Device,
+			VolumeName: luks1.Name,
+			Keyslot:    n,
+			Roots:      u.Roots,
+		})
+	}
+	return luks1, reqs, nil
+}
+
+// requestFields returns the structured log fields for a key request.
+func requestFields(req providers.Request) logrus.Fields {
+	return logrus.Fields{
+		logging.FieldVolume:  req.VolumeName,
+		logging.FieldDevice:  req.Device,
+		logging.FieldKeyslot: req.Keyslot,
+	}
+}
+
+// keyslot retrieves and verifies the key for a single keyslot, and audits
+// the attempt. On failure, the returned Result records the keyslot provider
+// if it is known.
+func (u Unlocker) keyslot(ctx context.Context, confDir string, req providers.Request) (Result, error) {
+	var res Result
+	rec := audit.Record{
+		Device:      req.Device,
+		Volume:      req.VolumeName,
+		Keyslot:     req.Keyslot,
+		KeyslotFile: common.KeyslotPath(confDir, req.Keyslot),
+	}
+	pj, err := common.ReadKeyslot(confDir, req.Keyslot)
+	if err != nil {
+		u.audit(ctx, rec, audit.ClassConfig, err)
+		return res, err
+	}
+	res.Provider = pj.Kind
+	rec.Provider = pj.Kind.String()
+	rec.Identifiers = audit.Identifiers(pj)
+
+	p, key, class, err := u.verifiedKey(ctx, pj, req)
+	u.audit(ctx, rec, class, err)
+	if err != nil {
+		return res, err
+	}
+	res.Volume = req.VolumeName
+	res.Keyslot = req.Keyslot
+	res.Key = key
+	if c, ok := p.(providers.Committer); ok {
+		res.committer, res.req = c, req
+	}
+	return res, nil
+}
+
+// verifiedKey retrieves a key from the keyslot provider, and checks it
+// against the LUKS header. It returns the provider along with the key, and
+// the audit error class on failure.
+func (u Unlocker) verifiedKey(ctx context.Context, pj config.ProviderJSON, req providers.Request) (providers.Provider, []byte, string, error) {
+	log := logrus.WithFields(requestFields(req)).WithField(logging.FieldProvider, pj.Kind.String())
+	p, err := providers.FromConfig(pj)
+	if err != nil {
+		return nil, nil, audit.ClassConfig, err
+	}
+	tries := 1
+	if r, ok := p.(providers.Retrier); ok {
+		tries = r.Tries()
+	}
+	var key []byte
+	for i := 1; ; i++ {
+		key, err = p.Key(ctx, req)
+		if err != nil {
+			return nil, nil, audit.ClassProvider, err
+		}
+		err = u.Cryptsetup.TestKey(req.Device, key, req.Keyslot)
+		if err == nil {
+			break
+		}
+		if i >= tries {
+			return nil, nil, audit.ClassVerification, errors.Wrap(err, "key verification failed")
+		}
+		log.Debugf("keyslot %d of volume %s: try %d/%d failed: %s", req.Keyslot, req.VolumeName, i, tries, err)
+	}
+	return p, key, "", nil
+}
+
+// audit appends the outcome of a keyslot attempt to the audit log. Failing
+// to do so is logged, but does not prevent unlocking.
+func (u Unlocker) audit(ctx context.Context, rec audit.Record, class string, err error) {
+	if u.Audit == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	rec.Result = audit.ResultSuccess
+	if err != nil {
+		rec.Result = audit.ResultFailure
+		rec.ErrorClass = class
+		if ctx.Err() != nil {
+			rec.ErrorClass = audit.ClassCanceled
+		}
+	}
+	if err := u.Audit.Append(rec); err != nil {
+		logrus.Warnf("failed to write audit record to %s: %s", u.Audit.Path, err)
+	}
+}
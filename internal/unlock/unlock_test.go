@@ -0,0 +1,356 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unlock
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/coreos-cryptagent/internal/audit"
+	"github.com/coreos/coreos-cryptagent/internal/common"
+	"github.com/coreos/coreos-cryptagent/internal/luks"
+	"github.com/coreos/coreos-cryptagent/internal/providers"
+	"github.com/coreos/coreos-cryptagent/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// fakeCryptsetup accepts a single key, in a single keyslot.
+type fakeCryptsetup struct {
+	key  string
+	slot string
+}
+
+func (f fakeCryptsetup) Run(args []string, keys ...[]byte) ([]byte, error) {
+	if len(args) == 0 || args[0] != "open" || len(keys) != 1 {
+		return nil, errors.Errorf("unexpected invocation %q", args)
+	}
+	for i, a := range args {
+		if a == "--key-slot" && args[i+1] == f.slot && string(keys[0]) == f.key {
+			return nil, nil
+		}
+	}
+	return nil, errors.New("No key available with this passphrase.")
+}
+
+// writeTestSystem creates a fake device tree under `root`, with a volume
+// configured for `/dev/sda2` and the given keyslot sources.
+func writeTestSystem(t *testing.T, root string, sources ...string) (common.System, string) {
+	if err := os.MkdirAll(filepath.Join(root, "dev", "block"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "dev", "sda2"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../sda2", filepath.Join(root, "dev", "block", "8:2")); err != nil {
+		t.Fatal(err)
+	}
+
+	confRoot := filepath.Join(root, "etc")
+	confDir := common.DeviceConfigDir(filepath.Join(confRoot, config.DevConfigSubdir), "/dev/sda2")
+	luks1 := config.CryptsetupLUKS1V1{Name: "luks_vol", Device: "/dev/sda2"}
+	if err := common.WriteVolume(confDir, config.VolumeJSON{Kind: config.VolumeCryptsetupLUKS1V1, Value: luks1}); err != nil {
+		t.Fatal(err)
+	}
+	for n, src := range sources {
+		pj := config.ProviderJSON{Kind: config.ProviderContentV1, Value: config.ContentV1{Source: src}}
+		if err := common.WriteKeyslot(confDir, n, pj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return common.System{Root: root, Roots: common.Roots{confRoot}}, confDir
+}
+
+func TestKey(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "unlock_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, confDir := writeTestSystem(t, tmpDir, "data:,wrong", "data:,sekrit")
+
+	al := &audit.Log{Path: filepath.Join(tmpDir, "audit.log")}
+	u := Unlocker{Cryptsetup: luks.Cryptsetup{Runner: fakeCryptsetup{key: "sekrit", slot: "1"}}, Audit: al}
+	res, err := u.Key(context.Background(), confDir)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if res.Keyslot != 1 || res.Provider != config.ProviderContentV1 || string(res.Key) != "sekrit" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	u.Cryptsetup = luks.Cryptsetup{Runner: fakeCryptsetup{key: "sekrit", slot: "0"}}
+	_, err = u.Key(context.Background(), confDir)
+	if err == nil || !strings.Contains(err.Error(), "all keyslots failed") {
+		t.Fatalf("expected keyslots failure, got %v", err)
+	}
+
+	recs, err := al.Read()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	exp := []struct {
+		keyslot int
+		result  string
+		class   string
+	}{
+		{0, audit.ResultFailure, audit.ClassVerification},
+		{1, audit.ResultSuccess, ""},
+		{0, audit.ResultFailure, audit.ClassVerification},
+		{1, audit.ResultFailure, audit.ClassVerification},
+	}
+	if len(recs) != len(exp) {
+		t.Fatalf("expected %d audit records, got %+v", len(exp), recs)
+	}
+	for i, rec := range recs {
+		if rec.Keyslot != exp[i].keyslot || rec.Result != exp[i].result || rec.ErrorClass != exp[i].class {
+			t.Fatalf("unexpected audit record %d: %+v", i, rec)
+		}
+		if rec.Volume != "luks_vol" || rec.Device != "/dev/sda2" || rec.Provider != "ContentV1" || rec.Identifiers["source"] != "data:" {
+			t.Fatalf("unexpected audit record %d: %+v", i, rec)
+		}
+		if rec.KeyslotFile != common.KeyslotPath(confDir, rec.Keyslot) || rec.Time.IsZero() {
+			t.Fatalf("unexpected audit record %d: %+v", i, rec)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "unlock_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, confDir := writeTestSystem(t, tmpDir, "data:,wrong", "data:,sekrit", "data:,other")
+
+	u := Unlocker{Cryptsetup: luks.Cryptsetup{Runner: fakeCryptsetup{key: "sekrit", slot: "1"}}}
+	checks, err := u.Check(context.Background(), confDir)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if len(checks) != 3 {
+		t.Fatalf("expected 3 keyslot checks, got %+v", checks)
+	}
+	for i, c := range checks {
+		if c.Keyslot != i || c.Provider != config.ProviderContentV1 {
+			t.Fatalf("unexpected keyslot check %d: %+v", i, c)
+		}
+		if (c.Err == nil) != (i == 1) {
+			t.Fatalf("unexpected keyslot check %d result: %v", i, c.Err)
+		}
+	}
+
+	if _, err := u.Check(context.Background(), filepath.Join(tmpDir, "missing")); err == nil {
+		t.Fatalf("expected error for missing configuration")
+	}
+}
+
+func TestHelperArgs(t *testing.T) {
+	disable, enable := true, false
+	tests := []struct {
+		disableDiscard *bool
+		exp            []string
+	}{
+		{nil, []string{"attach", "luks_vol", "/dev/block/8:2", "-"}},
+		{&enable, []string{"attach", "luks_vol", "/dev/block/8:2", "-", "discard"}},
+		{&disable, []string{"attach", "luks_vol", "/dev/block/8:2", "-"}},
+	}
+	for i, tt := range tests {
+		luks1 := config.CryptsetupLUKS1V1{Name: "luks_vol", Device: "/dev/sda2", DisableDiscard: tt.disableDiscard}
+		args, err := helperArgs(luks1, "/dev/block/8:2")
+		if err != nil {
+			t.Fatalf("#%d: unexpected error %q", i, err)
+		}
+		if !reflect.DeepEqual(args, tt.exp) {
+			t.Fatalf("#%d: expected %v, got %v", i, tt.exp, args)
+		}
+	}
+}
+
+func TestAttach(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "unlock_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	sys, _ := writeTestSystem(t, tmpDir)
+
+	argsFile := filepath.Join(tmpDir, "args")
+	helper := filepath.Join(tmpDir, "systemd-cryptsetup")
+	script := "#!/bin/sh\necho \"$@\" > " + argsFile + "\n"
+	if err := ioutil.WriteFile(helper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Attach(sys, helper, "/dev/sda2"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	out, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "attach luks_vol /dev/block/8:2 -\n"; string(out) != exp {
+		t.Fatalf("expected helper arguments %q, got %q", exp, out)
+	}
+
+	if err := Attach(sys, helper, "/dev/sdb"); err == nil {
+		t.Fatalf("expected error for missing device")
+	}
+	if err := Attach(sys, filepath.Join(tmpDir, "missing"), "/dev/sda2"); err == nil {
+		t.Fatalf("expected error for missing helper")
+	}
+}
+
+func TestPlanAttach(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "unlock_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	sys, confDir := writeTestSystem(t, tmpDir, "data:,wrong", "data:,sekrit")
+
+	// The helper must not run in dry-run mode, thus it does not exist.
+	helper := filepath.Join(tmpDir, "systemd-cryptsetup")
+	u := Unlocker{Cryptsetup: luks.Cryptsetup{Runner: fakeCryptsetup{key: "sekrit", slot: "1"}}}
+	plan, err := u.PlanAttach(context.Background(), sys, helper, "/dev/sda2")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	exp := Plan{
+		Device:      "/dev/sda2",
+		BlockDevice: "/dev/block/8:2",
+		Volume:      "luks_vol",
+		ConfigDir:   confDir,
+		Command:     []string{helper, "attach", "luks_vol", "/dev/block/8:2", "-"},
+		Keyslot:     1,
+		Provider:    "ContentV1",
+		Identifiers: map[string]string{"source": "data:"},
+	}
+	if !reflect.DeepEqual(plan, exp) {
+		t.Fatalf("expected plan %+v, got %+v", exp, plan)
+	}
+
+	u.Cryptsetup = luks.Cryptsetup{Runner: fakeCryptsetup{key: "other", slot: "1"}}
+	if _, err := u.PlanAttach(context.Background(), sys, helper, "/dev/sda2"); err == nil {
+		t.Fatalf("expected error for unverified key")
+	}
+}
+
+func TestPlanCheck(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "unlock_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	sys, confDir := writeTestSystem(t, tmpDir, "data:,wrong", "data:,sekrit", "data:,other")
+
+	helper := filepath.Join(tmpDir, "systemd-cryptsetup")
+	u := Unlocker{Cryptsetup: luks.Cryptsetup{Runner: fakeCryptsetup{key: "sekrit", slot: "1"}}}
+	plan, checks, err := u.PlanCheck(context.Background(), sys, helper, "/dev/sda2")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	exp := Plan{
+		Device:      "/dev/sda2",
+		BlockDevice: "/dev/block/8:2",
+		Volume:      "luks_vol",
+		ConfigDir:   confDir,
+		Command:     []string{helper, "attach", "luks_vol", "/dev/block/8:2", "-"},
+		Keyslot:     1,
+		Provider:    "ContentV1",
+		Identifiers: map[string]string{"source": "data:"},
+	}
+	if !reflect.DeepEqual(plan, exp) {
+		t.Fatalf("expected plan %+v, got %+v", exp, plan)
+	}
+	if len(checks) != 3 {
+		t.Fatalf("expected 3 keyslot checks, got %+v", checks)
+	}
+	for i, c := range checks {
+		if (c.Err == nil) != (i == 1) {
+			t.Fatalf("unexpected keyslot check %d result: %v", i, c.Err)
+		}
+	}
+
+	u.Cryptsetup = luks.Cryptsetup{Runner: fakeCryptsetup{key: "none", slot: "1"}}
+	_, checks, err = u.PlanCheck(context.Background(), sys, helper, "/dev/sda2")
+	if err == nil {
+		t.Fatalf("expected error for unverified keys")
+	}
+	if len(checks) != 3 {
+		t.Fatalf("expected 3 keyslot checks, got %+v", checks)
+	}
+}
+
+// fakeCommitter records commits.
+type fakeCommitter struct {
+	commits *int
+}
+
+func (f fakeCommitter) Key(ctx context.Context, req providers.Request) ([]byte, error) {
+	return []byte("sekrit"), nil
+}
+
+func (f fakeCommitter) Commit(ctx context.Context, req providers.Request) error {
+	*f.commits++
+	return nil
+}
+
+func TestCommitOnceActive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "unlock_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	defer func(dir string) { mapperDir = dir }(mapperDir)
+	mapperDir = tmpDir
+
+	commits := 0
+	res := Result{Volume: "luks_vol", committer: fakeCommitter{&commits}}
+	if !res.NeedsCommit() {
+		t.Fatalf("expected result to need a commit")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*activePollInterval)
+	defer cancel()
+	if err := WaitActive(ctx, res.Volume); err == nil {
+		t.Fatalf("expected error for inactive volume")
+	}
+
+	go func() {
+		time.Sleep(activePollInterval)
+		ioutil.WriteFile(filepath.Join(tmpDir, "luks_vol"), nil, 0600)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*activePollInterval)
+	defer cancel()
+	if err := WaitActive(ctx, res.Volume); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := res.Commit(ctx); err != nil || commits != 1 {
+		t.Fatalf("expected a single commit, got %d (%v)", commits, err)
+	}
+
+	if err := WaitActive(ctx, "../luks_vol"); err == nil {
+		t.Fatalf("expected error for invalid volume name")
+	}
+	if err := (Result{}).Commit(ctx); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+// AwsKmsV1 is the v1 configuration for an AWS KMS provider. It
+// authenticates with the static Credentials if set, and with the instance
+// profile credentials otherwise.
+type AwsKmsV1 struct {
+	Region string `json:"region"`
+	// KeyID optionally pins the KMS key which must have encrypted Ciphertext.
+	KeyID string `json:"keyID,omitempty"`
+	// Ciphertext is the base64-encoded KMS ciphertext blob, empty in
+	// configurations given to enroll.
+	Ciphertext string `json:"ciphertext"`
+	// EncryptionContext must match the context used for encryption.
+	EncryptionContext map[string]string    `json:"encryptionContext,omitempty"`
+	Credentials       *AwsKmsV1Credentials `json:"credentials,omitempty"`
+	// Endpoint overrides the regional KMS endpoint.
+	Endpoint string `json:"endpoint,omitempty"`
+	// MetadataEndpoint overrides the instance metadata service base URL.
+	MetadataEndpoint string `json:"metadataEndpoint,omitempty"`
+}
+
+// Validate checks the region, ciphertext and endpoints.
+func (a AwsKmsV1) Validate() error {
+	if a.Region == "" {
+		return errors.New("empty kms region")
+	}
+	if _, err := base64.StdEncoding.DecodeString(a.Ciphertext); err != nil {
+		return errors.New("ciphertext must be base64")
+	}
+	if a.Credentials != nil {
+		if a.Credentials.AccessKeyID == "" || a.Credentials.SecretAccessKey == "" {
+			return errors.New("credentials require accessKeyID and secretAccessKey")
+		}
+		if a.MetadataEndpoint != "" {
+			return errors.New("metadataEndpoint given with static credentials")
+		}
+	}
+	if err := validateEndpoint("kms", a.Endpoint); err != nil {
+		return err
+	}
+	return validateEndpoint("metadata", a.MetadataEndpoint)
+}
+
+// AwsKmsV1Credentials are static AWS credentials for AwsKmsV1.
+type AwsKmsV1Credentials struct {
+	AccessKeyID     string `json:"accessKeyID"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken,omitempty"`
+}
@@ -14,20 +14,109 @@
 
 package config
 
-// TODO(lucab): double-check, stabilize and make this public.
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
 
 // AzureVaultV1 is the v1 configuration for an Azure Vault provider.
-type azureVaultV1 struct {
-	BaseURL             string                    `json:"baseURL"`
-	EncryptionAlgorithm string                    `json:"encryptionAlgorithm"`
-	KeyName             string                    `json:"keyName"`
-	KeyVersion          string                    `json:"keyVersion"`
-	Ciphertext          string                    `json:"ciphertext"`
-	PasswordAuth        *azureVaultV1PasswordAuth `json:"passwordAuth"`
+//
+// Exactly one of the authentication stanzas must be set.
+type AzureVaultV1 struct {
+	BaseURL             string `json:"baseURL"`
+	EncryptionAlgorithm string `json:"encryptionAlgorithm"`
+	KeyName             string `json:"keyName"`
+	KeyVersion          string `json:"keyVersion"`
+	// Ciphertext is the base64url-encoded wrapped key. When empty, enroll
+	// wraps a new random key and fills it in.
+	Ciphertext            string                             `json:"ciphertext"`
+	PasswordAuth          *AzureVaultV1PasswordAuth          `json:"passwordAuth,omitempty"`
+	ManagedIdentityAuth   *AzureVaultV1ManagedIdentityAuth   `json:"managedIdentityAuth,omitempty"`
+	ClientCertificateAuth *AzureVaultV1ClientCertificateAuth `json:"clientCertificateAuth,omitempty"`
+}
+
+// Validate checks the vault, key and authentication settings.
+func (a AzureVaultV1) Validate() error {
+	if a.BaseURL == "" {
+		return errors.New("empty vault baseURL")
+	}
+	if err := validateEndpoint("vault", a.BaseURL); err != nil {
+		return fmt.Errorf("invalid vault baseURL: %s", err)
+	}
+	switch a.EncryptionAlgorithm {
+	case "RSA-OAEP", "RSA-OAEP-256", "RSA1_5":
+	default:
+		return fmt.Errorf("unsupported encryption algorithm %q", a.EncryptionAlgorithm)
+	}
+	if a.KeyName == "" {
+		return errors.New("empty vault key name")
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(a.Ciphertext); err != nil {
+		return errors.New("ciphertext must be base64url")
+	}
+	auths := 0
+	if pa := a.PasswordAuth; pa != nil {
+		auths++
+		if pa.TenantID == "" || pa.AppID == "" || pa.Password == "" {
+			return errors.New("passwordAuth requires tenantID, appID and password")
+		}
+		if err := validateEndpoint("authority", pa.AuthorityEndpoint); err != nil {
+			return err
+		}
+	}
+	if mi := a.ManagedIdentityAuth; mi != nil {
+		auths++
+		if err := validateEndpoint("metadata", mi.MetadataEndpoint); err != nil {
+			return err
+		}
+	}
+	if cc := a.ClientCertificateAuth; cc != nil {
+		auths++
+		if cc.TenantID == "" || cc.AppID == "" || cc.Certificate == "" || cc.Key == "" {
+			return errors.New("clientCertificateAuth requires tenantID, appID, certificate and key")
+		}
+		if err := validateEndpoint("authority", cc.AuthorityEndpoint); err != nil {
+			return err
+		}
+	}
+	if auths != 1 {
+		return errors.New("exactly one authentication method must be configured")
+	}
+	return nil
 }
 
 // AzureVaultV1PasswordAuth is the password authentication stanza for AzureVaultV1.
-type azureVaultV1PasswordAuth struct {
+type AzureVaultV1PasswordAuth struct {
+	TenantID string `json:"tenantID"`
 	AppID    string `json:"appID"`
 	Password string `json:"password"`
+	// AuthorityEndpoint overrides the Azure AD base URL.
+	AuthorityEndpoint string `json:"authorityEndpoint,omitempty"`
+}
+
+// AzureVaultV1ManagedIdentityAuth authenticates with the managed identity
+// of the instance, via the Azure instance metadata service.
+type AzureVaultV1ManagedIdentityAuth struct {
+	// ClientID selects a user-assigned identity; the system-assigned
+	// identity is used if empty.
+	ClientID string `json:"clientID,omitempty"`
+	// MetadataEndpoint overrides the instance metadata service base URL.
+	MetadataEndpoint string `json:"metadataEndpoint,omitempty"`
+}
+
+// AzureVaultV1ClientCertificateAuth authenticates an application with a
+// certificate registered in Azure AD, signing a client assertion with its
+// RSA private key.
+type AzureVaultV1ClientCertificateAuth struct {
+	TenantID string `json:"tenantID"`
+	AppID    string `json:"appID"`
+	// Certificate and Key are inline PEM documents or absolute paths under
+	// one of the active configuration roots.
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+	// KeyPassphrase retrieves the passphrase for an encrypted PEM key.
+	KeyPassphrase *ProviderJSON `json:"keyPassphrase,omitempty"`
+	// AuthorityEndpoint overrides the Azure AD base URL.
+	AuthorityEndpoint string `json:"authorityEndpoint,omitempty"`
 }
@@ -25,11 +25,23 @@ import (
 const (
 	// BaseConfigDir is the path of the base directory storing coreos-cryptagent config.
 	BaseConfigDir = "/boot/etc/coreos-cryptagent/"
+	// VendorConfigDir is the path of the directory storing vendor defaults.
+	VendorConfigDir = "/usr/lib/coreos-cryptagent/"
+	// RuntimeConfigDir is the path of the directory storing runtime overrides.
+	RuntimeConfigDir = "/run/coreos-cryptagent/"
+	// ConfigRootEnv is the environment variable overriding the configuration
+	// roots, as a colon-separated list by decreasing precedence.
+	ConfigRootEnv = "COREOS_CRYPTAGENT_CONFIG_ROOT"
+	// DevConfigSubdir is the subdirectory of a configuration root for
+	// devices/volumes configuration files.
+	DevConfigSubdir = "dev"
 )
 
 var (
 	// DevConfigDir is the base directory for devices/volumes configuration files.
-	DevConfigDir = filepath.Join(BaseConfigDir, "dev")
+	DevConfigDir = filepath.Join(BaseConfigDir, DevConfigSubdir)
+	// DefaultConfigRoots are the configuration roots, by decreasing precedence.
+	DefaultConfigRoots = []string{RuntimeConfigDir, BaseConfigDir, VendorConfigDir}
 )
 
 // VolumeKind is an enum of volume kinds.
@@ -71,6 +83,16 @@ func (vk VolumeKind) MarshalJSON() ([]byte, error) {
 	return json.Marshal(s)
 }
 
+// String returns the name of the volume kind, as used in JSON.
+func (vk VolumeKind) String() string {
+	switch vk {
+	case VolumeCryptsetupLUKS1V1:
+		return "CryptsetupLUKS1V1"
+	default:
+		return "Invalid"
+	}
+}
+
 // ProviderKind is an enum of provider kinds.
 type ProviderKind int
 
@@ -83,6 +105,20 @@ const (
 	ProviderAzureVaultV1
 	// ProviderHcVaultV1 represents an HashiCorp Vault (v1) config
 	ProviderHcVaultV1
+	// ProviderExecV1 represents an external executable (v1) config
+	ProviderExecV1
+	// ProviderAwsKmsV1 represents an AWS KMS (v1) config
+	ProviderAwsKmsV1
+	// ProviderGcpKmsV1 represents a Google Cloud KMS (v1) config
+	ProviderGcpKmsV1
+	// ProviderPkcs11V1 represents a PKCS#11 token (v1) config
+	ProviderPkcs11V1
+	// ProviderEtcdV1 represents an etcd (v1) config
+	ProviderEtcdV1
+	// ProviderKeyFileV1 represents a key file on a block device (v1) config
+	ProviderKeyFileV1
+	// ProviderInteractiveV1 represents an interactive prompt (v1) config
+	ProviderInteractiveV1
 )
 
 // UnmarshalJSON is part of the json.Unmarshaler interface.
@@ -95,9 +131,23 @@ func (vk *ProviderKind) UnmarshalJSON(b []byte) error {
 	case "ContentV1":
 		*vk = ProviderContentV1
 	case "AzureVaultV1":
-		return errors.New("azure-vault unimplemented")
+		*vk = ProviderAzureVaultV1
 	case "HcVaultV1":
 		return errors.New("hc-vault unimplemented")
+	case "ExecV1":
+		*vk = ProviderExecV1
+	case "AwsKmsV1":
+		*vk = ProviderAwsKmsV1
+	case "GcpKmsV1":
+		*vk = ProviderGcpKmsV1
+	case "Pkcs11V1":
+		*vk = ProviderPkcs11V1
+	case "EtcdV1":
+		*vk = ProviderEtcdV1
+	case "KeyFileV1":
+		*vk = ProviderKeyFileV1
+	case "InteractiveV1":
+		*vk = ProviderInteractiveV1
 	default:
 		return errors.New("unknown kind")
 	}
@@ -105,6 +155,34 @@ func (vk *ProviderKind) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// String returns the name of the provider kind, as used in JSON.
+func (vk ProviderKind) String() string {
+	switch vk {
+	case ProviderContentV1:
+		return "ContentV1"
+	case ProviderAzureVaultV1:
+		return "AzureVaultV1"
+	case ProviderHcVaultV1:
+		return "HcVaultV1"
+	case ProviderExecV1:
+		return "ExecV1"
+	case ProviderAwsKmsV1:
+		return "AwsKmsV1"
+	case ProviderGcpKmsV1:
+		return "GcpKmsV1"
+	case ProviderPkcs11V1:
+		return "Pkcs11V1"
+	case ProviderEtcdV1:
+		return "EtcdV1"
+	case ProviderKeyFileV1:
+		return "KeyFileV1"
+	case ProviderInteractiveV1:
+		return "InteractiveV1"
+	default:
+		return "Invalid"
+	}
+}
+
 // MarshalJSON is part of the json.Marshaler interface.
 func (vk ProviderKind) MarshalJSON() ([]byte, error) {
 	var s string
@@ -112,9 +190,23 @@ func (vk ProviderKind) MarshalJSON() ([]byte, error) {
 	case ProviderContentV1:
 		s = "ContentV1"
 	case ProviderAzureVaultV1:
-		return nil, errors.New("azure-vault unimplemented")
+		s = "AzureVaultV1"
 	case ProviderHcVaultV1:
 		return nil, errors.New("hc-vault unimplemented")
+	case ProviderExecV1:
+		s = "ExecV1"
+	case ProviderAwsKmsV1:
+		s = "AwsKmsV1"
+	case ProviderGcpKmsV1:
+		s = "GcpKmsV1"
+	case ProviderPkcs11V1:
+		s = "Pkcs11V1"
+	case ProviderEtcdV1:
+		s = "EtcdV1"
+	case ProviderKeyFileV1:
+		s = "KeyFileV1"
+	case ProviderInteractiveV1:
+		s = "InteractiveV1"
 	default:
 		return nil, errors.New("unknown kind")
 	}
@@ -14,12 +14,125 @@
 
 package config
 
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
 // ContentV1 is the v1 configuration for a generic remote content provider.
+//
+// Supported source schemes are `https`, `http`, `data`, `file`, `tftp` and
+// `s3`. Scheme-specific options are only allowed for the source scheme.
 type ContentV1 struct {
-	Source   string             `json:"source"`
-	Timeouts *ContentV1Timeouts `json:"timeouts,omitempty"`
-	//TODO(lucab): specify this better
-	CertificateAuthorities []ContentV1CertAuth `json:"certificateAuthorities,omitempty"`
+	Source       string                 `json:"source"`
+	Verification *ContentV1Verification `json:"verification,omitempty"`
+	Timeouts     *ContentV1Timeouts     `json:"timeouts,omitempty"`
+	// CertificateAuthorities are additional trusted CAs for HTTPS sources.
+	CertificateAuthorities []ContentV1CertAuth  `json:"certificateAuthorities,omitempty"`
+	ClientCertificate      *ContentV1ClientCert `json:"clientCertificate,omitempty"`
+	File                   *ContentV1File       `json:"file,omitempty"`
+	TFTP                   *ContentV1TFTP       `json:"tftp,omitempty"`
+	S3                     *ContentV1S3         `json:"s3,omitempty"`
+	// Envelope describes how the fetched payload is wrapped, if at all.
+	Envelope *ContentV1Envelope `json:"envelope,omitempty"`
+}
+
+// Validate checks the source URL and its scheme-specific options.
+func (c ContentV1) Validate() error {
+	if c.Source == "" {
+		return errors.New("empty content source")
+	}
+	u, err := url.Parse(c.Source)
+	if err != nil {
+		return fmt.Errorf("invalid content source %q: %s", c.Source, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "data":
+	case "file":
+		if u.Host != "" {
+			return fmt.Errorf("file source %q must not have a host", c.Source)
+		}
+		root := "/boot"
+		if c.File != nil {
+			if !filepath.IsAbs(c.File.Root) {
+				return fmt.Errorf("file root %q is not absolute", c.File.Root)
+			}
+			root = c.File.Root
+		}
+		if !underRoot(u.Path, root) {
+			return fmt.Errorf("file source %q is not an absolute path under %s", c.Source, root)
+		}
+	case "tftp":
+		if u.Host == "" {
+			return fmt.Errorf("tftp source %q has no host", c.Source)
+		}
+		if c.TFTP != nil && (c.TFTP.Timeout < 0 || c.TFTP.Retries < 0) {
+			return errors.New("negative tftp timeout or retries")
+		}
+	case "s3":
+		if u.Host == "" || u.Path == "" || u.Path == "/" {
+			return fmt.Errorf("s3 source %q must be in the form s3://bucket/key", c.Source)
+		}
+		if c.S3 == nil {
+			return errors.New("s3 source without s3 options")
+		}
+		if c.S3.Region == "" {
+			return errors.New("s3 options require a region")
+		}
+		static := c.S3.AccessKeyID != "" || c.S3.SecretAccessKey != "" || c.S3.SessionToken != ""
+		if static && (c.S3.AccessKeyID == "" || c.S3.SecretAccessKey == "") {
+			return errors.New("s3 static credentials require accessKeyID and secretAccessKey")
+		}
+		if static && c.S3.MetadataEndpoint != "" {
+			return errors.New("metadataEndpoint given with s3 static credentials")
+		}
+		if err := validateEndpoint("s3", c.S3.Endpoint); err != nil {
+			return err
+		}
+		if err := validateEndpoint("metadata", c.S3.MetadataEndpoint); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported content source scheme %q", u.Scheme)
+	}
+
+	if c.File != nil && u.Scheme != "file" {
+		return fmt.Errorf("file options given for %s source", u.Scheme)
+	}
+	if c.TFTP != nil && u.Scheme != "tftp" {
+		return fmt.Errorf("tftp options given for %s source", u.Scheme)
+	}
+	if c.S3 != nil && u.Scheme != "s3" {
+		return fmt.Errorf("s3 options given for %s source", u.Scheme)
+	}
+
+	if c.Envelope != nil {
+		switch c.Envelope.Kind {
+		case EnvelopeJWE, EnvelopeAge, EnvelopeAESGCM:
+		default:
+			return fmt.Errorf("unsupported envelope kind %q", c.Envelope.Kind)
+		}
+		if c.Envelope.Key == nil {
+			return errors.New("envelope without key provider")
+		}
+	}
+	return nil
+}
+
+// underRoot reports whether `path` is absolute and, once cleaned, under `root`.
+func underRoot(path, root string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	prefix := filepath.Clean(root)
+	if prefix != "/" {
+		prefix += "/"
+	}
+	return strings.HasPrefix(filepath.Clean(path), prefix)
 }
 
 // ContentV1Timeouts records HTTPS client timeouts
@@ -30,6 +143,80 @@ type ContentV1Timeouts struct {
 
 // ContentV1CertAuth records HTTPS client custom CAs
 type ContentV1CertAuth struct {
-	//TODO(lucab): store PEM here? Or just a path?
-	Authority string `json:"authority"`
+	// Authority is a PEM certificate bundle, either inline, as a `data:`
+	// URL or as a `file:` URL under `/boot`.
+	Authority    string                 `json:"authority"`
+	Verification *ContentV1Verification `json:"verification,omitempty"`
+}
+
+// ContentV1Verification records the expected digest of fetched content.
+type ContentV1Verification struct {
+	// Hash is formatted as `<function>-<hex digest>`, where function is
+	// either `sha512` or `sha256`.
+	Hash string `json:"hash"`
+}
+
+// ContentV1ClientCert records an HTTPS client certificate, presented
+// to the server for mutual TLS authentication.
+//
+// Both `Certificate` and `Key` are either inline PEM documents, or absolute
+// paths to PEM files under one of the active configuration roots.
+type ContentV1ClientCert struct {
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+	// KeyPassphrase retrieves the passphrase for an encrypted PEM `Key`.
+	KeyPassphrase *ProviderJSON `json:"keyPassphrase,omitempty"`
+}
+
+// ContentV1File records options for `file://` sources.
+type ContentV1File struct {
+	// Root is the directory absolute source paths must be under (default:
+	// `/boot`).
+	Root string `json:"root"`
+}
+
+// ContentV1TFTP records options for `tftp://` sources.
+type ContentV1TFTP struct {
+	// Timeout is the per-packet timeout, in seconds.
+	Timeout int `json:"timeout,omitempty"`
+	Retries int `json:"retries,omitempty"`
+}
+
+// ContentV1S3 records options for `s3://bucket/key` sources.
+//
+// Requests are signed with the static credentials if set, and with the EC2
+// instance profile credentials otherwise.
+type ContentV1S3 struct {
+	// Endpoint is the base URL of an S3-compatible service (default: AWS).
+	Endpoint        string `json:"endpoint,omitempty"`
+	Region          string `json:"region"`
+	AccessKeyID     string `json:"accessKeyID,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	SessionToken    string `json:"sessionToken,omitempty"`
+	// MetadataEndpoint overrides the EC2 instance metadata service base URL.
+	MetadataEndpoint string `json:"metadataEndpoint,omitempty"`
+	// PathStyle addresses buckets as `endpoint/bucket/key` instead of
+	// `bucket.endpoint/key`.
+	PathStyle bool `json:"pathStyle,omitempty"`
+}
+
+// Envelope kinds for ContentV1Envelope.
+const (
+	// EnvelopeJWE is a JWE compact serialization, with `dir` or `A*KW` key
+	// management.
+	EnvelopeJWE = "JWE"
+	// EnvelopeAge is an age (v1) file encrypted to an X25519 recipient.
+	EnvelopeAge = "age"
+	// EnvelopeAESGCM is a 12-byte nonce followed by AES-256-GCM ciphertext,
+	// with the key derived via HKDF-SHA256 from the envelope key material.
+	EnvelopeAESGCM = "AESGCM"
+)
+
+// ContentV1Envelope describes how a ContentV1 payload is encrypted.
+type ContentV1Envelope struct {
+	Kind string `json:"kind"`
+	// Key retrieves the key material to decrypt the payload: a raw or JWK
+	// symmetric key for JWE, an `AGE-SECRET-KEY-1...` identity for age, or
+	// any secret for AESGCM.
+	Key *ProviderJSON `json:"key"`
 }
@@ -36,3 +36,54 @@ func TestProviderJSONUmarshal(t *testing.T) {
 	}
 
 }
+
+func TestContentV1Validate(t *testing.T) {
+	s3 := &ContentV1S3{Region: "us-east-1", AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	envKey := &ProviderJSON{Kind: ProviderContentV1, Value: ContentV1{Source: "data:,secret"}}
+	tests := []struct {
+		cfg    ContentV1
+		expErr bool
+	}{
+		{ContentV1{}, true},
+		{ContentV1{Source: "gopher://localhost/key"}, true},
+		{ContentV1{Source: "https://localhost/key.txt"}, false},
+		{ContentV1{Source: "data:,key"}, false},
+		{ContentV1{Source: "file:///boot/keys/node.key"}, false},
+		{ContentV1{Source: "file:///keys/node.key"}, true},
+		{ContentV1{Source: "file:///boot/../etc/shadow"}, true},
+		{ContentV1{Source: "file:///etc/keys/node.key", File: &ContentV1File{Root: "/"}}, false},
+		{ContentV1{Source: "file:///keys/node.key", File: &ContentV1File{Root: "relative"}}, true},
+		{ContentV1{Source: "file://host/keys/node.key"}, true},
+		{ContentV1{Source: "tftp://10.0.0.1/node.key"}, false},
+		{ContentV1{Source: "tftp:///node.key"}, true},
+		{ContentV1{Source: "s3://bucket/node.key", S3: s3}, false},
+		{ContentV1{Source: "s3://bucket/node.key"}, true},
+		{ContentV1{Source: "s3://bucket", S3: s3}, true},
+		{ContentV1{Source: "s3://bucket/node.key", S3: &ContentV1S3{Region: "us-east-1"}}, false},
+		{ContentV1{Source: "s3://bucket/node.key", S3: &ContentV1S3{AccessKeyID: "AKID", SecretAccessKey: "secret"}}, true},
+		{ContentV1{Source: "s3://bucket/node.key", S3: &ContentV1S3{Region: "us-east-1", AccessKeyID: "AKID"}}, true},
+		{ContentV1{Source: "s3://bucket/node.key", S3: &ContentV1S3{Region: "us-east-1", AccessKeyID: "AKID", SecretAccessKey: "secret", MetadataEndpoint: "http://169.254.169.254"}}, true},
+		{ContentV1{Source: "s3://bucket/node.key", S3: &ContentV1S3{Region: "us-east-1", AccessKeyID: "AKID", SecretAccessKey: "secret", Endpoint: "minio:9000"}}, true},
+		{ContentV1{Source: "https://localhost/key.txt", S3: s3}, true},
+		{ContentV1{Source: "https://localhost/key.txt", TFTP: &ContentV1TFTP{}}, true},
+		{ContentV1{Source: "data:,key", Envelope: &ContentV1Envelope{Kind: EnvelopeAge, Key: envKey}}, false},
+		{ContentV1{Source: "data:,key", Envelope: &ContentV1Envelope{Kind: "PGP", Key: envKey}}, true},
+		{ContentV1{Source: "data:,key", Envelope: &ContentV1Envelope{Kind: EnvelopeJWE}}, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.cfg.Validate()
+		if tt.expErr && err == nil {
+			t.Fatalf("expected error for %+v", tt.cfg)
+		}
+		if !tt.expErr && err != nil {
+			t.Fatalf("unexpected error %q for %+v", err, tt.cfg)
+		}
+	}
+
+	invalid := `{"kind": "ContentV1", "value": {"source": "s3://bucket/node.key"}}`
+	var pj ProviderJSON
+	if err := json.NewDecoder(strings.NewReader(invalid)).Decode(&pj); err == nil {
+		t.Fatalf("expected error decoding %s", invalid)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+)
+
+// EtcdV1 is the v1 configuration for an etcd (v3 API) provider.
+type EtcdV1 struct {
+	// Endpoints are tried in order, until one of them answers.
+	Endpoints []string `json:"endpoints"`
+	Key       string   `json:"key"`
+	// OneTimeRead deletes the key (and revokes its lease, if any) once it
+	// has been verified to unlock the volume.
+	OneTimeRead            bool                 `json:"oneTimeRead,omitempty"`
+	CertificateAuthorities []ContentV1CertAuth  `json:"certificateAuthorities,omitempty"`
+	ClientCertificate      *ContentV1ClientCert `json:"clientCertificate,omitempty"`
+	Auth                   *EtcdV1Auth          `json:"auth,omitempty"`
+	// Timeout is the maximum duration of each request, in seconds.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// Validate checks the endpoints, key and authentication settings.
+func (e EtcdV1) Validate() error {
+	if len(e.Endpoints) == 0 {
+		return errors.New("no etcd endpoints")
+	}
+	for _, ep := range e.Endpoints {
+		if ep == "" {
+			return errors.New("empty etcd endpoint")
+		}
+		if err := validateEndpoint("etcd", ep); err != nil {
+			return err
+		}
+	}
+	if e.Key == "" {
+		return errors.New("empty etcd key")
+	}
+	if e.Auth != nil && (e.Auth.Username == "" || e.Auth.Password == nil) {
+		return errors.New("etcd auth requires username and password")
+	}
+	if e.Timeout < 0 {
+		return errors.New("negative etcd timeout")
+	}
+	return nil
+}
+
+// EtcdV1Auth is the username/password authentication stanza for EtcdV1.
+type EtcdV1Auth struct {
+	Username string `json:"username"`
+	// Password retrieves the user password.
+	Password *ProviderJSON `json:"password"`
+}
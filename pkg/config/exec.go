@@ -0,0 +1,70 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// MaxExecV1Timeout is the maximum runtime limit (in seconds) for ExecV1.
+const MaxExecV1Timeout = 300
+
+// ExecV1 is the v1 configuration for an external key-fetching executable.
+type ExecV1 struct {
+	Path string            `json:"path"`
+	Args []string          `json:"args,omitempty"`
+	Env  map[string]string `json:"env,omitempty"`
+	// Timeout is the maximum runtime of the executable, in seconds.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// Validate checks the executable path and the timeout.
+func (e ExecV1) Validate() error {
+	if e.Path == "" {
+		return errors.New("empty executable path")
+	}
+	if !filepath.IsAbs(e.Path) {
+		return fmt.Errorf("executable path %s is not absolute", e.Path)
+	}
+	if e.Timeout < 0 || e.Timeout > MaxExecV1Timeout {
+		return fmt.Errorf("invalid timeout %d, must be within 1 and %d seconds", e.Timeout, MaxExecV1Timeout)
+	}
+	return nil
+}
+
+// ExecV1Request is the request written by cryptagent to the standard input
+// of an ExecV1 executable.
+type ExecV1Request struct {
+	Version    int    `json:"version"`
+	Device     string `json:"device"`
+	VolumeName string `json:"volumeName"`
+	Keyslot    int    `json:"keyslot"`
+}
+
+// ExecV1Response is the response read by cryptagent from the standard output
+// of an ExecV1 executable. Exactly one of its fields must be set.
+type ExecV1Response struct {
+	// Key is the base64-encoded key material.
+	Key   string       `json:"key,omitempty"`
+	Error *ExecV1Error `json:"error,omitempty"`
+}
+
+// ExecV1Error is a structured error reported by an ExecV1 executable.
+type ExecV1Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
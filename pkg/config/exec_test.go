@@ -0,0 +1,72 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExecV1Unmarshal(t *testing.T) {
+	test := `
+{
+  "kind": "ExecV1",
+  "value": {
+    "path": "/usr/lib/cryptagent/hsm-gateway",
+    "args": ["--profile", "prod"],
+    "env": {"GATEWAY": "https://hsm.example.com"},
+    "timeout": 15
+  }
+}
+`
+	var pj ProviderJSON
+	err := json.NewDecoder(strings.NewReader(test)).Decode(&pj)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	v, ok := pj.Value.(ExecV1)
+	if !ok {
+		t.Fatalf("unexpected value type %T", pj.Value)
+	}
+	if v.Path != "/usr/lib/cryptagent/hsm-gateway" || len(v.Args) != 2 || v.Env["GATEWAY"] == "" || v.Timeout != 15 {
+		t.Fatalf("unexpected value %+v", v)
+	}
+
+	out, err := json.Marshal(pj)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !strings.Contains(string(out), `"kind":"ExecV1"`) {
+		t.Fatalf("unexpected serialization %s", out)
+	}
+}
+
+func TestExecV1UnmarshalInvalid(t *testing.T) {
+	tests := []string{
+		`{"kind": "ExecV1"}`,
+		`{"kind": "ExecV1", "value": null}`,
+		`{"kind": "ExecV1", "value": {}}`,
+		`{"kind": "ExecV1", "value": {"path": "hsm-gateway"}}`,
+		`{"kind": "ExecV1", "value": {"path": "/usr/lib/cryptagent/hsm-gateway", "timeout": -1}}`,
+		`{"kind": "ExecV1", "value": {"path": "/usr/lib/cryptagent/hsm-gateway", "timeout": 301}}`,
+	}
+	for i, tt := range tests {
+		var pj ProviderJSON
+		if err := json.Unmarshal([]byte(tt), &pj); err == nil {
+			t.Fatalf("#%d: expected error for %s", i, tt)
+		}
+	}
+}
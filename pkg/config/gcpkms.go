@@ -0,0 +1,57 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+// GcpKmsV1 is the v1 configuration for a Google Cloud KMS provider. It
+// authenticates with the ServiceAccountKey if set, and with the instance
+// service account otherwise.
+type GcpKmsV1 struct {
+	Project  string `json:"project"`
+	Location string `json:"location"`
+	KeyRing  string `json:"keyRing"`
+	Key      string `json:"key"`
+	// Ciphertext is the base64-encoded output of a KMS encryption. It is
+	// generated by enroll if empty.
+	Ciphertext string `json:"ciphertext"`
+	// ServiceAccountKey is a service account JSON key, either inline or as
+	// an absolute path under one of the active configuration roots.
+	ServiceAccountKey string `json:"serviceAccountKey,omitempty"`
+	// Endpoint overrides the Cloud KMS API base URL.
+	Endpoint string `json:"endpoint,omitempty"`
+	// MetadataEndpoint overrides the metadata server base URL.
+	MetadataEndpoint string `json:"metadataEndpoint,omitempty"`
+}
+
+// Validate checks the key name, ciphertext and endpoints.
+func (g GcpKmsV1) Validate() error {
+	if g.Project == "" || g.Location == "" || g.KeyRing == "" || g.Key == "" {
+		return errors.New("project, location, keyRing and key are required")
+	}
+	if _, err := base64.StdEncoding.DecodeString(g.Ciphertext); err != nil {
+		return errors.New("ciphertext must be base64")
+	}
+	if g.ServiceAccountKey != "" && g.MetadataEndpoint != "" {
+		return errors.New("metadataEndpoint given with a service account key")
+	}
+	if err := validateEndpoint("kms", g.Endpoint); err != nil {
+		return err
+	}
+	return validateEndpoint("metadata", g.MetadataEndpoint)
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// InteractiveV1 is the v1 configuration for an interactive passphrase
+// prompt, through Plymouth if a splash is running or on a terminal otherwise.
+//
+// It is usually configured on the last keyslot, as a fallback for all other
+// providers.
+type InteractiveV1 struct {
+	// Tries is the maximum number of passphrases to ask for (default 3).
+	Tries int `json:"tries,omitempty"`
+	// TTY is the terminal to prompt on without Plymouth (default /dev/console).
+	TTY string `json:"tty,omitempty"`
+}
+
+// Validate checks the number of tries and the terminal path.
+func (i InteractiveV1) Validate() error {
+	if i.Tries < 0 {
+		return errors.New("negative number of tries")
+	}
+	if i.TTY != "" && !strings.HasPrefix(i.TTY, "/dev/") {
+		return fmt.Errorf("invalid terminal %q", i.TTY)
+	}
+	return nil
+}
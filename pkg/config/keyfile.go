@@ -0,0 +1,71 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// keyFileDevicePrefixes are the accepted tags for KeyFileV1 devices, as in
+// fstab and crypttab.
+var keyFileDevicePrefixes = []string{"UUID=", "LABEL=", "PARTUUID=", "PARTLABEL="}
+
+// KeyFileV1 is the v1 configuration for a key file stored on another block
+// device, like the "key on removable media" setups of crypttab.
+type KeyFileV1 struct {
+	// Device is either a `UUID=`, `LABEL=`, `PARTUUID=` or `PARTLABEL=` tag,
+	// or an absolute path under /dev.
+	Device string `json:"device"`
+	// Path is the absolute path of the key file within the filesystem of
+	// the device. If empty, the key is read from the raw device.
+	Path string `json:"path,omitempty"`
+	// FsType is the filesystem type, all known types are tried if empty.
+	FsType string `json:"fsType,omitempty"`
+	// Offset is the number of bytes to skip, as crypttab's keyfile-offset.
+	Offset int64 `json:"offset,omitempty"`
+	// Size is the number of bytes to read, as crypttab's keyfile-size.
+	Size int64 `json:"size,omitempty"`
+	// Timeout is the maximum duration to wait for the device, in seconds.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// Validate checks the device reference and the key location.
+func (k KeyFileV1) Validate() error {
+	valid := strings.HasPrefix(k.Device, "/dev/")
+	for _, prefix := range keyFileDevicePrefixes {
+		if strings.HasPrefix(k.Device, prefix) && len(k.Device) > len(prefix) {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid key file device %q", k.Device)
+	}
+	if k.Path != "" && !filepath.IsAbs(k.Path) {
+		return fmt.Errorf("key file path %q is not absolute", k.Path)
+	}
+	if k.Path == "" && k.Size == 0 {
+		return errors.New("size is required to read a key from a raw device")
+	}
+	if strings.ContainsAny(k.FsType, ", ") {
+		return fmt.Errorf("invalid filesystem type %q", k.FsType)
+	}
+	if k.Offset < 0 || k.Size < 0 || k.Timeout < 0 {
+		return errors.New("negative offset, size or timeout")
+	}
+	return nil
+}
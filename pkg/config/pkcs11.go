@@ -0,0 +1,59 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// Pkcs11V1 is the v1 configuration for a PKCS#11 provider, unwrapping a
+// key with a private key object stored in a token.
+type Pkcs11V1 struct {
+	// Module is the absolute path of the PKCS#11 module to load.
+	Module     string `json:"module"`
+	TokenLabel string `json:"tokenLabel"`
+	// Pin retrieves the user PIN of the token.
+	Pin      *ProviderJSON `json:"pin"`
+	KeyLabel string        `json:"keyLabel"`
+	// Mechanism is one of "RSA-OAEP", "RSA-OAEP-256" or "RSA1_5".
+	Mechanism string `json:"mechanism"`
+	// Ciphertext is the base64-encoded wrapped key.
+	Ciphertext string `json:"ciphertext"`
+}
+
+// Validate checks the module path, token and key settings.
+func (p Pkcs11V1) Validate() error {
+	if !filepath.IsAbs(p.Module) {
+		return fmt.Errorf("module path %q is not absolute", p.Module)
+	}
+	if p.TokenLabel == "" || p.KeyLabel == "" {
+		return errors.New("tokenLabel and keyLabel are required")
+	}
+	if p.Pin == nil {
+		return errors.New("missing pin provider")
+	}
+	switch p.Mechanism {
+	case "RSA-OAEP", "RSA-OAEP-256", "RSA1_5":
+	default:
+		return fmt.Errorf("unsupported mechanism %q", p.Mechanism)
+	}
+	if _, err := base64.StdEncoding.DecodeString(p.Ciphertext); err != nil || p.Ciphertext == "" {
+		return errors.New("ciphertext must be non-empty base64")
+	}
+	return nil
+}
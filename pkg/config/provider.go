@@ -17,6 +17,8 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/url"
 )
 
 // ProviderJSON is the top-level configuration container for a provider.
@@ -35,6 +37,9 @@ func (pj *ProviderJSON) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(b, &tmp); err != nil {
 		return err
 	}
+	if tmp.Value == nil {
+		return errors.New("missing value")
+	}
 
 	switch tmp.Kind {
 	case ProviderContentV1:
@@ -42,15 +47,111 @@ func (pj *ProviderJSON) UnmarshalJSON(b []byte) error {
 		if err := json.Unmarshal(*tmp.Value, &v); err != nil {
 			return err
 		}
+		if err := v.Validate(); err != nil {
+			return err
+		}
 		pj.Kind = tmp.Kind
 		pj.Value = v
 	case ProviderAzureVaultV1:
-		return errors.New("azure-vault unimplemented")
+		var v AzureVaultV1
+		if err := json.Unmarshal(*tmp.Value, &v); err != nil {
+			return err
+		}
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		pj.Kind = tmp.Kind
+		pj.Value = v
 	case ProviderHcVaultV1:
 		return errors.New("hc-vault unimplemented")
+	case ProviderExecV1:
+		var v ExecV1
+		if err := json.Unmarshal(*tmp.Value, &v); err != nil {
+			return err
+		}
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		pj.Kind = tmp.Kind
+		pj.Value = v
+	case ProviderAwsKmsV1:
+		var v AwsKmsV1
+		if err := json.Unmarshal(*tmp.Value, &v); err != nil {
+			return err
+		}
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		pj.Kind = tmp.Kind
+		pj.Value = v
+	case ProviderGcpKmsV1:
+		var v GcpKmsV1
+		if err := json.Unmarshal(*tmp.Value, &v); err != nil {
+			return err
+		}
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		pj.Kind = tmp.Kind
+		pj.Value = v
+	case ProviderPkcs11V1:
+		var v Pkcs11V1
+		if err := json.Unmarshal(*tmp.Value, &v); err != nil {
+			return err
+		}
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		pj.Kind = tmp.Kind
+		pj.Value = v
+	case ProviderEtcdV1:
+		var v EtcdV1
+		if err := json.Unmarshal(*tmp.Value, &v); err != nil {
+			return err
+		}
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		pj.Kind = tmp.Kind
+		pj.Value = v
+	case ProviderKeyFileV1:
+		var v KeyFileV1
+		if err := json.Unmarshal(*tmp.Value, &v); err != nil {
+			return err
+		}
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		pj.Kind = tmp.Kind
+		pj.Value = v
+	case ProviderInteractiveV1:
+		var v InteractiveV1
+		if err := json.Unmarshal(*tmp.Value, &v); err != nil {
+			return err
+		}
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		pj.Kind = tmp.Kind
+		pj.Value = v
 	default:
 		return errors.New("unknown kind")
 	}
 
 	return nil
 }
+
+// validateEndpoint checks an optional HTTP(S) endpoint override.
+func validateEndpoint(name string, endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid %s endpoint %q: %s", name, endpoint, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid %s endpoint %q, expected an HTTP(S) URL with a host", name, endpoint)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCloudProvidersUnmarshal(t *testing.T) {
+	tests := []struct {
+		json   string
+		expErr bool
+	}{
+		{`{"kind": "AwsKmsV1", "value": {"region": "us-east-1", "ciphertext": "AQID"}}`, false},
+		{`{"kind": "AwsKmsV1", "value": {"ciphertext": "AQID"}}`, true},
+		{`{"kind": "AwsKmsV1", "value": {"region": "us-east-1", "ciphertext": "not base64!"}}`, true},
+		{`{"kind": "AwsKmsV1", "value": {"region": "us-east-1", "ciphertext": "AQID", "endpoint": "localhost:4566"}}`, true},
+		{`{"kind": "AwsKmsV1", "value": {"region": "us-east-1", "ciphertext": "AQID", "encryptionContext": {"volume": "data"}, "credentials": {"accessKeyID": "AKID", "secretAccessKey": "s"}}}`, false},
+		{`{"kind": "AwsKmsV1", "value": {"region": "us-east-1", "ciphertext": "AQID", "credentials": {"accessKeyID": "AKID"}}}`, true},
+		{`{"kind": "GcpKmsV1", "value": {"project": "p", "location": "global", "keyRing": "r", "key": "k", "ciphertext": "AQID"}}`, false},
+		{`{"kind": "GcpKmsV1", "value": {"project": "p", "location": "global", "key": "k", "ciphertext": "AQID"}}`, true},
+		{`{"kind": "GcpKmsV1", "value": {"project": "p", "location": "global", "keyRing": "r", "key": "k", "ciphertext": "AQID", "serviceAccountKey": "/boot/etc/coreos-cryptagent/gcp/sa.json"}}`, false},
+		{`{"kind": "GcpKmsV1", "value": {"project": "p", "location": "global", "keyRing": "r", "key": "k", "ciphertext": "AQID", "serviceAccountKey": "/boot/etc/coreos-cryptagent/gcp/sa.json", "metadataEndpoint": "http://localhost"}}`, true},
+		{`{"kind": "AzureVaultV1", "value": {"baseURL": "https://v.vault.azure.net", "encryptionAlgorithm": "RSA-OAEP", "keyName": "k", "ciphertext": "AQID", "managedIdentityAuth": {}}}`, false},
+		{`{"kind": "AzureVaultV1", "value": {"baseURL": "https://v.vault.azure.net", "encryptionAlgorithm": "RSA-OAEP", "keyName": "k", "ciphertext": "AQID"}}`, true},
+		{`{"kind": "AzureVaultV1", "value": {"baseURL": "https://v.vault.azure.net", "encryptionAlgorithm": "AES", "keyName": "k", "ciphertext": "AQID", "managedIdentityAuth": {}}}`, true},
+		{`{"kind": "AzureVaultV1", "value": {"encryptionAlgorithm": "RSA-OAEP", "keyName": "k", "ciphertext": "AQID", "managedIdentityAuth": {}}}`, true},
+		{`{"kind": "AzureVaultV1", "value": {"baseURL": "https://v.vault.azure.net", "encryptionAlgorithm": "RSA-OAEP", "keyName": "k", "ciphertext": "AQID", "managedIdentityAuth": {}, "passwordAuth": {"tenantID": "t", "appID": "a", "password": "p"}}}`, true},
+		{`{"kind": "AzureVaultV1", "value": {"baseURL": "https://v.vault.azure.net", "encryptionAlgorithm": "RSA-OAEP", "keyName": "k", "ciphertext": "AQID", "passwordAuth": {"appID": "a", "password": "p"}}}`, true},
+		{`{"kind": "AzureVaultV1", "value": {"baseURL": "https://v.vault.azure.net", "encryptionAlgorithm": "RSA-OAEP", "keyName": "k", "ciphertext": "AQID", "clientCertificateAuth": {"tenantID": "t", "appID": "a", "certificate": "/boot/etc/coreos-cryptagent/app.crt", "key": "/boot/etc/coreos-cryptagent/app.key"}}}`, false},
+		{`{"kind": "AzureVaultV1", "value": {"baseURL": "https://v.vault.azure.net", "encryptionAlgorithm": "RSA-OAEP", "keyName": "k", "ciphertext": "AQID", "clientCertificateAuth": {"tenantID": "t", "appID": "a", "key": "/boot/etc/coreos-cryptagent/app.key"}}}`, true},
+		{`{"kind": "Pkcs11V1", "value": {"module": "/usr/lib64/pkcs11/libsofthsm2.so", "tokenLabel": "t", "keyLabel": "k", "mechanism": "RSA-OAEP", "ciphertext": "AQID", "pin": {"kind": "ContentV1", "value": {"source": "data:,1234"}}}}`, false},
+		{`{"kind": "Pkcs11V1", "value": {"module": "libsofthsm2.so", "tokenLabel": "t", "keyLabel": "k", "mechanism": "RSA-OAEP", "ciphertext": "AQID", "pin": {"kind": "ContentV1", "value": {"source": "data:,1234"}}}}`, true},
+		{`{"kind": "Pkcs11V1", "value": {"module": "/usr/lib64/pkcs11/libsofthsm2.so", "tokenLabel": "t", "keyLabel": "k", "mechanism": "AES-GCM", "ciphertext": "AQID", "pin": {"kind": "ContentV1", "value": {"source": "data:,1234"}}}}`, true},
+		{`{"kind": "Pkcs11V1", "value": {"module": "/usr/lib64/pkcs11/libsofthsm2.so", "tokenLabel": "t", "keyLabel": "k", "mechanism": "RSA-OAEP", "ciphertext": "AQID"}}`, true},
+		{`{"kind": "EtcdV1", "value": {"endpoints": ["https://10.0.0.1:2379"], "key": "/cryptagent/node-1", "oneTimeRead": true}}`, false},
+		{`{"kind": "EtcdV1", "value": {"endpoints": ["10.0.0.1:2379"], "key": "/cryptagent/node-1"}}`, true},
+		{`{"kind": "EtcdV1", "value": {"endpoints": [], "key": "/cryptagent/node-1"}}`, true},
+		{`{"kind": "EtcdV1", "value": {"endpoints": ["https://10.0.0.1:2379"], "key": "/k", "auth": {"username": "root"}}}`, true},
+		{`{"kind": "KeyFileV1", "value": {"device": "LABEL=KEYS", "path": "/luks/root.key", "offset": 1024, "size": 64}}`, false},
+		{`{"kind": "KeyFileV1", "value": {"device": "/dev/disk/by-id/usb-key-part1", "size": 512, "timeout": 30}}`, false},
+		{`{"kind": "KeyFileV1", "value": {"device": "UUID=", "path": "/root.key"}}`, true},
+		{`{"kind": "KeyFileV1", "value": {"device": "LABEL=KEYS", "path": "root.key"}}`, true},
+		{`{"kind": "KeyFileV1", "value": {"device": "LABEL=KEYS"}}`, true},
+		{`{"kind": "KeyFileV1", "value": {"device": "LABEL=KEYS", "path": "/root.key", "offset": -1}}`, true},
+		{`{"kind": "InteractiveV1", "value": {}}`, false},
+		{`{"kind": "InteractiveV1", "value": {"tries": 5, "tty": "/dev/tty1"}}`, false},
+		{`{"kind": "InteractiveV1", "value": {"tty": "tty1"}}`, true},
+		{`{"kind": "InteractiveV1", "value": {"tries": -1}}`, true},
+		{`{"kind": "HcVaultV1", "value": {}}`, true},
+	}
+
+	for _, tt := range tests {
+		var pj ProviderJSON
+		err := json.Unmarshal([]byte(tt.json), &pj)
+		if tt.expErr && err == nil {
+			t.Fatalf("expected error for %s", tt.json)
+		}
+		if !tt.expErr && err != nil {
+			t.Fatalf("unexpected error %q for %s", err, tt.json)
+		}
+		if err != nil {
+			continue
+		}
+		out, err := json.Marshal(pj)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		var back ProviderJSON
+		if err := json.Unmarshal(out, &back); err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+		if back.Kind != pj.Kind {
+			t.Fatalf("expected kind %s, got %s", pj.Kind, back.Kind)
+		}
+	}
+}
+
+func TestValidateEndpointErrors(t *testing.T) {
+	tests := []struct {
+		cfg    AzureVaultV1
+		expErr string
+	}{
+		{AzureVaultV1{}, "empty vault baseURL"},
+		{AzureVaultV1{BaseURL: "v.vault.azure.net"}, "expected an HTTP(S) URL"},
+		{AzureVaultV1{BaseURL: "https://v.vault.azure.net/%zz"}, "invalid URL escape"},
+	}
+
+	for _, tt := range tests {
+		err := tt.cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.expErr) {
+			t.Fatalf("expected error containing %q for %q, got %v", tt.expErr, tt.cfg.BaseURL, err)
+		}
+	}
+}